@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/joshkunz/fakelib/export"
+)
+
+var (
+	archiveOutput = flag.String("archive_output", "-", "File written by \"fakelib archive\", or - for stdout")
+	archiveFormat = flag.String("archive_format", "", "Archive format of \"fakelib archive\". One of: tar, tar.gz, tar.zst (compressed by the external zstd command, which must be on the PATH), zip. Defaults to the format matching the extension of --archive_output, or tar")
+)
+
+// runArchive writes the library as a single archive.
+func runArchive() {
+	if flag.NArg() > 1 {
+		log.Fatalf("usage: fakelib archive [--archive_output=out.tar] [--archive_format=tar|tar.gz|tar.zst|zip] [golden.mp3]\n" +
+			"tar.zst archives are compressed by the external zstd command, which must be on the PATH")
+	}
+
+	format := export.Tar
+	if *archiveFormat != "" {
+		var err error
+		if format, err = export.ParseFormat(*archiveFormat); err != nil {
+			log.Fatalf("invalid --archive_format: %v", err)
+		}
+	} else if f, ok := export.FormatOf(*archiveOutput); ok {
+		format = f
+	}
+
+	out := os.Stdout
+	if *archiveOutput != "-" {
+		var err error
+		if out, err = os.Create(*archiveOutput); err != nil {
+			log.Fatal(err)
+		}
+	} else if info, err := out.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		log.Fatalf("refusing to write an archive to a terminal, redirect stdout or use --archive_output")
+	}
+
+	lib := newLibrary(flag.Arg(0))
+	start := time.Now()
+	w := bufio.NewWriterSize(out, 1<<20)
+	err := export.Archive(lib, w, format)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if errors.Is(err, export.ErrZstdUnavailable) {
+		log.Fatalf("%v: install zstd, or use another --archive_format", err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("archived %d songs as %v in %v", lib.Tracks, format, time.Since(start).Round(time.Millisecond))
+}
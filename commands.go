@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/bogem/id3v2/v2"
+
+	"github.com/joshkunz/fakelib/control"
+	"github.com/joshkunz/fakelib/filesystem"
+)
+
+const commandUsage = `commands:
+  resize <tracks>                  grow or shrink the library to <tracks> songs
+  add <n>                          add <n> songs to the end of the library
+  remove <lo> <hi>                 remove songs with index in [lo, hi)
+  retag <lo> <hi> <field> <value>  set <field> (artist, album, title, genre, year) of songs in [lo, hi)
+  move <index> <path>              move the song at <index> to <path>
+  fault <key=value>...             add a fault, e.g. "fault op=read errno=EIO rate=0.1"
+  faults                           list the current faults
+  clear-faults                     remove all faults`
+
+func atoi(args []string) ([]int, error) {
+	out := make([]int, len(args))
+	for i, a := range args {
+		n, err := strconv.Atoi(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", a)
+		}
+		out[i] = n
+	}
+	return out, nil
+}
+
+// runCommand parses and applies a single command to the mounted library.
+// Output of commands like help is written to `out`.
+func runCommand(server *filesystem.Server, out io.Writer, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd, args := fields[0], fields[1:]
+	switch cmd {
+	case "help":
+		fmt.Fprintln(out, commandUsage)
+		return nil
+	case "faults":
+		for _, f := range server.Faults() {
+			fmt.Fprintln(out, f)
+		}
+		return nil
+	case "clear-faults":
+		server.SetFaults(nil)
+		return nil
+	}
+
+	wantArgs := map[string]int{"resize": 1, "add": 1, "remove": 2, "retag": 4, "move": 2, "fault": 1}
+	want, ok := wantArgs[cmd]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", cmd, commandUsage)
+	}
+	if len(args) < want {
+		return fmt.Errorf("%s: want %d arguments, got %d\n%s", cmd, want, len(args), commandUsage)
+	}
+
+	switch cmd {
+	case "resize", "add":
+		n, err := atoi(args[:1])
+		if err != nil {
+			return err
+		}
+		if cmd == "add" {
+			n[0] += server.Tracks()
+		}
+		return server.Resize(n[0])
+	case "remove":
+		r, err := atoi(args[:2])
+		if err != nil {
+			return err
+		}
+		return server.Remove(r[0], r[1])
+	case "retag":
+		r, err := atoi(args[:2])
+		if err != nil {
+			return err
+		}
+		field, value := args[2], strings.Join(args[3:], " ")
+		if err := control.SetField(id3v2.NewEmptyTag(), field, value); err != nil {
+			return err
+		}
+		return server.Retag(r[0], r[1], func(_ int, tag *id3v2.Tag) {
+			control.SetField(tag, field, value)
+		})
+	case "move":
+		idx, err := atoi(args[:1])
+		if err != nil {
+			return err
+		}
+		return server.Move(idx[0], strings.Join(args[1:], " "))
+	case "fault":
+		f, err := filesystem.ParseFault(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		server.SetFaults(append(server.Faults(), f))
+	}
+	return nil
+}
+
+// runCommands reads commands from `r`, one per line, and applies them to the
+// mounted library until `r` is exhausted. Their output is written to `out`.
+func runCommands(server *filesystem.Server, r io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := runCommand(server, out, scanner.Text()); err != nil {
+			log.Printf("command %q failed: %v", scanner.Text(), err)
+			continue
+		}
+		fmt.Fprintf(out, "ok: %s\n", scanner.Text())
+	}
+}
@@ -0,0 +1,383 @@
+/*
+Package control provides an HTTP API to query and change a mounted library,
+so test harnesses can drive a running fakelib mount instead of restarting it
+for every scenario.
+
+Typical Usage:
+
+	server, err := filesystem.MountWithOptions(lib, dir, nil)
+	if err != nil {
+	    ...
+	}
+
+	l, err := control.Listen("unix:/tmp/fakelib.sock")
+	if err != nil {
+	    ...
+	}
+	go http.Serve(l, control.NewHandler(server, nil))
+
+Requests and responses are JSON. Errors are reported as {"error": "..."}
+with a 4xx or 5xx status. The endpoints are:
+
+	GET    /stats               counts of the library's songs and directories
+	GET    /songs/<index>       the path of a song, as {"index": 3, "path": "A/A/D.mp3"}
+	GET    /songs?path=<path>   the index of a song, in the same format
+	GET    /faults              the current faults, as {"faults": ["op=read errno=EIO rate=0.1"]}
+	PUT    /faults              replace the faults, in the same format
+	DELETE /faults              remove all faults
+	POST   /resize              {"tracks": 100}
+	POST   /remove              {"lo": 0, "hi": 10}
+	POST   /retag               {"lo": 0, "hi": 10, "field": "artist", "value": "X"}
+	POST   /move                {"index": 3, "path": "X/Y/Z.mp3"}
+	POST   /unmount             unmount the library
+
+Requests that change the library respond with the library's stats after the
+change.
+*/
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/bogem/id3v2/v2"
+
+	"github.com/joshkunz/fakelib/filesystem"
+	"github.com/joshkunz/fakelib/library"
+)
+
+// Library is a mounted library that can be controlled. It is implemented by
+// filesystem.Server.
+type Library interface {
+	Stats() filesystem.Stats
+	PathAt(idx int) (string, error)
+	Index(p string) (int, bool)
+	Faults() []filesystem.Fault
+	SetFaults(faults []filesystem.Fault)
+	Resize(tracks int) error
+	Remove(lo, hi int) error
+	Retag(lo, hi int, f func(idx int, tag *id3v2.Tag)) error
+	Move(idx int, p string) error
+}
+
+var _ Library = (*filesystem.Server)(nil)
+
+// Handler is an http.Handler that serves the control API of a library.
+type Handler struct {
+	lib     Library
+	unmount func()
+}
+
+// NewHandler returns a Handler that controls `lib`. `unmount` is called
+// after responding to a request to /unmount, and should unmount the library
+// (usually from another goroutine). If it is nil, /unmount is not found.
+func NewHandler(lib Library, unmount func()) *Handler {
+	return &Handler{lib: lib, unmount: unmount}
+}
+
+// Listen listens for connections to the control API on `addr`. Addresses
+// starting with "unix:" are Unix socket paths, e.g. "unix:/tmp/fakelib.sock".
+// A stale socket at that path, which refuses connections, is removed first.
+// An error is returned if the path is a socket in use, or is not a socket.
+// Other addresses are TCP addresses, which must be on a loopback interface,
+// e.g. "localhost:9090", since the API is not authenticated.
+func Listen(addr string) (net.Listener, error) {
+	if sock, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if err := removeStale(sock); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", sock)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("control address %q is not a loopback address", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// removeStale removes the Unix socket at `sock` if it exists, and no process
+// accepts connections on it any more.
+func removeStale(sock string) error {
+	info, err := os.Lstat(sock)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%q already exists and is not a socket", sock)
+	}
+	conn, err := net.Dial("unix", sock)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %q is in use by another process", sock)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("failed to check whether socket %q is stale: %w", sock, err)
+	}
+	return os.Remove(sock)
+}
+
+// SetField sets the tag field with the given name (artist, album, title,
+// genre or year) to `value`.
+func SetField(tag *id3v2.Tag, field, value string) error {
+	switch field {
+	case "artist":
+		tag.SetArtist(value)
+	case "album":
+		tag.SetAlbum(value)
+	case "title":
+		tag.SetTitle(value)
+	case "genre":
+		tag.SetGenre(value)
+	case "year":
+		tag.SetYear(value)
+	default:
+		return fmt.Errorf("unknown tag field %q", field)
+	}
+	return nil
+}
+
+// Stats is the response to /stats.
+type Stats struct {
+	Tracks   int                 `json:"tracks"`
+	Songs    int                 `json:"songs"`
+	Dirs     int                 `json:"dirs"`
+	Faults   int                 `json:"faults"`
+	TagCache *library.CacheStats `json:"tag_cache,omitempty"`
+}
+
+// Song is the response to /songs.
+type Song struct {
+	Index int    `json:"index"`
+	Path  string `json:"path"`
+}
+
+// Faults is the request and response of /faults. Faults are in the format
+// of filesystem.ParseFault.
+type Faults struct {
+	Faults []string `json:"faults"`
+}
+
+// Change is the request to /resize, /remove, /retag and /move. Each uses a
+// subset of the fields.
+type Change struct {
+	Tracks *int   `json:"tracks,omitempty"`
+	Lo     *int   `json:"lo,omitempty"`
+	Hi     *int   `json:"hi,omitempty"`
+	Index  *int   `json:"index,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// statusError is an error with an HTTP status.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+func badRequest(format string, args ...any) error {
+	return &statusError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+var errNotFound = &statusError{http.StatusNotFound, errors.New("not found")}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.serve(r)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		var se *statusError
+		if errors.As(err, &se) {
+			status = se.status
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+	if r.URL.Path == "/unmount" {
+		// Make sure the response is sent before the library is unmounted,
+		// which may stop the process.
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		h.unmount()
+	}
+}
+
+// methods returns an error unless the request's method is one of `allowed`.
+func methods(r *http.Request, allowed ...string) error {
+	for _, m := range allowed {
+		if r.Method == m {
+			return nil
+		}
+	}
+	return &statusError{http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed, want %s", r.Method, strings.Join(allowed, " or "))}
+}
+
+// serve handles a request, and returns the value to respond with.
+func (h *Handler) serve(r *http.Request) (any, error) {
+	p := r.URL.Path
+	switch {
+	case p == "/stats":
+		if err := methods(r, http.MethodGet); err != nil {
+			return nil, err
+		}
+		return h.stats(), nil
+	case p == "/songs" || strings.HasPrefix(p, "/songs/"):
+		if err := methods(r, http.MethodGet); err != nil {
+			return nil, err
+		}
+		return h.song(r)
+	case p == "/faults":
+		if err := methods(r, http.MethodGet, http.MethodPut, http.MethodDelete); err != nil {
+			return nil, err
+		}
+		return h.faults(r)
+	case p == "/resize" || p == "/remove" || p == "/retag" || p == "/move":
+		if err := methods(r, http.MethodPost); err != nil {
+			return nil, err
+		}
+		var c Change
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			return nil, badRequest("invalid request: %v", err)
+		}
+		if err := h.change(strings.TrimPrefix(p, "/"), c); err != nil {
+			return nil, err
+		}
+		return h.stats(), nil
+	case p == "/unmount" && h.unmount != nil:
+		if err := methods(r, http.MethodPost); err != nil {
+			return nil, err
+		}
+		return struct{}{}, nil
+	}
+	return nil, errNotFound
+}
+
+func (h *Handler) stats() Stats {
+	s := h.lib.Stats()
+	return Stats{
+		Tracks:   s.Tracks,
+		Songs:    s.Songs,
+		Dirs:     s.Dirs,
+		Faults:   len(h.lib.Faults()),
+		TagCache: s.TagCache,
+	}
+}
+
+// song looks up a song by index (/songs/<index>) or path (/songs?path=...).
+func (h *Handler) song(r *http.Request) (Song, error) {
+	if idx, ok := strings.CutPrefix(r.URL.Path, "/songs/"); ok {
+		n, err := strconv.Atoi(idx)
+		if err != nil {
+			return Song{}, badRequest("invalid index %q", idx)
+		}
+		p, err := h.lib.PathAt(n)
+		if err != nil {
+			return Song{}, &statusError{http.StatusNotFound, err}
+		}
+		return Song{Index: n, Path: p}, nil
+	}
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		return Song{}, badRequest("want /songs/<index> or /songs?path=<path>")
+	}
+	idx, ok := h.lib.Index(p)
+	if !ok {
+		return Song{}, &statusError{http.StatusNotFound, fmt.Errorf("no song at %q", p)}
+	}
+	return Song{Index: idx, Path: p}, nil
+}
+
+func (h *Handler) faults(r *http.Request) (Faults, error) {
+	switch r.Method {
+	case http.MethodPut:
+		var req Faults
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return Faults{}, badRequest("invalid request: %v", err)
+		}
+		faults := make([]filesystem.Fault, len(req.Faults))
+		for i, spec := range req.Faults {
+			f, err := filesystem.ParseFault(spec)
+			if err != nil {
+				return Faults{}, badRequest("%v", err)
+			}
+			faults[i] = f
+		}
+		h.lib.SetFaults(faults)
+	case http.MethodDelete:
+		h.lib.SetFaults(nil)
+	}
+	resp := Faults{Faults: []string{}}
+	for _, f := range h.lib.Faults() {
+		resp.Faults = append(resp.Faults, f.String())
+	}
+	return resp, nil
+}
+
+// change applies a /resize, /remove, /retag or /move request.
+func (h *Handler) change(op string, c Change) error {
+	// require returns an error if any of `fields` is unset. `names` are
+	// the names of the fields.
+	require := func(names string, fields ...*int) error {
+		for i, v := range fields {
+			if v == nil {
+				return badRequest("%s: missing %q", op, strings.Fields(names)[i])
+			}
+		}
+		return nil
+	}
+
+	var err error
+	switch op {
+	case "resize":
+		if err := require("tracks", c.Tracks); err != nil {
+			return err
+		}
+		err = h.lib.Resize(*c.Tracks)
+	case "remove":
+		if err := require("lo hi", c.Lo, c.Hi); err != nil {
+			return err
+		}
+		err = h.lib.Remove(*c.Lo, *c.Hi)
+	case "retag":
+		if err := require("lo hi", c.Lo, c.Hi); err != nil {
+			return err
+		}
+		if err := SetField(id3v2.NewEmptyTag(), c.Field, c.Value); err != nil {
+			return badRequest("%v", err)
+		}
+		err = h.lib.Retag(*c.Lo, *c.Hi, func(_ int, tag *id3v2.Tag) {
+			SetField(tag, c.Field, c.Value)
+		})
+	case "move":
+		if err := require("index", c.Index); err != nil {
+			return err
+		}
+		if c.Path == "" {
+			return badRequest("%s: missing \"path\"", op)
+		}
+		err = h.lib.Move(*c.Index, c.Path)
+	}
+	if err != nil {
+		// Changes fail because of bad indices or paths.
+		return badRequest("%s: %v", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bogem/id3v2/v2"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/joshkunz/fakelib/filesystem"
+	"github.com/joshkunz/fakelib/library"
+)
+
+// fakeLibrary is a library of songs at "<index>.mp3" that records every
+// change made to it.
+type fakeLibrary struct {
+	tracks int
+	faults []filesystem.Fault
+	tags   map[int]*id3v2.Tag
+	log    []string
+}
+
+func (f *fakeLibrary) Stats() filesystem.Stats {
+	return filesystem.Stats{Tracks: f.tracks, Songs: f.tracks, TagCache: &library.CacheStats{Hits: 1}}
+}
+
+func (f *fakeLibrary) PathAt(idx int) (string, error) {
+	if idx < 0 || idx >= f.tracks {
+		return "", fmt.Errorf("index %d out of range", idx)
+	}
+	return fmt.Sprintf("%d.mp3", idx), nil
+}
+
+func (f *fakeLibrary) Index(p string) (int, bool) {
+	var idx int
+	if _, err := fmt.Sscanf(p, "%d.mp3", &idx); err != nil || idx >= f.tracks {
+		return 0, false
+	}
+	return idx, true
+}
+
+func (f *fakeLibrary) Faults() []filesystem.Fault { return f.faults }
+
+func (f *fakeLibrary) SetFaults(faults []filesystem.Fault) { f.faults = faults }
+
+func (f *fakeLibrary) Resize(tracks int) error {
+	f.log = append(f.log, fmt.Sprintf("resize %d", tracks))
+	f.tracks = tracks
+	return nil
+}
+
+func (f *fakeLibrary) Remove(lo, hi int) error {
+	if hi > f.tracks {
+		return fmt.Errorf("index %d out of range", hi)
+	}
+	f.log = append(f.log, fmt.Sprintf("remove %d %d", lo, hi))
+	return nil
+}
+
+func (f *fakeLibrary) Retag(lo, hi int, fn func(int, *id3v2.Tag)) error {
+	for idx := lo; idx < hi; idx++ {
+		tag := id3v2.NewEmptyTag()
+		fn(idx, tag)
+		f.tags[idx] = tag
+	}
+	f.log = append(f.log, fmt.Sprintf("retag %d %d", lo, hi))
+	return nil
+}
+
+func (f *fakeLibrary) Move(idx int, p string) error {
+	f.log = append(f.log, fmt.Sprintf("move %d %s", idx, p))
+	return nil
+}
+
+func newServer(t *testing.T, unmount func()) (*httptest.Server, *fakeLibrary) {
+	t.Helper()
+	lib := &fakeLibrary{tracks: 10, tags: make(map[int]*id3v2.Tag)}
+	srv := httptest.NewServer(NewHandler(lib, unmount))
+	t.Cleanup(srv.Close)
+	return srv, lib
+}
+
+// do sends a request with the JSON `body` (unless it is empty), and returns
+// the response status, and decoded body.
+func do(t *testing.T, method, url, body string) (int, map[string]any) {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s %s has Content-Type %q, want application/json", method, url, ct)
+	}
+	var out map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("%s %s returned invalid JSON: %v", method, url, err)
+	}
+	return resp.StatusCode, out
+}
+
+func TestQueries(t *testing.T) {
+	srv, _ := newServer(t, nil)
+
+	for _, test := range []struct {
+		method, path string
+		wantStatus   int
+		want         map[string]any
+	}{
+		{"GET", "/stats", 200, map[string]any{
+			"tracks": 10.0, "songs": 10.0, "dirs": 0.0, "faults": 0.0,
+			"tag_cache": map[string]any{"hits": 1.0, "misses": 0.0, "evictions": 0.0, "entries": 0.0, "bytes": 0.0},
+		}},
+		{"GET", "/songs/3", 200, map[string]any{"index": 3.0, "path": "3.mp3"}},
+		{"GET", "/songs?path=7.mp3", 200, map[string]any{"index": 7.0, "path": "7.mp3"}},
+		{"GET", "/songs/12", 404, nil},
+		{"GET", "/songs/x", 400, nil},
+		{"GET", "/songs?path=12.mp3", 404, nil},
+		{"GET", "/songs", 400, nil},
+		{"POST", "/stats", 405, nil},
+		{"GET", "/nothing", 404, nil},
+		{"POST", "/unmount", 404, nil},
+	} {
+		status, got := do(t, test.method, srv.URL+test.path, "")
+		if status != test.wantStatus {
+			t.Errorf("%s %s = %d, want %d", test.method, test.path, status, test.wantStatus)
+		}
+		if test.want == nil {
+			if _, ok := got["error"]; !ok {
+				t.Errorf("%s %s = %v, want an error", test.method, test.path, got)
+			}
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s %s diff (want -> got):\n%s", test.method, test.path, diff)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	srv, lib := newServer(t, nil)
+
+	for _, test := range []struct {
+		path, body string
+		wantStatus int
+	}{
+		{"/resize", `{"tracks": 20}`, 200},
+		{"/remove", `{"lo": 0, "hi": 5}`, 200},
+		{"/retag", `{"lo": 5, "hi": 7, "field": "artist", "value": "X"}`, 200},
+		{"/move", `{"index": 3, "path": "A/B.mp3"}`, 200},
+		{"/resize", `{}`, 400},
+		{"/remove", `{"lo": 0}`, 400},
+		{"/remove", `{"lo": 0, "hi": 50}`, 400},
+		{"/retag", `{"lo": 5, "hi": 7, "field": "color", "value": "X"}`, 400},
+		{"/move", `{"index": 3}`, 400},
+		{"/move", `not json`, 400},
+	} {
+		status, got := do(t, "POST", srv.URL+test.path, test.body)
+		if status != test.wantStatus {
+			t.Errorf("POST %s %s = %d (%v), want %d", test.path, test.body, status, got, test.wantStatus)
+		}
+	}
+
+	want := []string{"resize 20", "remove 0 5", "retag 5 7", "move 3 A/B.mp3"}
+	if diff := cmp.Diff(want, lib.log); diff != "" {
+		t.Errorf("Changes diff (want -> got):\n%s", diff)
+	}
+	if got := lib.tags[6].Artist(); got != "X" {
+		t.Errorf("Artist of song 6 = %q, want X", got)
+	}
+
+	if status, _ := do(t, "GET", srv.URL+"/resize", ""); status != 405 {
+		t.Errorf("GET /resize = %d, want 405", status)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	srv, lib := newServer(t, nil)
+
+	status, got := do(t, "PUT", srv.URL+"/faults", `{"faults": ["op=read errno=EIO rate=0.5"]}`)
+	if status != 200 {
+		t.Fatalf("PUT /faults = %d (%v), want 200", status, got)
+	}
+	if len(lib.faults) != 1 || lib.faults[0].Ops != filesystem.OpRead {
+		t.Errorf("Faults after PUT /faults = %v, want one read fault", lib.faults)
+	}
+	want := map[string]any{"faults": []any{lib.faults[0].String()}}
+	if _, got := do(t, "GET", srv.URL+"/faults", ""); !cmp.Equal(want, got) {
+		t.Errorf("GET /faults = %v, want %v", got, want)
+	}
+
+	if status, _ := do(t, "PUT", srv.URL+"/faults", `{"faults": ["op=nope"]}`); status != 400 {
+		t.Errorf("PUT /faults with an invalid fault = %d, want 400", status)
+	}
+	if len(lib.faults) != 1 {
+		t.Errorf("Faults were changed by an invalid PUT /faults: %v", lib.faults)
+	}
+
+	want = map[string]any{"faults": []any{}}
+	if _, got := do(t, "DELETE", srv.URL+"/faults", ""); !cmp.Equal(want, got) {
+		t.Errorf("DELETE /faults = %v, want %v", got, want)
+	}
+	if len(lib.faults) != 0 {
+		t.Errorf("Faults after DELETE /faults = %v, want none", lib.faults)
+	}
+}
+
+func TestUnmount(t *testing.T) {
+	unmounted := make(chan struct{})
+	srv, _ := newServer(t, func() { close(unmounted) })
+
+	if status, got := do(t, "POST", srv.URL+"/unmount", ""); status != 200 {
+		t.Fatalf("POST /unmount = %d (%v), want 200", status, got)
+	}
+	select {
+	case <-unmounted:
+	case <-time.After(5 * time.Second):
+		t.Errorf("POST /unmount did not unmount the library")
+	}
+}
+
+func TestListen(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "control.sock")
+	// Listening twice removes the stale socket.
+	for i := 0; i < 2; i++ {
+		l, err := Listen("unix:" + sock)
+		if err != nil {
+			t.Fatalf("Listen(%q) = _, %v; want _, nil", "unix:"+sock, err)
+		}
+		// Keep the socket file, like a crashed process would.
+		l.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+		l.Close()
+	}
+
+	// A socket in use is not removed.
+	l, err := Listen("unix:" + sock)
+	if err != nil {
+		t.Fatalf("Listen(%q) = _, %v; want _, nil", "unix:"+sock, err)
+	}
+	if l2, err := Listen("unix:" + sock); err == nil {
+		l2.Close()
+		t.Errorf("Listen(%q) while the socket is in use = _, nil; want an error", "unix:"+sock)
+	}
+	l.Close()
+
+	// Nor is a file that isn't a socket.
+	file := filepath.Join(t.TempDir(), "control.txt")
+	if err := os.WriteFile(file, []byte("keep me"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", file, err)
+	}
+	if l, err := Listen("unix:" + file); err == nil {
+		l.Close()
+		t.Errorf("Listen(%q) on a regular file = _, nil; want an error", "unix:"+file)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Stat(%s) after Listen = %v, want nil", file, err)
+	}
+
+	l, err = Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(\"127.0.0.1:0\") = _, %v; want _, nil", err)
+	}
+	l.Close()
+	if _, err := Listen("0.0.0.0:0"); err == nil {
+		t.Errorf("Listen(\"0.0.0.0:0\") = _, nil; want an error")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/joshkunz/fakelib/export"
+)
+
+var (
+	exportWorkers  = flag.Int("export_workers", 0, "Number of songs written in parallel by \"fakelib export\". Defaults to --build_workers")
+	exportSparse   = flag.Bool("export_sparse", false, "Write sparse files with \"fakelib export\", skipping blocks of zeros")
+	exportReflink  = flag.Bool("export_reflink", false, "Share audio data between songs with copy-on-write clones with \"fakelib export\", where the filesystem supports it")
+	exportHardLink = flag.Bool("export_hardlink", false, "Hard link songs with identical contents with \"fakelib export\"")
+)
+
+// runExport writes the library to a directory.
+func runExport() {
+	var goldenPath, outDir string
+	switch flag.NArg() {
+	case 1:
+		outDir = flag.Arg(0)
+	case 2:
+		goldenPath, outDir = flag.Arg(0), flag.Arg(1)
+	default:
+		log.Fatalf("usage: fakelib export [golden.mp3] out/")
+	}
+
+	lib := newLibrary(goldenPath)
+	start := time.Now()
+	err := export.Export(lib, outDir, &export.Options{
+		Workers:  *exportWorkers,
+		Sparse:   *exportSparse,
+		Reflink:  *exportReflink,
+		HardLink: *exportHardLink,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("exported %d songs to %q in %v\n", lib.Tracks, outDir, time.Since(start).Round(time.Millisecond))
+}
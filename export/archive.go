@@ -0,0 +1,268 @@
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/joshkunz/fakelib/library"
+)
+
+// Format is an archive format.
+type Format int
+
+const (
+	// Tar is an uncompressed tar archive.
+	Tar Format = iota
+	// TarGzip is a gzip-compressed tar archive.
+	TarGzip
+	// TarZstd is a zstd-compressed tar archive. Compression is done by the
+	// zstd command, which must be installed.
+	TarZstd
+	// Zip is a zip archive. Songs are stored without compression, since
+	// MP3s don't compress well.
+	Zip
+)
+
+var formatNames = []string{"tar", "tar.gz", "tar.zst", "zip"}
+
+// formatExtensions are the file extensions of each format, including
+// the common short forms of compressed tar archives.
+var formatExtensions = map[string]Format{
+	".tar":     Tar,
+	".tar.gz":  TarGzip,
+	".tgz":     TarGzip,
+	".tar.zst": TarZstd,
+	".tzst":    TarZstd,
+	".zip":     Zip,
+}
+
+func (f Format) String() string {
+	if int(f) >= 0 && int(f) < len(formatNames) {
+		return formatNames[f]
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat returns the format with the given name, as returned by
+// Format.String.
+func ParseFormat(name string) (Format, error) {
+	for i, n := range formatNames {
+		if n == name {
+			return Format(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown archive format %q, want one of %s", name, strings.Join(formatNames, ", "))
+}
+
+// FormatOf returns the format of an archive named `name`, based on its
+// extension, and false if the extension is not known.
+func FormatOf(name string) (Format, bool) {
+	name = strings.ToLower(name)
+	for ext, f := range formatExtensions {
+		// No extension is a suffix of another, so at most one matches.
+		if strings.HasSuffix(name, ext) {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// ErrZstdUnavailable is returned when a TarZstd archive is requested, but
+// the zstd command is not installed.
+var ErrZstdUnavailable = errors.New("zstd compression requires the zstd command")
+
+// archiver writes the entries of an archive. Directories have a trailing
+// slash.
+type archiver interface {
+	writeDir(name string, modTime time.Time) error
+	writeFile(name string, modTime time.Time, content []byte) error
+	Close() error
+}
+
+// Archive writes every song in `lib` to `w` as an archive in the given
+// format. Songs have the same paths and modification times as in a mounted
+// library. The archive is streamed: only one song is held in memory at a
+// time, so libraries much larger than memory can be archived.
+func Archive(lib *library.Library, w io.Writer, format Format) (err error) {
+	paths, err := lib.Paths()
+	if err != nil {
+		return fmt.Errorf("failed to generate library paths: %w", err)
+	}
+	times := dirTimes(lib, paths)
+
+	var a archiver
+	switch format {
+	case Tar:
+		a = &tarArchiver{w: tar.NewWriter(w)}
+	case TarGzip:
+		gz := gzip.NewWriter(w)
+		a = &tarArchiver{w: tar.NewWriter(gz), compressor: gz}
+	case TarZstd:
+		zst, err := newZstdWriter(w)
+		if err != nil {
+			return err
+		}
+		a = &tarArchiver{w: tar.NewWriter(zst), compressor: zst}
+	case Zip:
+		a = &zipArchiver{w: zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("unknown archive format %v", format)
+	}
+	defer func() {
+		if cerr := a.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	var content []byte
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := paths.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			p := path.Join(dir, e.Name)
+			if e.IsDir() {
+				if err := a.writeDir(p+"/", times[p]); err != nil {
+					return err
+				}
+				if err := walk(p); err != nil {
+					return err
+				}
+				continue
+			}
+			song, err := lib.SongAt(e.Index)
+			if err != nil {
+				return err
+			}
+			if int64(cap(content)) < song.Size() {
+				content = make([]byte, song.Size())
+			}
+			content = content[:song.Size()]
+			song.ReadAt(content, 0)
+			if err := a.writeFile(p, song.ModTime(), content); err != nil {
+				return fmt.Errorf("failed to archive song %d: %w", e.Index, err)
+			}
+		}
+		return nil
+	}
+	return walk(".")
+}
+
+type tarArchiver struct {
+	w *tar.Writer
+	// compressor, if set, is closed after the tar writer.
+	compressor io.WriteCloser
+}
+
+func (a *tarArchiver) writeDir(name string, modTime time.Time) error {
+	return a.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  modTime,
+	})
+}
+
+func (a *tarArchiver) writeFile(name string, modTime time.Time, content []byte) error {
+	err := a.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.w.Write(content)
+	return err
+}
+
+func (a *tarArchiver) Close() error {
+	err := a.w.Close()
+	if a.compressor != nil {
+		if cerr := a.compressor.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type zipArchiver struct {
+	w *zip.Writer
+}
+
+func (a *zipArchiver) writeDir(name string, modTime time.Time) error {
+	fh := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modTime,
+	}
+	fh.SetMode(fs.ModeDir | 0755)
+	_, err := a.w.CreateHeader(fh)
+	return err
+}
+
+func (a *zipArchiver) writeFile(name string, modTime time.Time, content []byte) error {
+	fh := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modTime,
+	}
+	fh.SetMode(0644)
+	w, err := a.w.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+func (a *zipArchiver) Close() error {
+	return a.w.Close()
+}
+
+// zstdWriter compresses data written to it with the zstd command.
+type zstdWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+func newZstdWriter(w io.Writer) (*zstdWriter, error) {
+	bin, err := exec.LookPath("zstd")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrZstdUnavailable, err)
+	}
+	z := &zstdWriter{cmd: exec.Command(bin, "-q", "-c")}
+	z.cmd.Stdout = w
+	z.cmd.Stderr = &z.stderr
+	if z.WriteCloser, err = z.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := z.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start zstd: %w", err)
+	}
+	return z, nil
+}
+
+// Close finishes the compressed stream, and waits for zstd to exit.
+func (z *zstdWriter) Close() error {
+	z.WriteCloser.Close()
+	if err := z.cmd.Wait(); err != nil {
+		return fmt.Errorf("zstd failed: %v: %s", err, strings.TrimSpace(z.stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+// archiveEntry is a file or directory read back from an archive.
+type archiveEntry struct {
+	content []byte
+	modTime time.Time
+	isDir   bool
+}
+
+func readTar(t *testing.T, r io.Reader) map[string]archiveEntry {
+	t.Helper()
+	entries := make(map[string]archiveEntry)
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar archive: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Failed to read %s from tar archive: %v", h.Name, err)
+		}
+		entries[h.Name] = archiveEntry{content: content, modTime: h.ModTime, isDir: h.Typeflag == tar.TypeDir}
+	}
+}
+
+func readZip(t *testing.T, b []byte) map[string]archiveEntry {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("Failed to read zip archive: %v", err)
+	}
+	entries := make(map[string]archiveEntry)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s in zip archive: %v", f.Name, err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Failed to read %s from zip archive: %v", f.Name, err)
+		}
+		entries[f.Name] = archiveEntry{content: content, modTime: f.Modified, isDir: f.FileInfo().IsDir()}
+	}
+	return entries
+}
+
+func TestArchive(t *testing.T) {
+	lib := newLibrary(t, 50)
+	paths, err := lib.Paths()
+	if err != nil {
+		t.Fatalf("lib.Paths() = _, %v; want _, nil", err)
+	}
+	var tagged int
+	tagger := lib.Tagger
+	lib.Tagger = func(idx int) *id3v2.Tag {
+		tagged++
+		return tagger(idx)
+	}
+
+	for _, format := range []Format{Tar, TarGzip, TarZstd, Zip} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			tagged = 0
+			err := Archive(lib, &buf, format)
+			if errors.Is(err, ErrZstdUnavailable) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatalf("Archive(%v) = %v; want nil", format, err)
+			}
+			// Each tag is generated for its path, and again when its song is
+			// written, but not for the times of directories.
+			if want := 2 * lib.Tracks; tagged != want {
+				t.Errorf("Archive(%v) generated %d tags, want %d", format, tagged, want)
+			}
+
+			var entries map[string]archiveEntry
+			switch format {
+			case Tar:
+				entries = readTar(t, &buf)
+			case TarGzip:
+				gz, err := gzip.NewReader(&buf)
+				if err != nil {
+					t.Fatalf("Failed to read gzip stream: %v", err)
+				}
+				entries = readTar(t, gz)
+			case TarZstd:
+				cmd := exec.Command("zstd", "-d", "-c")
+				cmd.Stdin = &buf
+				out, err := cmd.Output()
+				if err != nil {
+					t.Fatalf("Failed to decompress zstd stream: %v", err)
+				}
+				entries = readTar(t, bytes.NewReader(out))
+			case Zip:
+				entries = readZip(t, buf.Bytes())
+			}
+
+			var files int
+			for name, e := range entries {
+				if e.isDir {
+					if name[len(name)-1] != '/' {
+						t.Errorf("Directory %q has no trailing slash", name)
+					}
+					continue
+				}
+				files++
+			}
+			if files != paths.Len() {
+				t.Errorf("Archived %d songs, want %d", files, paths.Len())
+			}
+			for idx := 0; idx < paths.Len(); idx++ {
+				p, _ := paths.PathAt(idx)
+				song, err := lib.SongAt(idx)
+				if err != nil {
+					t.Fatalf("lib.SongAt(%d) = _, %v; want _, nil", idx, err)
+				}
+				want := make([]byte, song.Size())
+				song.ReadAt(want, 0)
+
+				e, ok := entries[p]
+				if !ok {
+					t.Errorf("Song %d (%s) is missing from the archive", idx, p)
+					continue
+				}
+				if !bytes.Equal(e.content, want) {
+					t.Errorf("Archived %s differs from song %d", p, idx)
+				}
+				if !e.modTime.Equal(song.ModTime()) {
+					t.Errorf("Archived %s has mtime %v, want %v", p, e.modTime, song.ModTime())
+				}
+			}
+		})
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want Format
+		ok   bool
+	}{
+		{"library.tar", Tar, true},
+		{"library.tar.gz", TarGzip, true},
+		{"LIBRARY.TGZ", TarGzip, true},
+		{"library.tar.zst", TarZstd, true},
+		{"library.zip", Zip, true},
+		{"library.rar", 0, false},
+	} {
+		got, ok := FormatOf(test.name)
+		if got != test.want || ok != test.ok {
+			t.Errorf("FormatOf(%q) = %v, %v; want %v, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+	for _, f := range []Format{Tar, TarGzip, TarZstd, Zip} {
+		if got, err := ParseFormat(f.String()); got != f || err != nil {
+			t.Errorf("ParseFormat(%q) = %v, %v; want %v, nil", f.String(), got, err, f)
+		}
+	}
+	if _, err := ParseFormat("rar"); err == nil {
+		t.Errorf("ParseFormat(\"rar\") = _, nil; want an error")
+	}
+}
@@ -0,0 +1,44 @@
+package export
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ficloneRange is the FICLONERANGE ioctl, from linux/fs.h.
+const ficloneRange = 0x4020940d
+
+// fileCloneRange is struct file_clone_range, from linux/fs.h.
+type fileCloneRange struct {
+	srcFD     int64
+	srcOffset uint64
+	srcLength uint64
+	dstOffset uint64
+}
+
+// cloneRange clones `length` bytes at `srcOff` in `src` to `dstOff` in
+// `dst`, sharing the underlying storage. Offsets and length must be
+// multiples of the filesystem block size.
+func cloneRange(dst, src *os.File, srcOff, dstOff, length int64) error {
+	arg := fileCloneRange{
+		srcFD:     int64(src.Fd()),
+		srcOffset: uint64(srcOff),
+		srcLength: uint64(length),
+		dstOffset: uint64(dstOff),
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficloneRange, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 {
+		return &os.PathError{Op: "FICLONERANGE", Path: dst.Name(), Err: errno}
+	}
+	return nil
+}
+
+// blockSize returns the block size of the filesystem containing `dir`.
+func blockSize(dir string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil || st.Bsize <= 0 {
+		return 4096
+	}
+	return int64(st.Bsize)
+}
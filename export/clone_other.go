@@ -0,0 +1,17 @@
+//go:build !linux
+
+package export
+
+import (
+	"os"
+)
+
+// cloneRange is only supported on Linux.
+func cloneRange(dst, src *os.File, srcOff, dstOff, length int64) error {
+	return ErrReflinkUnsupported
+}
+
+// blockSize returns a typical filesystem block size.
+func blockSize(dir string) int64 {
+	return 4096
+}
@@ -0,0 +1,373 @@
+/*
+Package export writes a fake library to a real directory, for systems where
+FUSE isn't available. The exported files are byte-identical to the files in
+a library mounted with the filesystem package. Libraries can also be written
+as a single tar or zip archive with Archive.
+
+Typical Usage:
+
+	lib, err := library.New(...)
+	if err != nil {
+	    ...
+	}
+
+	if err := export.Export(lib, dir, nil); err != nil {
+	    ...
+	}
+*/
+package export
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joshkunz/fakelib/library"
+)
+
+// Options configures how a library is exported.
+type Options struct {
+	// Workers is the number of songs written in parallel. Defaults to the
+	// library's Workers if unset. If it is more than 1, the library's Tagger,
+	// Pather and Timestamper must be safe for concurrent use.
+	Workers int
+
+	// Sparse skips writing blocks of zeros, so they become holes in sparse
+	// files on filesystems that support them.
+	Sparse bool
+
+	// Reflink shares the audio data of songs with copy-on-write clones
+	// (FICLONERANGE), on filesystems that support them, like Btrfs and XFS.
+	// Each song still has its own tag. Songs are written normally if
+	// cloning is not supported.
+	Reflink bool
+
+	// HardLink makes songs with identical contents and modification times
+	// hard links to the same file. Songs generated by the default Tagger all
+	// have different tags, so this only saves space with Taggers that repeat
+	// tags, or with corrupted songs (see library.CorruptAudio).
+	HardLink bool
+}
+
+// ErrReflinkUnsupported is returned when cloning is not supported on this
+// platform.
+var ErrReflinkUnsupported = errors.New("reflinks are not supported")
+
+// exporter holds the state of a single export.
+type exporter struct {
+	lib   *library.Library
+	dir   string
+	opts  Options
+	block int64
+
+	// noReflink is set once cloning fails, so it isn't tried again.
+	noReflink atomic.Bool
+
+	mu sync.Mutex
+	// links are the files that songs with identical contents are linked
+	// to, by content hash and modification time.
+	links map[linkKey]*linkTarget
+	// clones are files that contain audio data, that other songs can clone
+	// their audio from, by audio hash and tag size modulo the block size.
+	clones map[cloneKey]cloneSource
+}
+
+type linkKey struct {
+	content [sha256.Size]byte
+	modTime int64
+}
+
+type linkTarget struct {
+	path string
+	// done is closed once the file at path is written, or failed to be
+	// written, in which case err is set.
+	done chan struct{}
+	err  error
+}
+
+type cloneKey struct {
+	audio   [sha256.Size]byte
+	residue int64
+}
+
+type cloneSource struct {
+	path    string
+	tagSize int64
+}
+
+// Export writes every song in `lib` to the directory `dir`, which is
+// created if needed. Songs are written to the same paths they have in a
+// mounted library, and have the same modification times. Export fails
+// without overwriting any files if a song's path already exists.
+func Export(lib *library.Library, dir string, options *Options) error {
+	if options == nil {
+		options = &Options{}
+	}
+	paths, err := lib.Paths()
+	if err != nil {
+		return fmt.Errorf("failed to generate library paths: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	e := &exporter{
+		lib:    lib,
+		dir:    dir,
+		opts:   *options,
+		block:  blockSize(dir),
+		links:  make(map[linkKey]*linkTarget),
+		clones: make(map[cloneKey]cloneSource),
+	}
+	workers := e.opts.Workers
+	if workers <= 0 {
+		workers = max(lib.Workers, 1)
+	}
+
+	indices := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				p, err := paths.PathAt(idx)
+				if errors.Is(err, library.ErrRemoved) {
+					continue
+				}
+				if err == nil {
+					err = e.write(idx, p)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("failed to export song %d: %w", idx, err)
+					// Drain the remaining songs, so the producer
+					// doesn't block.
+					for range indices {
+					}
+					return
+				}
+			}
+		}()
+	}
+	for idx := 0; idx < paths.Len(); idx++ {
+		select {
+		case indices <- idx:
+		case err := <-errs:
+			close(indices)
+			wg.Wait()
+			return err
+		}
+	}
+	close(indices)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+
+	return e.setDirTimes(paths)
+}
+
+// write writes the idx-th song to path `p` in the export directory.
+func (e *exporter) write(idx int, p string) error {
+	song, err := e.lib.SongAt(idx)
+	if err != nil {
+		return err
+	}
+	content := make([]byte, song.Size())
+	song.ReadAt(content, 0)
+
+	full := filepath.Join(e.dir, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+
+	if !e.opts.HardLink {
+		return e.writeFile(full, song, content)
+	}
+
+	key := linkKey{content: sha256.Sum256(content), modTime: song.ModTime().UnixNano()}
+	e.mu.Lock()
+	target, ok := e.links[key]
+	if !ok {
+		target = &linkTarget{path: full, done: make(chan struct{})}
+		e.links[key] = target
+	}
+	e.mu.Unlock()
+	if !ok {
+		target.err = e.writeFile(full, song, content)
+		close(target.done)
+		return target.err
+	}
+	<-target.done
+	if target.err != nil {
+		return target.err
+	}
+	return os.Link(target.path, full)
+}
+
+// writeFile writes `content`, the contents of `song`, to a new file at
+// `full`.
+func (e *exporter) writeFile(full string, song library.Song, content []byte) error {
+	f, err := os.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := e.writeContent(f, song, content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if t := song.ModTime(); !t.IsZero() {
+		return os.Chtimes(full, t, t)
+	}
+	return nil
+}
+
+func (e *exporter) writeContent(f *os.File, song library.Song, content []byte) error {
+	if !e.opts.Reflink || e.noReflink.Load() {
+		return e.writeAt(f, content, 0)
+	}
+
+	tagSize := song.TagSize()
+	key := cloneKey{audio: sha256.Sum256(content[tagSize:]), residue: tagSize % e.block}
+	e.mu.Lock()
+	src, ok := e.clones[key]
+	e.mu.Unlock()
+	if !ok {
+		if err := e.writeAt(f, content, 0); err != nil {
+			return err
+		}
+		e.mu.Lock()
+		if _, ok := e.clones[key]; !ok {
+			e.clones[key] = cloneSource{path: f.Name(), tagSize: tagSize}
+		}
+		e.mu.Unlock()
+		return nil
+	}
+
+	// Both files have the audio at the same offset within a block, so the
+	// whole blocks of audio can be cloned. The tag, and the partial blocks
+	// around the cloned range are written normally.
+	start := (tagSize + e.block - 1) / e.block * e.block
+	length := (int64(len(content)) - start) / e.block * e.block
+	if length <= 0 {
+		return e.writeAt(f, content, 0)
+	}
+	if err := e.writeAt(f, content[:start], 0); err != nil {
+		return err
+	}
+	if err := e.clone(f, src, start-tagSize+src.tagSize, start, length); err != nil {
+		// Fall back to writing the data.
+		e.noReflink.Store(true)
+		if err := e.writeAt(f, content[start:start+length], start); err != nil {
+			return err
+		}
+	}
+	return e.writeAt(f, content[start+length:], start+length)
+}
+
+// clone clones `length` bytes at `srcOff` in `src` to `dstOff` in `f`.
+func (e *exporter) clone(f *os.File, src cloneSource, srcOff, dstOff, length int64) error {
+	srcFile, err := os.Open(src.path)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	return cloneRange(f, srcFile, srcOff, dstOff, length)
+}
+
+// writeAt writes `data` at offset `off` in `f`. If Sparse is set, whole
+// blocks of zeros are skipped.
+func (e *exporter) writeAt(f *os.File, data []byte, off int64) error {
+	if !e.opts.Sparse {
+		_, err := f.WriteAt(data, off)
+		return err
+	}
+	end := off + int64(len(data))
+	for len(data) > 0 {
+		// Write up to the end of the current block.
+		n := e.block - off%e.block
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		if !allZero(data[:n]) {
+			if _, err := f.WriteAt(data[:n], off); err != nil {
+				return err
+			}
+		}
+		data, off = data[n:], off+n
+	}
+	// Extend the file over any trailing hole.
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if info.Size() < end {
+		return f.Truncate(end)
+	}
+	return nil
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// setDirTimes sets the modification time of every exported directory to
+// the time of its newest song, like in a mounted library.
+func (e *exporter) setDirTimes(paths *library.PathMap) error {
+	times := dirTimes(e.lib, paths)
+	dirs := make([]string, 0, len(times))
+	for dir := range times {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		t := times[dir]
+		if err := os.Chtimes(filepath.Join(e.dir, filepath.FromSlash(dir)), t, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirTimes returns the time of the newest song beneath each directory in
+// `paths`. The root is ".". Directories that only contain songs without a
+// modification time are missing. Only the times of the songs are generated,
+// not the songs themselves.
+func dirTimes(lib *library.Library, paths *library.PathMap) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for idx := 0; idx < paths.Len(); idx++ {
+		p, err := paths.PathAt(idx)
+		if err != nil {
+			continue
+		}
+		t := lib.ModTimeAt(idx)
+		if t.IsZero() {
+			continue
+		}
+		for dir := path.Dir(p); ; dir = path.Dir(dir) {
+			if t.After(times[dir]) {
+				times[dir] = t
+			}
+			if dir == "." {
+				break
+			}
+		}
+	}
+	return times
+}
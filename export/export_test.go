@@ -0,0 +1,180 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bogem/id3v2/v2"
+
+	"github.com/joshkunz/fakelib/library"
+)
+
+func newLibrary(t *testing.T, tracks int) *library.Library {
+	t.Helper()
+	lib, err := library.New(library.EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = tracks
+	lib.Timestamper = func(idx int) time.Time { return time.Unix(int64(1_000_000_000+idx), 0) }
+	return lib
+}
+
+// checkExport checks that every song in `lib` was exported to `dir` with
+// the same contents and modification time as the song.
+func checkExport(t *testing.T, lib *library.Library, dir string) {
+	t.Helper()
+	paths, err := lib.Paths()
+	if err != nil {
+		t.Fatalf("lib.Paths() = _, %v; want _, nil", err)
+	}
+	var files int
+	filepath.Walk(dir, func(_ string, info os.FileInfo, _ error) error {
+		if !info.IsDir() {
+			files++
+		}
+		return nil
+	})
+	if files != paths.Len() {
+		t.Errorf("Exported %d files, want %d", files, paths.Len())
+	}
+	for idx := 0; idx < paths.Len(); idx++ {
+		p, _ := paths.PathAt(idx)
+		song, err := lib.SongAt(idx)
+		if err != nil {
+			t.Fatalf("lib.SongAt(%d) = _, %v; want _, nil", idx, err)
+		}
+		want := make([]byte, song.Size())
+		song.ReadAt(want, 0)
+
+		full := filepath.Join(dir, p)
+		got, err := os.ReadFile(full)
+		if err != nil {
+			t.Errorf("Failed to read exported %s: %v", p, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Exported %s differs from song %d", p, idx)
+		}
+		if song.ModTime().IsZero() {
+			continue
+		}
+		if info, err := os.Stat(full); err != nil || !info.ModTime().Equal(song.ModTime()) {
+			t.Errorf("Exported %s has mtime %v, want %v", p, info.ModTime(), song.ModTime())
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	for _, opts := range []*Options{
+		nil,
+		{Workers: 1},
+		{Sparse: true},
+		{Reflink: true, Workers: 3},
+		{Reflink: true, Sparse: true, HardLink: true},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			lib := newLibrary(t, 25)
+			dir := t.TempDir()
+			if err := Export(lib, dir, opts); err != nil {
+				t.Fatalf("Export(...) = %v, want nil", err)
+			}
+			checkExport(t, lib, dir)
+
+			// Directories get the time of their newest song.
+			info, err := os.Stat(filepath.Join(dir, "A", "A"))
+			if err != nil {
+				t.Fatalf("Failed to stat A/A: %v", err)
+			}
+			if want := time.Unix(1_000_000_009, 0); !info.ModTime().Equal(want) {
+				t.Errorf("A/A has mtime %v, want %v", info.ModTime(), want)
+			}
+		})
+	}
+}
+
+func TestExportDefaultWorkers(t *testing.T) {
+	lib := newLibrary(t, 25)
+	// The library has one worker, so its Tagger is never called concurrently.
+	var running, overlaps atomic.Int32
+	tagger := lib.Tagger
+	lib.Tagger = func(idx int) *id3v2.Tag {
+		if running.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		defer running.Add(-1)
+		time.Sleep(100 * time.Microsecond)
+		return tagger(idx)
+	}
+	if err := Export(lib, t.TempDir(), nil); err != nil {
+		t.Fatalf("Export(...) = %v, want nil", err)
+	}
+	if n := overlaps.Load(); n > 0 {
+		t.Errorf("Export called the Tagger concurrently %d times, want none with lib.Workers = 1", n)
+	}
+}
+
+func TestExportHardLinks(t *testing.T) {
+	lib := newLibrary(t, 20)
+	// Pairs of songs have the same tag and time, and so the same contents.
+	tagger := lib.Tagger
+	lib.Tagger = func(idx int) *id3v2.Tag { return tagger(idx / 2) }
+	lib.Timestamper = func(idx int) time.Time { return time.Unix(int64(1_000_000_000+idx/2), 0) }
+	lib.Pather = func(idx int, _ *id3v2.Tag) string { return fmt.Sprintf("%02d.mp3", idx) }
+
+	dir := t.TempDir()
+	if err := Export(lib, dir, &Options{HardLink: true}); err != nil {
+		t.Fatalf("Export(...) = %v, want nil", err)
+	}
+	checkExport(t, lib, dir)
+
+	stat := func(p string) os.FileInfo {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(dir, p))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", p, err)
+		}
+		return info
+	}
+	if !os.SameFile(stat("00.mp3"), stat("01.mp3")) {
+		t.Errorf("00.mp3 and 01.mp3 have the same contents, but are not hard links")
+	}
+	if os.SameFile(stat("00.mp3"), stat("02.mp3")) {
+		t.Errorf("00.mp3 and 02.mp3 have different contents, but are hard links")
+	}
+
+	// Songs with the same contents, but different times can't be linked.
+	lib.Timestamper = func(idx int) time.Time { return time.Unix(int64(1_000_000_000+idx), 0) }
+	dir = t.TempDir()
+	if err := Export(lib, dir, &Options{HardLink: true}); err != nil {
+		t.Fatalf("Export(...) = %v, want nil", err)
+	}
+	checkExport(t, lib, dir)
+	if os.SameFile(stat("00.mp3"), stat("01.mp3")) {
+		t.Errorf("00.mp3 and 01.mp3 have different times, but are hard links")
+	}
+}
+
+func TestExportExisting(t *testing.T) {
+	lib := newLibrary(t, 5)
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "A", "A", "C.mp3")
+	if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Export(lib, dir, nil); err == nil {
+		t.Errorf("Export(...) into a directory with existing songs = nil, want error")
+	}
+	if got, _ := os.ReadFile(existing); string(got) != "keep me" {
+		t.Errorf("Export(...) overwrote existing file, now contains %q", got)
+	}
+}
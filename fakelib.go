@@ -1,39 +1,112 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/joshkunz/fakelib/control"
 	"github.com/joshkunz/fakelib/filesystem"
 	"github.com/joshkunz/fakelib/library"
+	"github.com/joshkunz/fakelib/metrics"
+	"github.com/joshkunz/fakelib/scenario"
 )
 
 var (
-	librarySize     = flag.Int("library_size", 1000, "Number of songs to include in the library")
-	minPathLength   = flag.Int("min_path_length", 3, "The minimum number of non-separator bytes in the generated paths")
-	tracksPerAlbum  = flag.Int("tracks_per_album", 10, "Max number of tracks in each album")
-	albumsPerArtist = flag.Int("albums_per_artist", 3, "Max number of albums for each artist")
+	librarySize       = flag.Int("library_size", 1000, "Number of songs to include in the library")
+	minPathLength     = flag.Int("min_path_length", 3, "The minimum number of non-separator bytes in the generated paths")
+	tracksPerAlbum    = flag.Int("tracks_per_album", 10, "Max number of tracks in each album")
+	albumsPerArtist   = flag.Int("albums_per_artist", 3, "Max number of albums for each artist")
+	pathTemplate      = flag.String("path_template", "", "Template used to generate song paths, e.g. \"{albumartist}/{year} - {album}/{track:02} {title}.{ext}\". Defaults to <artist>/<album>/<title>.mp3")
+	sanitize          = flag.String("sanitize", "posix", "How to sanitize tag values used in --path_template. One of: posix, windows")
+	collisions        = flag.String("collisions", "error", "How to handle songs that are given the same path. One of: error, count (add a \" (2)\" suffix), index (add a \" [index]\" suffix)")
+	noiseRate         = flag.Float64("noise_rate", 0, "Probability (0 to 1) that each kind of non-music noise file (.nfo, .log, Thumbs.db, ...) is placed in a directory")
+	noiseSeed         = flag.Int64("noise_seed", 0, "Seed used to select the noise files placed in each directory")
+	songSymlinks      = flag.Float64("song_symlink_rate", 0, "Probability (0 to 1) that a directory contains a symlink to a song elsewhere in the library")
+	dirSymlinks       = flag.Float64("dir_symlink_rate", 0, "Probability (0 to 1) that a directory contains a symlink to another directory in the library")
+	outsideSymlinks   = flag.Float64("outside_symlink_rate", 0, "Probability (0 to 1) that a directory contains a symlink to a directory outside the library")
+	danglingLinks     = flag.Float64("dangling_symlink_rate", 0, "Probability (0 to 1) that a directory contains a dangling symlink")
+	loopSymlinks      = flag.Float64("loop_symlink_rate", 0, "Probability (0 to 1) that a directory contains a symlink to its parent, forming a loop")
+	hardLinks         = flag.Float64("hardlink_rate", 0, "Probability (0 to 1) that a directory contains a second name for a song elsewhere in the library")
+	linkSeed          = flag.Int64("link_seed", 0, "Seed used to select the links placed in each directory")
+	mtimeSpan         = flag.Duration("mtime_span", 0, "Spread song modification times over this period before --mtime_end, e.g. 43800h for 5 years. Timestamps are zero if unset")
+	mtimeEnd          = flag.String("mtime_end", "", "Latest song modification time, in RFC 3339 format. Defaults to the current time")
+	mtimeRecent       = flag.Float64("mtime_recent", 0, "Fraction (0 to 1) of albums that were recently added, within --mtime_recent_window of --mtime_end")
+	mtimeWindow       = flag.Duration("mtime_recent_window", 24*time.Hour, "Length of the recently added period")
+	controlStdin      = flag.Bool("control_stdin", false, "Read commands that change the mounted library from stdin, one per line. Send \"help\" for a list of commands")
+	accessLogPath     = flag.String("access_log", "", "Write a JSON line for every filesystem operation (op, path, index, offset, length, latency) to this file, or stdout if \"-\". See filesystem.AccessEntry for the fields")
+	metricsAddr       = flag.String("metrics", "", "Serve Prometheus metrics (operations, bytes read, cache hits, injected errors, latency) at /metrics on this address, e.g. \"localhost:9100\"")
+	controlAddr       = flag.String("control", "", "Serve an HTTP API to query and change the mounted library on this address, e.g. \"localhost:9090\" or \"unix:/tmp/fakelib.sock\". See the control package docs for the endpoints")
+	scenarioPath      = flag.String("scenario", "", "Path to a scenario script that changes the mounted library over time. See the scenario package docs for the format")
+	scenarioSeed      = flag.Int64("scenario_seed", 0, "Seed used to pick the tracks changed by --scenario")
+	layout            = flag.String("layout", "tags", "Directory layout of the library. One of: tags (see --path_template), flat, nested, sharded")
+	layoutDepth       = flag.Int("layout_depth", 0, "Number of directory levels for --layout=nested and --layout=sharded. Defaults to 20 for nested, and 2 for sharded")
+	layoutFanout      = flag.Int("layout_fanout", 10, "Max number of entries in each directory for --layout=nested")
+	bandwidth         = flag.Int64("bandwidth", 0, "Limit the total rate of song reads to this many bytes per second")
+	coldAfter         = flag.Duration("cold_after", 0, "Songs not read for this long get --latency_first_byte added to their next read. Defaults to only the first read")
+	corruptTagRate    = flag.Float64("corrupt_tag_rate", 0, "Fraction (0 to 1) of songs with a malformed id3v2 tag")
+	corruptTagKinds   = flag.String("corrupt_tag_kinds", "all", "Comma-separated kinds of tag damage used for --corrupt_tag_rate. Any of: truncated-header, bad-synchsafe-size, short-size, invalid-frame-id, bad-encoding, zero-length-frame, oversized-tag, all")
+	corruptAudioRate  = flag.Float64("corrupt_audio_rate", 0, "Fraction (0 to 1) of songs with damaged audio")
+	corruptAudioKinds = flag.String("corrupt_audio_kinds", "all", "Comma-separated kinds of audio damage used for --corrupt_audio_rate. Any of: truncated, garbage, missing-sync, zero-length, all")
+	corruptSeed       = flag.Int64("corrupt_seed", 0, "Seed used to select the corrupted songs")
+	buildWorkers      = flag.Int("build_workers", runtime.NumCPU(), "Number of goroutines used to generate the library's songs and paths at startup")
+	largeInodes       = flag.Bool("large_inodes", false, "Allow inode numbers over 32 bits, for libraries of more than 2^31 songs. MPD does not support them")
+	tagCache          = flag.String("tag_cache", "none", "How encoded tags are cached between reads of a song. One of: none, lru (keep recently used tags), arena (encode every tag at startup)")
+	tagCacheBytes     = flag.Int64("tag_cache_bytes", 64<<20, "Memory budget of --tag_cache in bytes. Startup fails if --tag_cache=arena needs more")
+	faultSeed         = flag.Int64("fault_seed", 0, "Seed used to pick the operations that fail, for --fault with a rate")
+	faults            faultFlags
+	latencies         = map[string]*filesystem.Delay{}
 )
 
-func main() {
-	flag.Parse()
-	if len(flag.Args()) < 1 {
-		log.Fatalf("usage: %s golden.mp3 mount/", os.Args[0])
+func init() {
+	for _, op := range []string{"lookup", "getattr", "readdir", "read", "first_byte"} {
+		d := new(filesystem.Delay)
+		latencies[op] = d
+		flag.Func("latency_"+op, fmt.Sprintf("Delay added to each %s, e.g. \"5ms\" or \"5ms+exp:20ms\". See filesystem.ParseDelay for the format", strings.ReplaceAll(op, "_", " ")), func(s string) (err error) {
+			*d, err = filesystem.ParseDelay(s)
+			return err
+		})
 	}
+	flag.Var(&faults, "fault", "Make some filesystem operations fail, e.g. \"op=read errno=EIO rate=0.01\". May be repeated. See filesystem.ParseFault for the format")
+}
 
-	if *minPathLength < 3 {
-		log.Fatalf("--min_path_length must be at least 3")
+// faultFlags is a repeatable flag of filesystem faults.
+type faultFlags []filesystem.Fault
+
+func (f *faultFlags) String() string {
+	var specs []string
+	for _, fault := range *f {
+		specs = append(specs, fault.String())
 	}
+	return strings.Join(specs, "; ")
+}
 
-	var goldenPath, mountDir string
-	if len(flag.Args()) < 2 {
-		mountDir = flag.Arg(0)
-	} else {
-		goldenPath, mountDir = flag.Arg(0), flag.Arg(1)
+func (f *faultFlags) Set(s string) error {
+	fault, err := filesystem.ParseFault(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fault)
+	return nil
+}
+
+// newLibrary creates the library configured by the command line flags, from
+// the golden file at `goldenPath`, or the embedded golden file if it is
+// empty.
+func newLibrary(goldenPath string) *library.Library {
+	if *minPathLength < 3 {
+		log.Fatalf("--min_path_length must be at least 3")
 	}
 
 	var golden io.ReadSeeker
@@ -53,11 +126,137 @@ func main() {
 		log.Fatalf("failed to load golden file %q: %v", goldenPath, err)
 	}
 	lib.Tracks = *librarySize
+	lib.Workers = *buildWorkers
 	lib.Tagger = library.RepeatedLetters{
 		TracksPerAlbum:     *tracksPerAlbum,
 		AlbumsPerArtist:    *albumsPerArtist,
 		MinComponentLength: *minPathLength / 3,
 	}.Tag
+	if *mtimeSpan > 0 {
+		end := time.Now()
+		if *mtimeEnd != "" {
+			end, err = time.Parse(time.RFC3339, *mtimeEnd)
+			if err != nil {
+				log.Fatalf("invalid --mtime_end: %v", err)
+			}
+		}
+		lib.Timestamper = library.Timestamps{
+			End:          end,
+			Span:         *mtimeSpan,
+			Group:        *tracksPerAlbum,
+			Recent:       *mtimeRecent,
+			RecentWindow: *mtimeWindow,
+		}.Time
+	}
+	if *layoutDepth < 0 {
+		log.Fatalf("--layout_depth must not be negative, got %d", *layoutDepth)
+	}
+	switch *layout {
+	case "tags":
+	case "flat":
+		lib.Pather = library.Flat
+	case "nested":
+		depth := *layoutDepth
+		if depth == 0 {
+			depth = 20
+		}
+		lib.Pather = library.Nested{Depth: depth, Fanout: *layoutFanout}.Path
+	case "sharded":
+		depth := *layoutDepth
+		if depth == 0 {
+			depth = 2
+		}
+		lib.Pather = library.HashSharded{Levels: depth}.Path
+	default:
+		log.Fatalf("--layout must be one of tags, flat, nested, sharded, got %q", *layout)
+	}
+	if *pathTemplate != "" {
+		if *layout != "tags" {
+			log.Fatalf("--path_template can only be used with --layout=tags")
+		}
+		tmpl, err := library.ParseTemplate(*pathTemplate)
+		if err != nil {
+			log.Fatalf("invalid --path_template: %v", err)
+		}
+		switch *sanitize {
+		case "posix":
+			tmpl.Sanitize = library.SanitizePOSIX
+		case "windows":
+			tmpl.Sanitize = library.SanitizeWindows
+		default:
+			log.Fatalf("--sanitize must be one of posix, windows, got %q", *sanitize)
+		}
+		lib.Pather = tmpl.Path
+	}
+
+	lib.Collisions, err = library.ParseCollisionStrategy(*collisions)
+	if err != nil {
+		log.Fatalf("invalid --collisions: %v", err)
+	}
+
+	if *corruptTagRate > 0 {
+		kinds, err := library.ParseTagCorruptions(*corruptTagKinds)
+		if err != nil {
+			log.Fatalf("invalid --corrupt_tag_kinds: %v", err)
+		}
+		lib.TagCorrupter = library.CorruptTags{Rate: *corruptTagRate, Kinds: kinds, Seed: *corruptSeed}.Corrupt
+	}
+	if *corruptAudioRate > 0 {
+		kinds, err := library.ParseAudioCorruptions(*corruptAudioKinds)
+		if err != nil {
+			log.Fatalf("invalid --corrupt_audio_kinds: %v", err)
+		}
+		// Use a different seed, so tag and audio corruption are independent.
+		lib.AudioCorrupter = (&library.CorruptAudio{Rate: *corruptAudioRate, Kinds: kinds, Seed: *corruptSeed + 1}).Corrupt
+	}
+
+	switch *tagCache {
+	case "none":
+	case "lru":
+		lib.TagCache = library.NewLRUTagCache(*tagCacheBytes)
+	case "arena":
+		arena, err := library.PrecomputeTags(lib, *tagCacheBytes)
+		if err != nil {
+			log.Fatalf("failed to precompute tags: %v", err)
+		}
+		lib.TagCache = arena
+	default:
+		log.Fatalf("--tag_cache must be one of none, lru, arena, got %q", *tagCache)
+	}
+	return lib
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			flag.CommandLine.Parse(os.Args[2:])
+			runServe()
+			return
+		case "export":
+			flag.CommandLine.Parse(os.Args[2:])
+			runExport()
+			return
+		case "archive":
+			flag.CommandLine.Parse(os.Args[2:])
+			runArchive()
+			return
+		}
+	}
+
+	flag.Parse()
+	if len(flag.Args()) < 1 {
+		log.Fatalf("usage: %[1]s [golden.mp3] mount/\n       %[1]s serve [golden.mp3]\n       %[1]s export [golden.mp3] out/\n       %[1]s archive [golden.mp3]", os.Args[0])
+	}
+
+	var goldenPath, mountDir string
+	if len(flag.Args()) < 2 {
+		mountDir = flag.Arg(0)
+	} else {
+		goldenPath, mountDir = flag.Arg(0), flag.Arg(1)
+	}
+
+	lib := newLibrary(goldenPath)
 
 	if _, err := os.Stat(mountDir); os.IsNotExist(err) {
 		os.Mkdir(mountDir, 0755)
@@ -65,19 +264,173 @@ func main() {
 		log.Fatalf("failed to stat %q: %v", mountDir, err)
 	}
 
-	server, err := filesystem.Mount(lib, mountDir, nil)
+	var script *scenario.Scenario
+	if *scenarioPath != "" {
+		f, err := os.Open(*scenarioPath)
+		if err != nil {
+			log.Fatalf("failed to open scenario: %v", err)
+		}
+		script, err = scenario.Parse(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("failed to parse scenario %q: %v", *scenarioPath, err)
+		}
+		script.Seed = *scenarioSeed
+		script.Logger = log.Default()
+	}
+
+	var opts filesystem.Options
+	if *noiseRate > 0 {
+		opts.Noise = &filesystem.Noise{Rate: *noiseRate, Seed: *noiseSeed}
+	}
+	if *songSymlinks > 0 || *dirSymlinks > 0 || *outsideSymlinks > 0 || *danglingLinks > 0 || *loopSymlinks > 0 || *hardLinks > 0 {
+		opts.Links = &filesystem.Links{
+			Songs:     *songSymlinks,
+			Dirs:      *dirSymlinks,
+			Outside:   *outsideSymlinks,
+			Dangling:  *danglingLinks,
+			Loops:     *loopSymlinks,
+			HardLinks: *hardLinks,
+			Seed:      *linkSeed,
+		}
+	}
+
+	opts.Faults = faults
+	opts.FaultSeed = *faultSeed
+	opts.LargeInodes = *largeInodes
+	latency := filesystem.Latency{
+		Lookup:    *latencies["lookup"],
+		Getattr:   *latencies["getattr"],
+		Readdir:   *latencies["readdir"],
+		Read:      *latencies["read"],
+		FirstByte: *latencies["first_byte"],
+		ColdAfter: *coldAfter,
+		Bandwidth: *bandwidth,
+	}
+	if latency != (filesystem.Latency{}) {
+		opts.Latency = &latency
+	}
+
+	// closeLog flushes and closes the access log. log.Fatalf skips deferred
+	// calls, so fatalf is used instead once the log is open.
+	closeLog := func() {}
+	fatalf := func(format string, v ...any) {
+		closeLog()
+		log.Fatalf(format, v...)
+	}
+	// status is where messages about the mount are written. They go to
+	// stderr if the access log is written to stdout, so the log is only
+	// JSON lines.
+	var status io.Writer = os.Stdout
+	if *accessLogPath == "-" {
+		opts.AccessLog = os.Stdout
+		status = os.Stderr
+	} else if *accessLogPath != "" {
+		f, err := os.Create(*accessLogPath)
+		if err != nil {
+			log.Fatalf("failed to create access log: %v", err)
+		}
+		// The log is flushed when the library is unmounted.
+		w := &syncWriter{w: bufio.NewWriterSize(f, 1<<20)}
+		closeLog = func() {
+			w.Flush()
+			f.Close()
+		}
+		defer closeLog()
+		opts.AccessLog = w
+	}
+
+	var reg *metrics.Registry
+	if *metricsAddr != "" {
+		reg = metrics.NewRegistry()
+		metrics.RegisterTagCache(reg, lib.TagCache)
+		opts.Metrics = reg
+	}
+
+	server, err := filesystem.MountWithOptions(lib, mountDir, &opts)
 	if err != nil {
-		log.Fatal(err)
+		fatalf("%v", err)
 	}
-	fmt.Printf("filesystem mounted at %q\n", mountDir)
+	fmt.Fprintf(status, "filesystem mounted at %q\n", mountDir)
 
-	// Wait for our process to be interrupted.
-	c := make(chan os.Signal)
+	if reg != nil {
+		l, err := listenMetrics(reg)
+		if err != nil {
+			server.Unmount()
+			fatalf("%v", err)
+		}
+		defer l.Close()
+		fmt.Fprintf(status, "metrics served at http://%s/metrics\n", *metricsAddr)
+	}
+
+	if *controlStdin {
+		go runCommands(server, os.Stdin, status)
+	}
+	// unmount is closed when the library should be unmounted by a request to
+	// the control API.
+	unmount := make(chan struct{})
+	if *controlAddr != "" {
+		l, err := control.Listen(*controlAddr)
+		if err != nil {
+			server.Unmount()
+			fatalf("failed to listen on %q: %v", *controlAddr, err)
+		}
+		defer l.Close()
+		var once sync.Once
+		h := control.NewHandler(server, func() { once.Do(func() { close(unmount) }) })
+		go http.Serve(l, h)
+		fmt.Fprintf(status, "control API listening on %q\n", *controlAddr)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if script != nil {
+		go script.Run(ctx, server)
+	}
+
+	// Wait for our process to be interrupted, or asked to unmount.
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
-	<-c
+	select {
+	case <-c:
+	case <-unmount:
+	}
+	cancel()
 
 	if err := server.Unmount(); err != nil {
-		log.Fatal(err)
+		fatalf("%v", err)
+	}
+	fmt.Fprintf(status, "filesystem unmounted from %q\n", mountDir)
+}
+
+// syncWriter is a buffered writer that can be flushed while it is written by
+// other goroutines, e.g. by a library that failed to unmount.
+type syncWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (s *syncWriter) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Flush()
+}
+
+// listenMetrics serves the metrics in `reg` at /metrics on --metrics, until
+// the returned listener is closed.
+func listenMetrics(reg *metrics.Registry) (net.Listener, error) {
+	l, err := net.Listen("tcp", *metricsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %q: %w", *metricsAddr, err)
 	}
-	fmt.Printf("filesystem unmounted from %q\n", mountDir)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg)
+	go http.Serve(l, mux)
+	return l, nil
 }
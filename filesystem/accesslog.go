@@ -0,0 +1,155 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// AccessEntry is a line of the access log written to Options.AccessLog. It
+// records a single operation on the mounted library.
+type AccessEntry struct {
+	// Time is when the operation started.
+	Time time.Time `json:"time"`
+	// Op is the operation, e.g. "read". See Op.
+	Op string `json:"op"`
+	// Path is the path of the file or directory, relative to the library
+	// root. The root is ".". For lookups, it is the path that was looked up,
+	// which may not exist.
+	Path string `json:"path"`
+	// Index is the index of the song, or nil if the file is not a song.
+	Index *int `json:"index,omitempty"`
+
+	// Offset and Length are the offset and length requested by a read.
+	Offset int64 `json:"offset,omitempty"`
+	Length int   `json:"length,omitempty"`
+	// TagBytes and AudioBytes are the number of bytes returned by a read of
+	// a song, from its id3v2 tag, and from the golden MP3's audio data.
+	// Reads of other files only return AudioBytes.
+	TagBytes   int `json:"tag_bytes,omitempty"`
+	AudioBytes int `json:"audio_bytes,omitempty"`
+
+	// Latency is how long the operation took, including any delay added by
+	// Options.Latency.
+	Latency time.Duration `json:"latency_ns"`
+	// Errno is the name of the error the operation failed with (e.g. "EIO"),
+	// or empty if it succeeded.
+	Errno string `json:"errno,omitempty"`
+}
+
+// accessLog writes AccessEntries to a writer as JSON lines.
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+	// buf is reused to encode each entry, so it is written with a single
+	// Write call.
+	buf []byte
+}
+
+func (l *accessLog) write(e *AccessEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(append(l.buf[:0], line...), '\n')
+	l.w.Write(l.buf)
+}
+
+// access records an operation in progress, for the access log and metrics.
+type access struct {
+	log     *accessLog
+	metrics *fsMetrics
+	entry   AccessEntry
+	// injected is set if the operation failed because of a Fault.
+	injected bool
+}
+
+// internalKey is a context key set for operations that are part of another
+// operation, e.g. the getattr done by a lookup, so they aren't recorded,
+// delayed or failed twice.
+type internalKey struct{}
+
+// internal returns a context for an operation that is part of the operation
+// with context `ctx`.
+func internal(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalKey{}, true)
+}
+
+// isInternal returns true if `ctx` is the context of an operation that is
+// part of another operation.
+func isInternal(ctx context.Context) bool {
+	return ctx.Value(internalKey{}) != nil
+}
+
+// begin starts recording operation `op` on `node`, or on its child `name`
+// if it is not empty. `idx` is the index of the song, or -1. It returns nil
+// if there is no access log or metrics, or the operation is internal. The
+// returned access is written by done, and all its methods can be called on
+// nil.
+func (r *root) begin(ctx context.Context, op Op, node *fs.Inode, name string, idx int) *access {
+	if (r.accessLog == nil && r.metrics == nil) || isInternal(ctx) {
+		return nil
+	}
+	a := &access{log: r.accessLog, metrics: r.metrics, entry: AccessEntry{Time: time.Now(), Op: op.String()}}
+	if r.accessLog != nil {
+		// Paths are only needed for the log, and require walking the tree.
+		p := node.Path(&r.Inode)
+		if name != "" {
+			p = path.Join(p, name)
+		}
+		if p == "" {
+			p = "."
+		}
+		a.entry.Path = p
+	}
+	if idx >= 0 {
+		a.entry.Index = &idx
+	}
+	return a
+}
+
+// fault records that the operation failed with `errno` because of a Fault,
+// and returns `errno`.
+func (a *access) fault(errno syscall.Errno) syscall.Errno {
+	if a != nil {
+		a.injected = true
+	}
+	return errno
+}
+
+// read records the requested range of a read, and the number of bytes
+// returned, of a file whose first `tagSize` bytes are its tag.
+func (a *access) read(off int64, length, n int, tagSize int64) {
+	if a == nil {
+		return
+	}
+	a.entry.Offset, a.entry.Length = off, length
+	fromTag := int(min(max(tagSize-off, 0), int64(n)))
+	a.entry.TagBytes, a.entry.AudioBytes = fromTag, n-fromTag
+}
+
+// done finishes recording the operation, which returned `errno`, and writes
+// it to the access log and metrics.
+func (a *access) done(errno syscall.Errno) {
+	if a == nil {
+		return
+	}
+	a.entry.Latency = time.Since(a.entry.Time)
+	if errno != 0 {
+		a.entry.Errno = errnoName(errno)
+	}
+	if a.log != nil {
+		a.log.write(&a.entry)
+	}
+	if a.metrics != nil {
+		a.metrics.record(&a.entry, a.injected)
+	}
+}
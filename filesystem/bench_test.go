@@ -0,0 +1,87 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/joshkunz/fakelib/library"
+)
+
+// benchSizes are the library sizes used by benchmarks. Sizes over a million
+// tracks need several GiB of memory, and are skipped with -short.
+var benchSizes = []int{1_000, 100_000, 1_000_000, 10_000_000}
+
+// benchLibrary returns a library with `tracks` songs, that is built on every
+// CPU.
+func benchLibrary(b *testing.B, tracks int) *library.Library {
+	b.Helper()
+	if testing.Short() && tracks > 1_000_000 {
+		b.Skipf("skipping %d tracks in short mode", tracks)
+	}
+	lib := loadLibrary(b)
+	lib.Tracks = tracks
+	lib.Workers = runtime.NumCPU()
+	return lib
+}
+
+// heapAlloc returns the bytes allocated on the heap, after a GC.
+func heapAlloc() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// BenchmarkMount measures the time to mount a library, which is dominated by
+// building the tree of songs, and the memory used by each track.
+func BenchmarkMount(b *testing.B) {
+	for _, tracks := range benchSizes {
+		b.Run(fmt.Sprintf("tracks=%d", tracks), func(b *testing.B) {
+			lib := benchLibrary(b, tracks)
+			b.StopTimer()
+			for i := 0; i < b.N; i++ {
+				before := heapAlloc()
+				b.StartTimer()
+				_, _, cleanup := mountServer(b, lib, &Options{})
+				b.StopTimer()
+				b.ReportMetric(float64(heapAlloc()-before)/float64(tracks), "B/track")
+				cleanup()
+			}
+			b.ReportMetric(float64(tracks)*float64(b.N)/b.Elapsed().Seconds(), "tracks/s")
+		})
+	}
+}
+
+// BenchmarkRead measures the throughput of reading whole songs, spread over
+// the library, through the mount.
+func BenchmarkRead(b *testing.B) {
+	for _, tracks := range benchSizes {
+		b.Run(fmt.Sprintf("tracks=%d", tracks), func(b *testing.B) {
+			lib := benchLibrary(b, tracks)
+			dir, _, cleanup := mountServer(b, lib, &Options{})
+			defer cleanup()
+			song, err := lib.SongAt(0)
+			if err != nil {
+				b.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+			}
+			b.SetBytes(song.Size())
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				// Step through the library by a prime, to touch songs in
+				// many directories.
+				idx := int(int64(i) * 7919 % int64(tracks))
+				p, err := lib.PathAt(idx)
+				if err != nil {
+					b.Fatalf("lib.PathAt(%d) = _, %v; want _, nil", idx, err)
+				}
+				if _, err := os.ReadFile(filepath.Join(dir, p)); err != nil {
+					b.Fatalf("Failed to read %s: %v", p, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Op is a set of filesystem operations that a Fault applies to.
+type Op int
+
+const (
+	// OpLookup is the lookup of a name in a directory, e.g. when a path is
+	// opened or stat'd. The fault applies to the path being looked up.
+	OpLookup Op = 1 << iota
+	// OpGetattr is a request for the attributes (stat) of a file or
+	// directory.
+	OpGetattr
+	// OpReaddir is the listing of a directory's entries.
+	OpReaddir
+	// OpRead is a read of a song's contents.
+	OpRead
+
+	// OpAll is every operation.
+	OpAll = OpLookup | OpGetattr | OpReaddir | OpRead
+)
+
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{OpLookup, "lookup"},
+	{OpGetattr, "getattr"},
+	{OpReaddir, "readdir"},
+	{OpRead, "read"},
+}
+
+func (o Op) String() string {
+	if o == OpAll {
+		return "all"
+	}
+	var names []string
+	for _, n := range opNames {
+		if o&n.op != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseOp parses a comma-separated list of operation names (lookup, getattr,
+// readdir, read, or all).
+func ParseOp(s string) (Op, error) {
+	var o Op
+	for _, name := range strings.Split(s, ",") {
+		if name == "all" {
+			o |= OpAll
+			continue
+		}
+		found := false
+		for _, n := range opNames {
+			if n.name == name {
+				o |= n.op
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown operation %q, want one of lookup, getattr, readdir, read, all", name)
+		}
+	}
+	return o, nil
+}
+
+// errnos are the error numbers that can be named in ParseFault.
+var errnos = map[string]syscall.Errno{
+	"EIO":       syscall.EIO,
+	"ENOENT":    syscall.ENOENT,
+	"EACCES":    syscall.EACCES,
+	"EPERM":     syscall.EPERM,
+	"ESTALE":    syscall.ESTALE,
+	"EAGAIN":    syscall.EAGAIN,
+	"EINTR":     syscall.EINTR,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+	"ENOTCONN":  syscall.ENOTCONN,
+	"EHOSTDOWN": syscall.EHOSTDOWN,
+}
+
+// Fault makes some filesystem operations fail with an error, to simulate
+// flaky storage like a network-mounted library. A fault applies to an
+// operation if the operation is in Ops, and the file or directory matches
+// every one of Path, the index range, and Rate that is set.
+type Fault struct {
+	// Ops are the operations that fail. Defaults to OpAll if zero.
+	Ops Op
+	// Errno is the error returned by failed operations. Defaults to EIO if
+	// zero.
+	Errno syscall.Errno
+
+	// Path, if set, is a pattern (see path.Match) matched against the path
+	// of the file or directory relative to the library root. The fault also
+	// applies to everything below a matching directory.
+	Path string
+
+	// IndexLo and IndexHi, if IndexHi > IndexLo, limit the fault to songs
+	// with an index in [IndexLo, IndexHi). Other files and directories are
+	// never matched.
+	IndexLo, IndexHi int
+
+	// Rate, if set, is the probability (0 to 1) that each matching
+	// operation fails. Otherwise every matching operation fails.
+	Rate float64
+}
+
+// String formats the fault in the format accepted by ParseFault.
+func (f Fault) String() string {
+	ops := f.Ops
+	if ops == 0 {
+		ops = OpAll
+	}
+	parts := []string{"op=" + ops.String(), "errno=" + errnoName(f.errno())}
+	if f.Path != "" {
+		parts = append(parts, "path="+f.Path)
+	}
+	if f.IndexHi > f.IndexLo {
+		parts = append(parts, fmt.Sprintf("index=%d-%d", f.IndexLo, f.IndexHi))
+	}
+	if f.Rate > 0 {
+		parts = append(parts, "rate="+strconv.FormatFloat(f.Rate, 'g', -1, 64))
+	}
+	return strings.Join(parts, " ")
+}
+
+func errnoName(e syscall.Errno) string {
+	for name, errno := range errnos {
+		if errno == e {
+			return name
+		}
+	}
+	return strconv.Itoa(int(e))
+}
+
+func (f Fault) errno() syscall.Errno {
+	if f.Errno == 0 {
+		return syscall.EIO
+	}
+	return f.Errno
+}
+
+// ParseFault parses a fault from space-separated key=value pairs, e.g.
+// "op=read,getattr errno=EIO path=Artist/* index=0-100 rate=0.1". Keys are
+// op (see ParseOp), errno (a name like EIO or ENOENT, or a number), path,
+// index (an index range, lo-hi with hi excluded), and rate. All keys are
+// optional.
+func ParseFault(s string) (Fault, error) {
+	var f Fault
+	for _, field := range strings.Fields(s) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Fault{}, fmt.Errorf("invalid fault field %q, want key=value", field)
+		}
+		var err error
+		switch key {
+		case "op":
+			f.Ops, err = ParseOp(value)
+		case "errno":
+			if errno, ok := errnos[strings.ToUpper(value)]; ok {
+				f.Errno = errno
+			} else if n, nErr := strconv.Atoi(value); nErr == nil && n > 0 {
+				f.Errno = syscall.Errno(n)
+			} else {
+				err = fmt.Errorf("unknown errno %q", value)
+			}
+		case "path":
+			if _, err = path.Match(value, ""); err == nil {
+				f.Path = value
+			}
+		case "index":
+			lo, hi, ok := strings.Cut(value, "-")
+			if f.IndexLo, err = strconv.Atoi(lo); err == nil && ok {
+				f.IndexHi, err = strconv.Atoi(hi)
+			}
+			if err != nil || !ok || f.IndexHi <= f.IndexLo {
+				err = fmt.Errorf("invalid index range %q, want lo-hi with lo < hi", value)
+			}
+		case "rate":
+			f.Rate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (f.Rate < 0 || f.Rate > 1) {
+				err = fmt.Errorf("rate %v is not between 0 and 1", f.Rate)
+			}
+		default:
+			err = fmt.Errorf("unknown fault key %q", key)
+		}
+		if err != nil {
+			return Fault{}, fmt.Errorf("invalid fault %q: %w", s, err)
+		}
+	}
+	return f, nil
+}
+
+// matchPath returns true if `p`, or one of its parent directories, matches
+// the pattern.
+func matchPath(pattern, p string) bool {
+	for p != "" && p != "." {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		p = path.Dir(p)
+	}
+	return false
+}
+
+// matches returns true if the fault applies to operation `op` on the file at
+// path `p`, which is the idx-th song, or not a song if idx is negative. `p`
+// is only called if the fault depends on the path, since computing it
+// requires walking the tree. `roll` returns a number in [0, 1) to compare
+// with Rate.
+func (f Fault) matches(op Op, p func() string, idx int, roll func() float64) bool {
+	ops := f.Ops
+	if ops == 0 {
+		ops = OpAll
+	}
+	if ops&op == 0 {
+		return false
+	}
+	if f.IndexHi > f.IndexLo && (idx < f.IndexLo || idx >= f.IndexHi) {
+		return false
+	}
+	if f.Path != "" && !matchPath(f.Path, p()) {
+		return false
+	}
+	return f.Rate <= 0 || roll() < f.Rate
+}
+
+// lockedRand is a source of random numbers that is safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+// Float64 returns a random number in [0, 1).
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+// fault returns the errno of the first configured fault that applies to
+// operation `op` on `node`, or 0 if the operation should succeed. Operations
+// that are part of another operation (see internal) never fail.
+func (r *root) fault(ctx context.Context, op Op, node *fs.Inode, idx int) syscall.Errno {
+	if isInternal(ctx) {
+		return 0
+	}
+	faults := r.faults.Load()
+	if faults == nil {
+		return 0
+	}
+	p := func() string { return node.Path(&r.Inode) }
+	for _, f := range *faults {
+		if f.matches(op, p, idx, r.faultRand.Float64) {
+			return f.errno()
+		}
+	}
+	return 0
+}
+
+// rootOf returns the root of the filesystem containing `n`.
+func rootOf(n *fs.Inode) *root {
+	return n.Root().Operations().(*root)
+}
+
+// songIndex returns the index of the song `n`, or -1 if it is not a song.
+func songIndex(n *fs.Inode) int {
+	if s, ok := n.Operations().(*song); ok {
+		return s.idx
+	}
+	return -1
+}
+
+// lookupChild implements Lookup for directories. It behaves like go-fuse's
+// default lookup, except that lookup latency and faults are applied.
+func lookupChild(ctx context.Context, parent *fs.Inode, name string, out *fuse.EntryOut) (_ *fs.Inode, errno syscall.Errno) {
+	r := rootOf(parent)
+	child := parent.GetChild(name)
+	idx := -1
+	if child != nil {
+		idx = songIndex(child)
+	}
+	a := r.begin(ctx, OpLookup, parent, name, idx)
+	defer func() { a.done(errno) }()
+	if errno := r.wait(ctx, OpLookup); errno != 0 {
+		return nil, errno
+	}
+	if faults := r.faults.Load(); faults != nil {
+		p := func() string { return path.Join(parent.Path(&r.Inode), name) }
+		for _, f := range *faults {
+			if f.matches(OpLookup, p, idx, r.faultRand.Float64) {
+				return nil, a.fault(f.errno())
+			}
+		}
+	}
+	if child == nil {
+		return nil, syscall.ENOENT
+	}
+
+	if ga, ok := child.Operations().(fs.NodeGetattrer); ok {
+		// Like go-fuse's default lookup, errors from the getattr are
+		// ignored. It isn't delayed or failed like a getattr of its own.
+		var attr fuse.AttrOut
+		if errno := ga.Getattr(internal(ctx), nil, &attr); errno == 0 {
+			out.Attr = attr.Attr
+		}
+	}
+	return child, fs.OK
+}
+
+// readdir implements Readdir for directories. It behaves like go-fuse's
+// default readdir, except that readdir latency and faults are applied.
+func readdir(ctx context.Context, dir *fs.Inode) (_ fs.DirStream, errno syscall.Errno) {
+	r := rootOf(dir)
+	a := r.begin(ctx, OpReaddir, dir, "", -1)
+	defer func() { a.done(errno) }()
+	if errno := r.wait(ctx, OpReaddir); errno != 0 {
+		return nil, errno
+	}
+	if errno := r.fault(ctx, OpReaddir, dir, -1); errno != 0 {
+		return nil, a.fault(errno)
+	}
+	children := dir.Children()
+	entries := make([]fuse.DirEntry, 0, len(children))
+	for name, child := range children {
+		entries = append(entries, fuse.DirEntry{
+			Mode: child.Mode(),
+			Name: name,
+			Ino:  child.StableAttr().Ino,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+// SetFaults replaces the faults applied to the mounted library. A nil or
+// empty `faults` disables fault injection. Note that the kernel may cache
+// lookups and attributes (see fs.Options.EntryTimeout and AttrTimeout), in
+// which case cached operations never reach the filesystem, and can't fail.
+func (s *Server) SetFaults(faults []Fault) {
+	s.root.setFaults(faults)
+}
+
+// Faults returns the faults currently applied to the mounted library.
+func (s *Server) Faults() []Fault {
+	faults := s.root.faults.Load()
+	if faults == nil {
+		return nil
+	}
+	return append([]Fault(nil), *faults...)
+}
+
+func (r *root) setFaults(faults []Fault) {
+	if len(faults) == 0 {
+		r.faults.Store(nil)
+		return
+	}
+	faults = append([]Fault(nil), faults...)
+	r.faults.Store(&faults)
+}
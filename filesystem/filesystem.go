@@ -9,7 +9,7 @@ Typical Usage:
         ...
     }
 
-    server, err := filesystem.Mount(lib, dir, nil)
+    server, err := filesystem.MountWithOptions(lib, dir, nil)
     if err != nil {
         ...
     }
@@ -22,25 +22,48 @@ package filesystem
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"io"
 	"path"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/joshkunz/fakelib/library"
+	"github.com/joshkunz/fakelib/metrics"
 )
 
 type song struct {
 	fs.Inode
 
+	// idx is the index of the song in the library.
+	idx int
+	// lastRead is the time the song was last read, in Unix nanoseconds.
+	lastRead int64
+
+	// mu guards song, which is replaced when the library is edited while
+	// mounted.
+	mu   sync.RWMutex
 	song library.Song
 }
 
+func (s *song) get() library.Song {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.song
+}
+
+func (s *song) set(lSong library.Song) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.song = lSong
+}
+
 var _ fs.NodeOpener = (*song)(nil)
 var _ fs.NodeReader = (*song)(nil)
 var _ fs.NodeGetattrer = (*song)(nil)
@@ -49,70 +72,336 @@ func (s *song) Open(context.Context, uint32) (fs.FileHandle, uint32, syscall.Err
 	return nil, 0, fs.OK
 }
 
-func (s *song) Read(_ context.Context, _ fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	s.song.Read(dest, off)
-	return fuse.ReadResultData(dest), fs.OK
+func (s *song) Read(ctx context.Context, _ fs.FileHandle, dest []byte, off int64) (_ fuse.ReadResult, errno syscall.Errno) {
+	r := rootOf(&s.Inode)
+	a := r.begin(ctx, OpRead, &s.Inode, "", s.idx)
+	defer func() { a.done(errno) }()
+	lSong := s.get()
+	n := lSong.Size() - off
+	if n > int64(len(dest)) {
+		n = int64(len(dest))
+	}
+	if errno := r.waitRead(ctx, &s.lastRead, int(max(n, 0))); errno != 0 {
+		return nil, errno
+	}
+	if errno := r.fault(ctx, OpRead, &s.Inode, s.idx); errno != 0 {
+		return nil, a.fault(errno)
+	}
+	// Only return the bytes that were read, so short reads at the end of
+	// the song don't include the rest of `dest`.
+	read, _ := lSong.ReadAt(dest, off)
+	a.read(off, len(dest), read, lSong.TagSize())
+	return fuse.ReadResultData(dest[:read]), fs.OK
 }
 
-func (s *song) Getattr(_ context.Context, _ fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	out.Size = uint64(s.song.Size())
+func (s *song) Getattr(ctx context.Context, _ fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	r := rootOf(&s.Inode)
+	a := r.begin(ctx, OpGetattr, &s.Inode, "", s.idx)
+	defer func() { a.done(errno) }()
+	if errno := r.wait(ctx, OpGetattr); errno != 0 {
+		return errno
+	}
+	if errno := r.fault(ctx, OpGetattr, &s.Inode, s.idx); errno != 0 {
+		return a.fault(errno)
+	}
+	lSong := s.get()
+	out.Size = uint64(lSong.Size())
+	setTimes(&out.Attr, lSong.ModTime())
 	return fs.OK
 }
 
+// setTimes sets the access, modification and change times in `attr` to `t`,
+// unless `t` is the zero time.
+func setTimes(attr *fuse.Attr, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	attr.SetTimes(&t, &t, &t)
+}
+
+// dirTimes tracks the modification time of a directory, which is the
+// modification time of its newest child.
+type dirTimes struct {
+	mu    sync.Mutex
+	mtime time.Time
+}
+
+func (d *dirTimes) touch(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t.After(d.mtime) {
+		d.mtime = t
+	}
+}
+
+func (d *dirTimes) modTime() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mtime
+}
+
+type toucher interface {
+	touch(time.Time)
+	modTime() time.Time
+}
+
+type directory struct {
+	fs.Inode
+	dirTimes
+}
+
+var _ fs.NodeGetattrer = (*directory)(nil)
+var _ fs.NodeLookuper = (*directory)(nil)
+var _ fs.NodeReaddirer = (*directory)(nil)
+
+func (d *directory) Getattr(ctx context.Context, _ fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	r := rootOf(&d.Inode)
+	a := r.begin(ctx, OpGetattr, &d.Inode, "", -1)
+	defer func() { a.done(errno) }()
+	if errno := r.wait(ctx, OpGetattr); errno != 0 {
+		return errno
+	}
+	if errno := r.fault(ctx, OpGetattr, &d.Inode, -1); errno != 0 {
+		return a.fault(errno)
+	}
+	setTimes(&out.Attr, d.modTime())
+	return fs.OK
+}
+
+func (d *directory) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return lookupChild(ctx, &d.Inode, name, out)
+}
+
+func (d *directory) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return readdir(ctx, &d.Inode)
+}
+
 type root struct {
 	fs.Inode
+	dirTimes
+
+	// mu guards l, paths, and changes to the tree after OnAdd.
+	mu     sync.Mutex
+	l      *library.Library
+	paths  *library.PathMap
+	opts   Options
+	inodes inodes
+	// accessLog is set if Options.AccessLog is.
+	accessLog *accessLog
+	// metrics is set if Options.Metrics is.
+	metrics *fsMetrics
+	// buildErr is set if the tree could not be built by OnAdd.
+	buildErr error
 
-	l              *library.Library
-	nextInodeInit  sync.Once
-	nextInodeIDRaw *uint64
+	// faults are the faults currently applied, or nil if there are none.
+	faults atomic.Pointer[[]Fault]
+	// faultRand decides whether faults with a Rate apply. It is seeded with
+	// Options.FaultSeed.
+	faultRand *lockedRand
+	// latency is the current latency, or nil if there is none.
+	latency  atomic.Pointer[Latency]
+	throttle throttle
 }
 
 var _ fs.NodeOnAdder = (*root)(nil)
+var _ fs.NodeGetattrer = (*root)(nil)
+var _ fs.NodeLookuper = (*root)(nil)
+var _ fs.NodeReaddirer = (*root)(nil)
 
-func (r *root) nextInodeID() (out uint64) {
-	r.nextInodeInit.Do(func() {
-		// -1, and 1 are reserved, so start at 2.
-		nodeID := uint64(2)
-		r.nextInodeIDRaw = &nodeID
-	})
-	return atomic.AddUint64(r.nextInodeIDRaw, 1)
+func (r *root) Getattr(ctx context.Context, _ fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	a := r.begin(ctx, OpGetattr, &r.Inode, "", -1)
+	defer func() { a.done(errno) }()
+	if errno := r.wait(ctx, OpGetattr); errno != 0 {
+		return errno
+	}
+	setTimes(&out.Attr, r.modTime())
+	return fs.OK
+}
+
+func (r *root) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return lookupChild(ctx, &r.Inode, name, out)
+}
+
+func (r *root) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return readdir(ctx, &r.Inode)
+}
+
+// mkdirAll returns the inode of the directory `dir`, creating it and any
+// missing parents. It also returns the inodes of every directory from the
+// root down to `dir`.
+func (r *root) mkdirAll(ctx context.Context, dir string) (wd *fs.Inode, ancestors []*fs.Inode, err error) {
+	wd = &r.Inode
+	ancestors = []*fs.Inode{wd}
+	var cwd string
+	for _, component := range strings.Split(dir, "/") {
+		if component == "" {
+			// `dir` likely has a trailing `/` which yields an empty path
+			// component on split, so ignore that component.
+			continue
+		}
+		cwd = path.Join(cwd, component)
+
+		cur := wd.GetChild(component)
+		if cur != nil && !cur.IsDir() {
+			// Noise files and links aren't in the PathMap, so a directory
+			// for a song can have the same name as one. The song wins.
+			wd.RmChild(component)
+			r.forget(cur)
+			notifyEntry(wd, component)
+			cur = nil
+		}
+		if cur == nil {
+			attr, err := r.inodes.dir(cwd)
+			if err != nil {
+				return nil, nil, err
+			}
+			cur = wd.NewPersistentInode(ctx, &directory{}, attr)
+			wd.AddChild(component, cur, true)
+		}
+
+		wd = cur
+		ancestors = append(ancestors, wd)
+	}
+	return wd, ancestors, nil
+}
+
+// touchAll updates the modification time of every directory in `dirs`.
+func touchAll(dirs []*fs.Inode, t time.Time) {
+	for _, d := range dirs {
+		d.Operations().(toucher).touch(t)
+	}
 }
 
 func (r *root) OnAdd(ctx context.Context) {
-	for i := 0; i < r.l.Tracks; i++ {
-		location, err := r.l.PathAt(i)
+	// Directories that contain songs, in the order they were created.
+	var songDirs []string
+	songDirNodes := make(map[string]*fs.Inode)
+
+	// Songs and their paths are generated together (see
+	// library.Library.SongPaths), and the tree is built as they are.
+	paths, err := r.l.SongPaths(func(i int, location string, lSong library.Song) error {
+		dir, fname := path.Split(location)
+		wd, ancestors, err := r.mkdirAll(ctx, dir)
 		if err != nil {
-			log.Fatalf("failed to get path at idx %d: %v", i, err)
+			return err
 		}
-		lSong, err := r.l.SongAt(i)
+		attr, err := r.inodes.song(i)
 		if err != nil {
-			log.Fatalf("failed to get song at idx %d: %v", i, err)
+			return err
 		}
-		dir, fname := path.Split(location)
+		node := wd.NewPersistentInode(ctx, &song{idx: i, song: lSong}, attr)
+		wd.AddChild(fname, node, true)
+		touchAll(ancestors, lSong.ModTime())
 
-		wd := &r.Inode
-		for _, component := range strings.Split(dir, "/") {
-			if component == "" {
-				// `dir` likely has a trailing `/` which yields an empty path
-				// component on split, so ignore that component.
-				continue
-			}
+		dir = strings.TrimSuffix(dir, "/")
+		if _, ok := songDirNodes[dir]; !ok {
+			songDirNodes[dir] = wd
+			songDirs = append(songDirs, dir)
+		}
+		return nil
+	})
+	if err != nil {
+		r.buildErr = fmt.Errorf("failed to build the library tree: %w", err)
+		return
+	}
+	r.paths = paths
 
-			cur := wd.GetChild(component)
-			if cur == nil {
-				cur = wd.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{
-					Mode: fuse.S_IFDIR,
-					Ino:  r.nextInodeID(),
-				})
-				wd.AddChild(component, cur, true)
+	if r.opts.Links != nil {
+		for _, dir := range songDirs {
+			if err := r.addLinks(ctx, dir, songDirNodes[dir]); err != nil {
+				r.buildErr = err
+				return
 			}
+		}
+	}
 
-			wd = cur
+	if r.opts.Noise != nil {
+		for _, dir := range songDirs {
+			wd := songDirNodes[dir]
+			for _, f := range r.opts.Noise.filesFor(dir) {
+				if wd.GetChild(f.Name) != nil {
+					// Never shadow a song.
+					continue
+				}
+				noise := &noiseFile{data: f.Contents, mtime: wd.Operations().(toucher).modTime()}
+				attr, err := r.inodes.near(wd.StableAttr().Ino, fuse.S_IFREG)
+				if err != nil {
+					r.buildErr = err
+					return
+				}
+				node := wd.NewPersistentInode(ctx, noise, attr)
+				wd.AddChild(f.Name, node, true)
+			}
 		}
+	}
+}
 
-		node := wd.NewPersistentInode(ctx, &song{song: lSong}, fs.StableAttr{Ino: r.nextInodeID()})
-		wd.AddChild(fname, node, true)
+// Options configures a mounted library.
+type Options struct {
+	// Options are the go-fuse options used for the mount. EntryTimeout and
+	// AttrTimeout default to 1s if unset, like with fs.Mount and nil options.
+	fs.Options
+
+	// Noise, if set, places non-music files alongside the songs in the
+	// library.
+	Noise *Noise
+
+	// Links, if set, adds symbolic links and hard links to the library.
+	Links *Links
+
+	// Latency, if set, slows down operations on the mounted library. It can
+	// be changed after mounting with Server.SetLatency.
+	Latency *Latency
+
+	// Faults make some operations on the mounted library fail. They can be
+	// changed after mounting with Server.SetFaults.
+	Faults []Fault
+	// FaultSeed seeds the choice of operations that fail for faults with a
+	// Rate, so a run that makes the same operations in the same order sees
+	// the same failures.
+	FaultSeed int64
+
+	// AccessLog, if set, is written a line of JSON for every operation on
+	// the mounted library, see AccessEntry. Lines are written with a single
+	// Write call each, and writes are serialized. Operations are slowed down
+	// by slow writes, so e.g. files should be buffered.
+	AccessLog io.Writer
+
+	// Metrics, if set, is the registry that metrics about the mounted library
+	// are added to, e.g. counts and latencies of operations, and bytes read
+	// from tags and audio data.
+	Metrics *metrics.Registry
+
+	// LargeInodes allows inode numbers that don't fit in 32 bits, for
+	// libraries with more than about 2^31 songs. Mounting such a library
+	// fails with ErrTooManyInodes otherwise. Programs that store inode
+	// numbers in 32 bits, like MPD, won't work with these libraries.
+	LargeInodes bool
+}
+
+// newRoot returns the root of a filesystem for `lib`. The tree of songs is
+// built by OnAdd, once the root is added to a go-fuse filesystem.
+func newRoot(lib *library.Library, options *Options) (*root, error) {
+	// Check the inode numbers first, since generating the paths of a library
+	// that large takes a long time.
+	ino := inodes{large: options.LargeInodes}
+	if err := ino.checkTracks(lib.Tracks); err != nil {
+		return nil, err
+	}
+	r := &root{l: lib, opts: *options, inodes: ino}
+	if options.AccessLog != nil {
+		r.accessLog = &accessLog{w: options.AccessLog}
+	}
+	if options.Metrics != nil {
+		r.metrics = newMetrics(options.Metrics, r)
 	}
+	r.faultRand = newLockedRand(options.FaultSeed)
+	r.setFaults(options.Faults)
+	if options.Latency != nil {
+		latency := *options.Latency
+		r.latency.Store(&latency)
+	}
+	return r, nil
 }
 
 // Mount mounts the given library into `dir`. `options` can be used to supply
@@ -121,6 +410,66 @@ func (r *root) OnAdd(ctx context.Context) {
 // goroutine. This function does not block. The `Unmount` method of the returned
 // server can be used to unmount the filesystem. See the go-fuse docs for
 // details.
+//
+// Deprecated: Use MountWithOptions, which can also configure the library's
+// filesystem, and returns a Server that can change the mounted library.
 func Mount(lib *library.Library, dir string, options *fs.Options) (*fuse.Server, error) {
-	return fs.Mount(dir, &root{l: lib}, options)
+	var opts Options
+	if options != nil {
+		opts.Options = *options
+	}
+	server, err := MountWithOptions(lib, dir, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return server.Server, nil
+}
+
+// fuseOptions returns the go-fuse options of `options`, with the defaults
+// fs.Mount uses for nil options in place of unset timeouts.
+func fuseOptions(options *Options) fs.Options {
+	opts := options.Options
+	oneSec := time.Second
+	if opts.EntryTimeout == nil {
+		opts.EntryTimeout = &oneSec
+	}
+	if opts.AttrTimeout == nil {
+		opts.AttrTimeout = &oneSec
+	}
+	return opts
+}
+
+// MountWithOptions mounts the given library into `dir`. `options` can be
+// used to supply additional FUSE mount options, and configure the library's
+// filesystem. If the default options are OK, then `nil` can safely be
+// provided for `options`. The FUSE server runs in a separate goroutine. This
+// function does not block. The `Unmount` method of the returned server can
+// be used to unmount the filesystem. See the go-fuse docs for details. The
+// library can be changed while it is mounted using the returned server, see
+// Server. An error is returned without mounting if the library's paths
+// collide, and the library's Collisions strategy does not resolve them.
+func MountWithOptions(lib *library.Library, dir string, options *Options) (*Server, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	r, err := newRoot(lib, options)
+	if err != nil {
+		return nil, err
+	}
+	fsOpts := fuseOptions(options)
+	// Like fs.Mount, but the tree is built (by OnAdd) before mounting, so
+	// nothing is mounted if it can't be.
+	rawFS := fs.NewNodeFS(r, &fsOpts)
+	if r.buildErr != nil {
+		return nil, r.buildErr
+	}
+	server, err := fuse.NewServer(rawFS, dir, &fsOpts.MountOptions)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		return nil, err
+	}
+	return &Server{Server: server, root: r}, nil
 }
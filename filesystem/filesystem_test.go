@@ -1,24 +1,36 @@
 package filesystem
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/bogem/id3v2/v2"
+	"github.com/google/go-cmp/cmp"
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/joshkunz/fakelib/library"
+	"github.com/joshkunz/fakelib/metrics"
 )
 
 const (
 	goldFilePath = "testdata/gold.mp3"
 )
 
-func loadLibrary(t *testing.T) *library.Library {
+func loadLibrary(t testing.TB) *library.Library {
 	t.Helper()
 
 	gold, err := os.Open(goldFilePath)
@@ -36,17 +48,28 @@ func loadLibrary(t *testing.T) *library.Library {
 
 func mount(t *testing.T, lib *library.Library) (dir string, cleanup func()) {
 	t.Helper()
+	return mountWithOptions(t, lib, &Options{})
+}
+
+func mountWithOptions(t *testing.T, lib *library.Library, opts *Options) (dir string, cleanup func()) {
+	t.Helper()
+	dir, _, cleanup = mountServer(t, lib, opts)
+	return dir, cleanup
+}
+
+func mountServer(t testing.TB, lib *library.Library, opts *Options) (dir string, server *Server, cleanup func()) {
+	t.Helper()
 
 	d, err := ioutil.TempDir("", "fakelib-filesystem")
 	if err != nil {
 		t.Fatalf("Failed to create temp directory: %v", err)
 	}
 
-	srv, err := Mount(lib, d, &fs.Options{})
+	srv, err := MountWithOptions(lib, d, opts)
 	if err != nil {
 		t.Fatalf("Failed to mount FUSE server at %q: %v", d, err)
 	}
-	return d, func() {
+	return d, srv, func() {
 		if err := srv.Unmount(); err != nil {
 			t.Errorf("Failed to unmount: %v", err)
 		}
@@ -74,6 +97,38 @@ func TestBasic(t *testing.T) {
 	}
 }
 
+// Test that songs read through the mount match the library, including short
+// reads at the end of a song.
+func TestReadContents(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 3
+	dir, cleanup := mount(t, lib)
+	defer cleanup()
+
+	for idx := 0; idx < lib.Tracks; idx++ {
+		p, _ := lib.PathAt(idx)
+		song, _ := lib.SongAt(idx)
+		want := make([]byte, song.Size())
+		song.ReadAt(want, 0)
+
+		got, err := ioutil.ReadFile(filepath.Join(dir, p))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("ReadFile(%s) = %d bytes, %v; want song %d (%d bytes), nil", p, len(got), err, idx, len(want))
+		}
+
+		f, err := os.Open(filepath.Join(dir, p))
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", p, err)
+		}
+		buf := make([]byte, 1<<16)
+		n, err := f.ReadAt(buf, song.Size()-10)
+		f.Close()
+		if n != 10 || err != io.EOF || !bytes.Equal(buf[:n], want[len(want)-10:]) {
+			t.Errorf("ReadAt(<64KiB>, size-10) of %s = %d, %v; want 10, io.EOF", p, n, err)
+		}
+	}
+}
+
 // MPD (musicpd.org) has a recursive-folder detection algorithm based on file
 // Inode number. Unfortunately, it representes inodes as C `unsigned` integers
 // which are typically 32 bits. This is problematic for us because go-fuse by
@@ -93,9 +148,9 @@ func TestSmallUniqueInodes(t *testing.T) {
 	dir, cleanup := mount(t, lib)
 	defer cleanup()
 
-	// The largest Inode we will support, something a good bit larger than our
-	// our library size.
-	maxInode := uint64(lib.Tracks * 2)
+	// The largest Inode we will support. Directories are numbered from a
+	// hash of their path, so they can have any number that fits in 32 bits.
+	maxInode := uint64(math.MaxUint32)
 	allInodes := make(map[uint64]string)
 
 	var failures int
@@ -138,3 +193,1154 @@ func TestSmallUniqueInodes(t *testing.T) {
 		t.Fatalf("Error while walking mount: %v, want nil", err)
 	}
 }
+
+// Songs have inode numbers derived from their index, which they keep when the
+// library is changed.
+func TestSongInodes(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 10
+
+	dir, srv, cleanup := mountServer(t, lib, &Options{})
+	defer cleanup()
+
+	inodeOf := func(idx int) uint64 {
+		t.Helper()
+		p, err := lib.PathAt(idx)
+		if err != nil {
+			t.Fatalf("lib.PathAt(%d) = _, %v; want _, nil", idx, err)
+		}
+		var stat syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(dir, p), &stat); err != nil {
+			t.Fatalf("Failed to stat song %d: %v", idx, err)
+		}
+		return stat.Ino
+	}
+
+	for idx := 0; idx < lib.Tracks; idx++ {
+		if got, want := inodeOf(idx), songInode(idx); got != want {
+			t.Errorf("Song %d has inode %d, want %d", idx, got, want)
+		}
+	}
+
+	if err := srv.Resize(5); err != nil {
+		t.Fatalf("srv.Resize(5) = %v, want nil", err)
+	}
+	if err := srv.Resize(10); err != nil {
+		t.Fatalf("srv.Resize(10) = %v, want nil", err)
+	}
+	if got, want := inodeOf(7), songInode(7); got != want {
+		t.Errorf("Song 7 has inode %d after it was re-added, want %d", got, want)
+	}
+}
+
+func TestFuseOptions(t *testing.T) {
+	opts := fuseOptions(&Options{})
+	if opts.EntryTimeout == nil || *opts.EntryTimeout != time.Second || opts.AttrTimeout == nil || *opts.AttrTimeout != time.Second {
+		t.Errorf("fuseOptions(&Options{}) has EntryTimeout %v, AttrTimeout %v; want 1s for both", opts.EntryTimeout, opts.AttrTimeout)
+	}
+	var noCache time.Duration
+	set := &Options{}
+	set.EntryTimeout = &noCache
+	set.AttrTimeout = &noCache
+	if opts := fuseOptions(set); *opts.EntryTimeout != 0 || *opts.AttrTimeout != 0 {
+		t.Errorf("fuseOptions(...) with zero timeouts has EntryTimeout %v, AttrTimeout %v; want 0 for both", *opts.EntryTimeout, *opts.AttrTimeout)
+	}
+}
+
+func TestTooManyInodes(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = math.MaxUint32/2 + 1
+	if _, err := newRoot(lib, &Options{}); !errors.Is(err, ErrTooManyInodes) {
+		t.Errorf("newRoot(...) with %d tracks = _, %v; want _, ErrTooManyInodes", lib.Tracks, err)
+	}
+
+	if err := (&inodes{}).checkTracks(math.MaxUint32 / 2); err != nil {
+		t.Errorf("checkTracks(%d) = %v, want nil", math.MaxUint32/2, err)
+	}
+	if err := (&inodes{large: true}).checkTracks(lib.Tracks); err != nil {
+		t.Errorf("checkTracks(%d) with large inodes = %v, want nil", lib.Tracks, err)
+	}
+}
+
+func TestInodeAllocation(t *testing.T) {
+	var n inodes
+	alloc := func(attr fs.StableAttr, err error) uint64 {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Failed to allocate an inode: %v", err)
+		}
+		return attr.Ino
+	}
+
+	// Directories are numbered from their path alone.
+	a := alloc(n.dir("A"))
+	if a%2 != 1 || a < 3 || a > math.MaxUint32 {
+		t.Errorf("Directory A has inode %d, want an odd number in [3, 2^32)", a)
+	}
+	aa := alloc(n.dir("A/A"))
+	var other inodes
+	if got := alloc(other.dir("A/A")); got != aa {
+		t.Errorf("Directory A/A has inode %d, want %d as in another tree", got, aa)
+	}
+	// A directory that collides with another takes the next free number.
+	n.free(aa)
+	n.alloc(aa, fuse.S_IFREG)
+	if got := alloc(n.dir("A/A")); got != aa+2 {
+		t.Errorf("Directory A/A has inode %d after a collision, want %d", got, aa+2)
+	}
+	// Nodes in a directory skip the inodes already in use.
+	if got := alloc(n.near(aa, fuse.S_IFLNK)); got != aa+4 {
+		t.Errorf("Symlink in directory %d has inode %d, want %d", aa, got, aa+4)
+	}
+	// Freed inodes are reused, with a new generation.
+	n.free(a)
+	attr, err := n.dir("A")
+	if err != nil {
+		t.Fatalf("dir(\"A\") = _, %v; want _, nil", err)
+	}
+	if attr.Ino != a || attr.Gen == 0 {
+		t.Errorf("Directory A has inode %d, generation %d; want %d, > 0", attr.Ino, attr.Gen, a)
+	}
+
+	// Probing skips full words of the bitset, and wraps around after the
+	// limit.
+	var full inodes
+	last := uint64(math.MaxUint32)
+	if got := alloc(full.alloc(last, fuse.S_IFDIR)); got != last {
+		t.Fatalf("alloc(%d) = %d, want %d", last, got, last)
+	}
+	for i := 0; i < 200; i++ {
+		if got, want := alloc(full.near(last, fuse.S_IFREG)), uint64(3+2*i); got != want {
+			t.Fatalf("Node %d after the limit has inode %d, want %d", i, got, want)
+		}
+	}
+}
+
+// inodesOf returns the inode number of every file and directory in `dir`,
+// by path.
+func inodesOf(t *testing.T, dir string) map[string]uint64 {
+	t.Helper()
+	inodes := make(map[string]uint64)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		inodes[rel] = info.Sys().(*syscall.Stat_t).Ino
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk %q: %v", dir, err)
+	}
+	return inodes
+}
+
+// Inode numbers are the same every time a library is mounted, and the songs
+// and directories shared by libraries of different sizes, or with some songs
+// moved, have the same inode numbers.
+func TestStableInodes(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 500
+	opts := &Options{
+		Noise: &Noise{Rate: 1},
+		Links: &Links{Songs: 0.5, Dangling: 0.5},
+	}
+
+	dir, cleanup := mountWithOptions(t, lib, opts)
+	first := inodesOf(t, dir)
+	cleanup()
+	dir, cleanup = mountWithOptions(t, lib, opts)
+	second := inodesOf(t, dir)
+	cleanup()
+	if diff := cmp.Diff(first, second); diff != "" {
+		t.Errorf("Inodes differ between mounts of the same library (-first +second):\n%s", diff)
+	}
+
+	smaller := loadLibrary(t)
+	smaller.Tracks = 123
+	// Moving the first songs elsewhere doesn't renumber the directories of
+	// the songs after them.
+	for idx := 0; idx < 3; idx++ {
+		if err := smaller.SetPath(idx, fmt.Sprintf("Moved/%d.mp3", idx)); err != nil {
+			t.Fatalf("smaller.SetPath(%d, ...) = %v, want nil", idx, err)
+		}
+	}
+	dir, cleanup = mount(t, smaller)
+	defer cleanup()
+	var shared int
+	for p, ino := range inodesOf(t, dir) {
+		got, ok := first[p]
+		if !ok {
+			continue
+		}
+		if got != ino {
+			t.Errorf("%s has inode %d in a library of %d songs, and %d in a library of %d songs", p, ino, smaller.Tracks, got, lib.Tracks)
+		}
+		shared++
+	}
+	if shared <= smaller.Tracks-3 {
+		t.Errorf("Compared %d inodes, want more than %d", shared, smaller.Tracks-3)
+	}
+}
+
+// Mounting a library where two songs have the same path should fail, unless a
+// collision strategy is configured.
+func TestMountCollisions(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Pather = func(int, *id3v2.Tag) string { return "A/A/A.mp3" }
+	lib.Tracks = 3
+
+	d, err := ioutil.TempDir("", "fakelib-filesystem")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.Remove(d)
+
+	if srv, err := MountWithOptions(lib, d, &Options{}); err == nil {
+		srv.Unmount()
+		t.Fatalf("MountWithOptions(...) with colliding paths = _, nil; want _, <error>")
+	}
+
+	lib.Collisions = library.CollisionSuffixCount
+	dir, cleanup := mount(t, lib)
+	defer cleanup()
+
+	for _, name := range []string{"A.mp3", "A (2).mp3", "A (3).mp3"} {
+		if _, err := os.Stat(filepath.Join(dir, "A", "A", name)); err != nil {
+			t.Errorf("Failed to stat A/A/%s: %v", name, err)
+		}
+	}
+}
+
+func TestNoiseFilesFor(t *testing.T) {
+	all := &Noise{Rate: 1}
+	got := all.filesFor("A/Album")
+	if len(got) != len(DefaultNoiseFiles) {
+		t.Fatalf("Noise{Rate: 1}.filesFor(...) returned %d files, want %d", len(got), len(DefaultNoiseFiles))
+	}
+	if got[0].Name != "Album.nfo" {
+		t.Errorf("Noise{Rate: 1}.filesFor(\"A/Album\")[0].Name = %q, want %q", got[0].Name, "Album.nfo")
+	}
+
+	if got := (&Noise{Rate: 0}).filesFor("A/Album"); len(got) != 0 {
+		t.Errorf("Noise{Rate: 0}.filesFor(...) = %v, want no files", got)
+	}
+
+	// Selection must be deterministic, and roughly follow Rate.
+	half := &Noise{Rate: 0.5, Seed: 1}
+	var total int
+	for i := 0; i < 1000; i++ {
+		dir := fmt.Sprintf("dir%d", i)
+		a, b := half.filesFor(dir), half.filesFor(dir)
+		if len(a) != len(b) {
+			t.Fatalf("filesFor(%q) is not deterministic: %v != %v", dir, a, b)
+		}
+		total += len(a)
+	}
+	want := len(DefaultNoiseFiles) * 1000 / 2
+	if total < want*9/10 || total > want*11/10 {
+		t.Errorf("Noise{Rate: 0.5} selected %d files, want ~%d", total, want)
+	}
+}
+
+func TestRoll(t *testing.T) {
+	// Noise files and links are picked by rolling, so a seed always picks
+	// the same ones.
+	if a, b := roll(7, "A/Album", "Thumbs.db"), roll(7, "A/Album", "Thumbs.db"); a != b {
+		t.Errorf("roll(7, \"A/Album\", \"Thumbs.db\") = %v, then %v; want the same number", a, b)
+	}
+	if a, b := roll(7, "ab", "c"), roll(7, "a", "bc"); a == b {
+		t.Errorf("roll(7, \"ab\", \"c\") = roll(7, \"a\", \"bc\") = %v, want different numbers", a)
+	}
+
+	// Rolls for the directories of a library are in [0, 1), and spread
+	// evenly over it.
+	const rolls, buckets = 10000, 10
+	var counts [buckets]int
+	for i := 0; i < rolls; i++ {
+		dir := "Artist " + strconv.Itoa(i) + "/Album"
+		r := roll(7, dir, "Thumbs.db")
+		if r < 0 || r >= 1 {
+			t.Fatalf("roll(7, %q, \"Thumbs.db\") = %v, want a number in [0, 1)", dir, r)
+		}
+		counts[int(r*buckets)]++
+	}
+	for i, n := range counts {
+		if want := rolls / buckets; n < want*8/10 || n > want*12/10 {
+			t.Errorf("%d rolls in [%v, %v), want ~%d", n, float64(i)/buckets, float64(i+1)/buckets, want)
+		}
+	}
+}
+
+func TestNoise(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 20
+
+	d, cleanup := mountWithOptions(t, lib, &Options{Noise: &Noise{Rate: 1}})
+	defer cleanup()
+
+	for _, name := range []string{"A/A/A.mp3", "A/A/A.nfo", "A/A/Thumbs.db", "A/B/.DS_Store", "A/B/B.log"} {
+		if _, err := os.Stat(filepath.Join(d, name)); err != nil {
+			t.Errorf("Failed to stat %s: %v", name, err)
+		}
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(d, "A/A/desktop.ini"))
+	if err != nil {
+		t.Fatalf("Failed to read A/A/desktop.ini: %v", err)
+	}
+	var want []byte
+	for _, f := range DefaultNoiseFiles {
+		if f.Name == "desktop.ini" {
+			want = f.Contents
+		}
+	}
+	if want == nil || string(got) != string(want) {
+		t.Errorf("A/A/desktop.ini = %q, want %q", got, want)
+	}
+}
+
+func TestRelativeTo(t *testing.T) {
+	tests := []struct {
+		dir, target, want string
+	}{
+		{dir: "", target: "A/A/A.mp3", want: "A/A/A.mp3"},
+		{dir: "A/B", target: "A/A/A.mp3", want: "../../A/A/A.mp3"},
+		{dir: "A/B", target: "A", want: "../../A"},
+		{dir: "A", target: ".", want: ".."},
+		{dir: "", target: ".", want: "."},
+	}
+	for _, test := range tests {
+		if got := relativeTo(test.dir, test.target); got != test.want {
+			t.Errorf("relativeTo(%q, %q) = %q, want %q", test.dir, test.target, got, test.want)
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 20
+
+	dir, cleanup := mountWithOptions(t, lib, &Options{Links: &Links{
+		Songs:     1,
+		Dirs:      1,
+		Outside:   1,
+		Dangling:  1,
+		Loops:     1,
+		HardLinks: 1,
+	}})
+	defer cleanup()
+
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "A/A"))
+	if err != nil {
+		t.Fatalf("Failed to list A/A: %v", err)
+	}
+	byName := make(map[string]os.FileInfo)
+	for _, e := range entries {
+		byName[e.Name()] = e
+	}
+
+	for _, name := range []string{"outside", "dangling.mp3", "loop"} {
+		info, ok := byName[name]
+		if !ok {
+			t.Errorf("A/A/%s does not exist", name)
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("A/A/%s has mode %v, want a symlink", name, info.Mode())
+		}
+	}
+
+	if target, err := os.Readlink(filepath.Join(dir, "A/A/loop")); err != nil || target != "../../A" {
+		t.Errorf("Readlink(A/A/loop) = %q, %v; want %q, nil", target, err, "../../A")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "A/A/dangling.mp3")); err == nil {
+		t.Errorf("Stat(A/A/dangling.mp3) succeeded, want error")
+	}
+
+	var songLinks, hardLinks int
+	for name := range byName {
+		if strings.HasPrefix(name, "symlink - ") {
+			songLinks++
+			// Both song and directory links must resolve.
+			if _, err := os.Stat(filepath.Join(dir, "A/A", name)); err != nil {
+				t.Errorf("Stat(A/A/%s) = %v, want nil", name, err)
+			}
+		}
+		if strings.HasPrefix(name, "hardlink - ") {
+			hardLinks++
+			hard, err := os.Stat(filepath.Join(dir, "A/A", name))
+			if err != nil {
+				t.Fatalf("Stat(A/A/%s) = %v, want nil", name, err)
+			}
+			if hard.Mode()&os.ModeSymlink != 0 || !hard.Mode().IsRegular() {
+				t.Errorf("A/A/%s has mode %v, want regular file", name, hard.Mode())
+			}
+		}
+	}
+	if songLinks != 2 {
+		t.Errorf("A/A has %d symlinks to songs and directories, want 2", songLinks)
+	}
+	if hardLinks != 1 {
+		t.Errorf("A/A has %d hard links, want 1", hardLinks)
+	}
+
+	// Every hard link must share its inode with another song.
+	inodes := make(map[uint64][]string)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".mp3") {
+			ino := info.Sys().(*syscall.Stat_t).Ino
+			inodes[ino] = append(inodes[ino], path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error while walking mount: %v, want nil", err)
+	}
+	for _, paths := range inodes {
+		if len(paths) == 1 && strings.Contains(paths[0], "hardlink - ") {
+			t.Errorf("Hard link %q does not share an inode with any other song", paths[0])
+		}
+	}
+}
+
+// Songs should have the timestamp generated by the library, and directories
+// the timestamp of their newest child.
+func TestTimestamps(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 60
+	base := time.Unix(1_500_000_000, 0)
+	lib.Timestamper = func(idx int) time.Time {
+		return base.Add(time.Duration(idx) * time.Hour)
+	}
+
+	dir, cleanup := mount(t, lib)
+	defer cleanup()
+
+	tests := []struct {
+		path string
+		want time.Time
+	}{
+		{path: "A/A/A.mp3", want: base},
+		{path: "A/A/C.mp3", want: base.Add(2 * time.Hour)},
+		// A/A contains songs 0-9.
+		{path: "A/A", want: base.Add(9 * time.Hour)},
+		// A contains songs 0-29.
+		{path: "A", want: base.Add(29 * time.Hour)},
+		{path: ".", want: base.Add(59 * time.Hour)},
+	}
+	for _, test := range tests {
+		info, err := os.Stat(filepath.Join(dir, test.path))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %v", test.path, err)
+			continue
+		}
+		if !info.ModTime().Equal(test.want) {
+			t.Errorf("Stat(%s).ModTime() = %v, want %v", test.path, info.ModTime(), test.want)
+		}
+	}
+}
+
+func exists(t *testing.T, p string) bool {
+	t.Helper()
+	_, err := os.Stat(p)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("Failed to stat %q: %v", p, err)
+	}
+	return err == nil
+}
+
+// Changes made through the Server should be visible in the mounted library
+// immediately.
+func TestLiveMutation(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 10
+	lib.Timestamper = func(int) time.Time { return time.Unix(1_000_000_000, 0) }
+
+	dir, srv, cleanup := mountServer(t, lib, &Options{})
+	defer cleanup()
+
+	// Look everything up first, so the kernel has it cached.
+	for _, p := range []string{"A/A/A.mp3", "A/A/B.mp3", "A/A/J.mp3", "A/B/A.mp3"} {
+		exists(t, filepath.Join(dir, p))
+	}
+	before, err := os.Stat(filepath.Join(dir, "A/A"))
+	if err != nil {
+		t.Fatalf("Failed to stat A/A: %v", err)
+	}
+
+	if err := srv.Resize(12); err != nil {
+		t.Fatalf("srv.Resize(12) = %v, want nil", err)
+	}
+	if !exists(t, filepath.Join(dir, "A/B/B.mp3")) {
+		t.Errorf("A/B/B.mp3 does not exist after growing the library")
+	}
+	after, err := os.Stat(filepath.Join(dir, "A/A"))
+	if err != nil {
+		t.Fatalf("Failed to stat A/A: %v", err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("A/A mtime changed from %v to %v, but A/A was not changed", before.ModTime(), after.ModTime())
+	}
+
+	if err := srv.Resize(9); err != nil {
+		t.Fatalf("srv.Resize(9) = %v, want nil", err)
+	}
+	for _, p := range []string{"A/A/J.mp3", "A/B/A.mp3", "A/B"} {
+		if exists(t, filepath.Join(dir, p)) {
+			t.Errorf("%s exists after shrinking the library", p)
+		}
+	}
+
+	if err := srv.Remove(0, 1); err != nil {
+		t.Fatalf("srv.Remove(0, 1) = %v, want nil", err)
+	}
+	if exists(t, filepath.Join(dir, "A/A/A.mp3")) {
+		t.Errorf("A/A/A.mp3 exists after it was removed")
+	}
+	after, err = os.Stat(filepath.Join(dir, "A/A"))
+	if err != nil {
+		t.Fatalf("Failed to stat A/A: %v", err)
+	}
+	if !after.ModTime().After(before.ModTime()) {
+		t.Errorf("A/A mtime = %v after removing a song, want after %v", after.ModTime(), before.ModTime())
+	}
+
+	err = srv.Retag(1, 2, func(_ int, tag *id3v2.Tag) {
+		tag.SetTitle("Retagged")
+	})
+	if err != nil {
+		t.Fatalf("srv.Retag(1, 2, ...) = %v, want nil", err)
+	}
+	if exists(t, filepath.Join(dir, "A/A/B.mp3")) {
+		t.Errorf("A/A/B.mp3 exists after it was retagged")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "A/A/Retagged.mp3"))
+	if err != nil {
+		t.Fatalf("Failed to read retagged song: %v", err)
+	}
+	tag, err := id3v2.ParseReader(bytes.NewReader(data), id3v2.Options{Parse: true})
+	if err != nil {
+		t.Fatalf("Failed to parse retagged song: %v", err)
+	}
+	if tag.Title() != "Retagged" {
+		t.Errorf("Retagged song has title %q, want %q", tag.Title(), "Retagged")
+	}
+
+	if err := srv.Move(2, "Moved/Here.mp3"); err != nil {
+		t.Fatalf("srv.Move(2, ...) = %v, want nil", err)
+	}
+	if exists(t, filepath.Join(dir, "A/A/C.mp3")) || !exists(t, filepath.Join(dir, "Moved/Here.mp3")) {
+		t.Errorf("A/A/C.mp3 was not moved to Moved/Here.mp3")
+	}
+
+	// Moving onto an existing song fails with the default collision
+	// strategy, and leaves the library unchanged.
+	if err := srv.Move(3, "Moved/Here.mp3"); err == nil {
+		t.Errorf("srv.Move(3, ...) onto another song = nil, want error")
+	}
+	if !exists(t, filepath.Join(dir, "A/A/D.mp3")) {
+		t.Errorf("A/A/D.mp3 does not exist after failed move")
+	}
+
+	if p, err := srv.PathAt(2); p != "Moved/Here.mp3" || err != nil {
+		t.Errorf("srv.PathAt(2) = %q, %v; want \"Moved/Here.mp3\", nil", p, err)
+	}
+	if idx, ok := srv.Index("Moved/Here.mp3"); idx != 2 || !ok {
+		t.Errorf("srv.Index(\"Moved/Here.mp3\") = %d, %v; want 2, true", idx, ok)
+	}
+	if _, err := srv.PathAt(0); !errors.Is(err, library.ErrRemoved) {
+		t.Errorf("srv.PathAt(0) = _, %v; want _, ErrRemoved", err)
+	}
+	want := Stats{Tracks: 9, Songs: 8, Dirs: 3}
+	if got := srv.Stats(); got != want {
+		t.Errorf("srv.Stats() = %+v, want %+v", got, want)
+	}
+}
+
+// Changes made through the Server must keep hard links working, and replace
+// noise files that are in the way of new directories.
+// Changes that fail leave the library and the mounted tree as they were.
+func TestMutationRollback(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 3
+	pather := lib.Pather
+	lib.Pather = func(idx int, tag *id3v2.Tag) string {
+		if idx == 4 {
+			return "A/A/A.mp3"
+		}
+		return pather(idx, tag)
+	}
+
+	dir, srv, cleanup := mountServer(t, lib, &Options{})
+	defer cleanup()
+
+	// Song 4 collides with song 0.
+	if err := srv.Resize(6); err == nil {
+		t.Fatalf("srv.Resize(6) = nil, want an error")
+	}
+	if got := srv.Tracks(); got != 3 {
+		t.Errorf("srv.Tracks() after failing to grow = %d, want 3", got)
+	}
+	if exists(t, filepath.Join(dir, "A/A/D.mp3")) {
+		t.Errorf("A/A/D.mp3 exists after failing to grow the library")
+	}
+	if err := srv.Resize(4); err != nil {
+		t.Fatalf("srv.Resize(4) = %v, want nil", err)
+	}
+	if !exists(t, filepath.Join(dir, "A/A/D.mp3")) {
+		t.Errorf("A/A/D.mp3 does not exist after growing the library")
+	}
+
+	// Song 1 collides with song 0 if it is retitled "A".
+	if err := srv.Retag(1, 2, func(_ int, tag *id3v2.Tag) { tag.SetTitle("A") }); err == nil {
+		t.Fatalf("srv.Retag(1, 2, ...) to a colliding title = nil, want an error")
+	}
+	if tag, err := lib.EditedTag(1); err != nil || tag != nil {
+		t.Errorf("lib.EditedTag(1) after failing to retag = %v, %v; want nil, nil", tag, err)
+	}
+	if !exists(t, filepath.Join(dir, "A/A/B.mp3")) {
+		t.Errorf("A/A/B.mp3 does not exist after failing to retag it")
+	}
+}
+
+func TestMutationWithLinks(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 20
+
+	var noCache time.Duration
+	opts := &Options{Links: &Links{HardLinks: 1}, Noise: &Noise{Rate: 1}}
+	opts.EntryTimeout = &noCache
+	opts.AttrTimeout = &noCache
+	opts.NegativeTimeout = &noCache
+	dir, srv, cleanup := mountServer(t, lib, opts)
+	defer cleanup()
+
+	// Find a hard link in A/A, and the song it links to.
+	byInode := make(map[uint64]string)
+	var link string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if strings.HasPrefix(rel, "A/A/hardlink - ") {
+			link = rel
+		} else if strings.HasSuffix(rel, ".mp3") {
+			byInode[info.Sys().(*syscall.Stat_t).Ino] = rel
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error while walking mount: %v, want nil", err)
+	}
+	if link == "" {
+		t.Fatalf("A/A has no hard link")
+	}
+	info, err := os.Stat(filepath.Join(dir, link))
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", link, err)
+	}
+	target := byInode[info.Sys().(*syscall.Stat_t).Ino]
+	idx, ok := srv.Index(target)
+	if !ok {
+		t.Fatalf("Hard link %s does not link to a song", link)
+	}
+	want, err := ioutil.ReadFile(filepath.Join(dir, target))
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", target, err)
+	}
+
+	if err := srv.Remove(idx, idx+1); err != nil {
+		t.Fatalf("srv.Remove(%d, %d) = %v, want nil", idx, idx+1, err)
+	}
+	if exists(t, filepath.Join(dir, target)) {
+		t.Errorf("%s exists after it was removed", target)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dir, link)); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Reading %s after removing %s = %d bytes, %v; want %d bytes, nil", link, target, len(got), err, len(want))
+	}
+
+	// A/A/A.nfo is a noise file.
+	if err := srv.Move(0, "A/A/A.nfo/X.mp3"); err != nil {
+		t.Fatalf("srv.Move(0, \"A/A/A.nfo/X.mp3\") = %v, want nil", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "A/A/A.nfo")); err != nil || !info.IsDir() {
+		t.Errorf("Stat(A/A/A.nfo) = %v, %v; want a directory", info, err)
+	}
+	if !exists(t, filepath.Join(dir, "A/A/A.nfo/X.mp3")) {
+		t.Errorf("A/A/A.nfo/X.mp3 does not exist after moving song 0 there")
+	}
+	// A song moved to the name of a noise file replaces it, and the noise
+	// file's inode number is freed.
+	info, err = os.Stat(filepath.Join(dir, "A/A/notes.txt"))
+	if err != nil {
+		t.Fatalf("Failed to stat A/A/notes.txt: %v", err)
+	}
+	noiseIno := info.Sys().(*syscall.Stat_t).Ino
+	moved := 1
+	if moved == idx {
+		moved = 2
+	}
+	if err := srv.Move(moved, "A/A/notes.txt"); err != nil {
+		t.Fatalf("srv.Move(%d, \"A/A/notes.txt\") = %v, want nil", moved, err)
+	}
+	info, err = os.Stat(filepath.Join(dir, "A/A/notes.txt"))
+	if err != nil {
+		t.Fatalf("Failed to stat A/A/notes.txt: %v", err)
+	}
+	if ino := info.Sys().(*syscall.Stat_t).Ino; ino != songInode(moved) {
+		t.Errorf("A/A/notes.txt has inode %d after moving song %d there, want %d", ino, moved, songInode(moved))
+	}
+	srv.root.mu.Lock()
+	slot := (noiseIno - 3) / 2
+	used := srv.root.inodes.used[slot/64]&(1<<(slot%64)) != 0
+	srv.root.mu.Unlock()
+	if used {
+		t.Errorf("Inode %d of the replaced noise file is still in use", noiseIno)
+	}
+}
+
+func TestParseFault(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want Fault
+	}{
+		{"", Fault{}},
+		{"op=read errno=EIO", Fault{Ops: OpRead, Errno: syscall.EIO}},
+		{"op=lookup,getattr errno=estale path=A/* index=5-10 rate=0.5", Fault{
+			Ops: OpLookup | OpGetattr, Errno: syscall.ESTALE, Path: "A/*", IndexLo: 5, IndexHi: 10, Rate: 0.5,
+		}},
+		{"op=all errno=13", Fault{Ops: OpAll, Errno: syscall.EACCES}},
+	} {
+		got, err := ParseFault(test.in)
+		if err != nil {
+			t.Errorf("ParseFault(%q) = _, %v; want nil error", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseFault(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+		if again, err := ParseFault(got.String()); err != nil || !faultsEqual(again, got) {
+			t.Errorf("ParseFault(%q) = %+v, %v; want %+v", got.String(), again, err, got)
+		}
+	}
+
+	for _, in := range []string{"read", "op=write", "errno=EWHAT", "index=5", "index=10-5", "rate=2", "path=[", "size=1"} {
+		if _, err := ParseFault(in); err == nil {
+			t.Errorf("ParseFault(%q) = _, nil; want error", in)
+		}
+	}
+}
+
+// faultsEqual compares faults, treating zero Ops and Errno as their
+// defaults.
+func faultsEqual(a, b Fault) bool {
+	for _, f := range []*Fault{&a, &b} {
+		if f.Ops == 0 {
+			f.Ops = OpAll
+		}
+		f.Errno = f.errno()
+	}
+	return a == b
+}
+
+func TestFaultMatches(t *testing.T) {
+	p := func(s string) func() string { return func() string { return s } }
+	for _, test := range []struct {
+		fault Fault
+		op    Op
+		path  string
+		idx   int
+		want  bool
+	}{
+		{Fault{}, OpRead, "A/A/A.mp3", 0, true},
+		{Fault{Ops: OpRead}, OpGetattr, "A/A/A.mp3", 0, false},
+		{Fault{Path: "A/B"}, OpRead, "A/B/C.mp3", 0, true},
+		{Fault{Path: "A/B"}, OpRead, "A/BB/C.mp3", 0, false},
+		{Fault{Path: "*/*/C.mp3"}, OpRead, "A/B/C.mp3", 0, true},
+		{Fault{IndexLo: 5, IndexHi: 10}, OpRead, "A/A/A.mp3", 5, true},
+		{Fault{IndexLo: 5, IndexHi: 10}, OpRead, "A/A/A.mp3", 10, false},
+		{Fault{IndexLo: 0, IndexHi: 10}, OpReaddir, "A/A", -1, false},
+		{Fault{Rate: 1}, OpRead, "A/A/A.mp3", 0, true},
+	} {
+		if got := test.fault.matches(test.op, p(test.path), test.idx, rand.Float64); got != test.want {
+			t.Errorf("%+v.matches(%v, %q, %d) = %v, want %v", test.fault, test.op, test.path, test.idx, got, test.want)
+		}
+	}
+
+	// Rates are random, but should roughly be followed.
+	var failed int
+	for i := 0; i < 10000; i++ {
+		if (Fault{Rate: 0.25}).matches(OpRead, p(""), 0, rand.Float64) {
+			failed++
+		}
+	}
+	if failed < 2000 || failed > 3000 {
+		t.Errorf("Fault{Rate: 0.25} matched %d/10000 operations, want ~2500", failed)
+	}
+
+	// The same seed picks the same operations.
+	pick := func(seed int64) []bool {
+		roll := newLockedRand(seed).Float64
+		picked := make([]bool, 100)
+		for i := range picked {
+			picked[i] = (Fault{Rate: 0.5}).matches(OpRead, p(""), 0, roll)
+		}
+		return picked
+	}
+	if diff := cmp.Diff(pick(1), pick(1)); diff != "" {
+		t.Errorf("Fault{Rate: 0.5} picked different operations with the same seed (-first +second):\n%s", diff)
+	}
+	if cmp.Equal(pick(1), pick(2)) {
+		t.Errorf("Fault{Rate: 0.5} picked the same operations with seeds 1 and 2")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 11
+
+	// Disable kernel caching, so every operation reaches the filesystem.
+	var noCache time.Duration
+	opts := &Options{Faults: []Fault{
+		{Ops: OpRead, Errno: syscall.EIO, IndexLo: 1, IndexHi: 2},
+		{Ops: OpLookup, Errno: syscall.EACCES, Path: "A/A/C.mp3"},
+	}}
+	opts.EntryTimeout = &noCache
+	opts.AttrTimeout = &noCache
+	opts.NegativeTimeout = &noCache
+
+	dir, srv, cleanup := mountServer(t, lib, opts)
+	defer cleanup()
+
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "A/A/A.mp3")); err != nil {
+		t.Errorf("Failed to read A/A/A.mp3: %v", err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "A/A/B.mp3")); !errors.Is(err, syscall.EIO) {
+		t.Errorf("ReadFile(A/A/B.mp3) = _, %v; want %v", err, syscall.EIO)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "A/A/C.mp3")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("Stat(A/A/C.mp3) = _, %v; want %v", err, syscall.EACCES)
+	}
+
+	// Getattr faults don't make lookups fail, so the song can be opened.
+	srv.SetFaults([]Fault{{Ops: OpGetattr, Errno: syscall.EPERM, Path: "A/A/D.mp3"}})
+	f, err := os.Open(filepath.Join(dir, "A/A/D.mp3"))
+	if err != nil {
+		t.Errorf("Failed to open A/A/D.mp3 with a getattr fault: %v", err)
+	} else {
+		if _, err := f.Stat(); !errors.Is(err, syscall.EPERM) {
+			t.Errorf("Stat(A/A/D.mp3) = _, %v; want %v", err, syscall.EPERM)
+		}
+		f.Close()
+	}
+
+	srv.SetFaults([]Fault{{Ops: OpReaddir, Errno: syscall.ESTALE, Path: "A/B"}})
+	if _, err := os.ReadDir(filepath.Join(dir, "A/B")); !errors.Is(err, syscall.ESTALE) {
+		t.Errorf("ReadDir(A/B) = _, %v; want %v", err, syscall.ESTALE)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "A/A"))
+	if err != nil {
+		t.Fatalf("Failed to list A/A: %v", err)
+	}
+	if len(entries) != 10 {
+		t.Errorf("A/A has %d entries, want 10", len(entries))
+	}
+	for _, p := range []string{"A/A/B.mp3", "A/A/C.mp3"} {
+		if _, err := ioutil.ReadFile(filepath.Join(dir, p)); err != nil {
+			t.Errorf("Failed to read %s after changing faults: %v", p, err)
+		}
+	}
+
+	srv.SetFaults(nil)
+	if _, err := os.ReadDir(filepath.Join(dir, "A/B")); err != nil {
+		t.Errorf("Failed to list A/B after clearing faults: %v", err)
+	}
+	if got := srv.Faults(); got != nil {
+		t.Errorf("srv.Faults() = %v after clearing faults, want nil", got)
+	}
+}
+
+func TestParseDelay(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want Delay
+	}{
+		{"0s", Delay{}},
+		{"5ms", Delay{Base: 5 * time.Millisecond}},
+		{"exp:20ms", Delay{Jitter: 20 * time.Millisecond, Distribution: Exponential}},
+		{"1s+normal:100ms", Delay{Base: time.Second, Jitter: 100 * time.Millisecond, Distribution: Normal}},
+		{"2ms+uniform:3ms", Delay{Base: 2 * time.Millisecond, Jitter: 3 * time.Millisecond}},
+	} {
+		got, err := ParseDelay(test.in)
+		if err != nil || got != test.want {
+			t.Errorf("ParseDelay(%q) = %+v, %v; want %+v, nil", test.in, got, err, test.want)
+		}
+		if again, err := ParseDelay(got.String()); err != nil || again != got {
+			t.Errorf("ParseDelay(%q) = %+v, %v; want %+v, nil", got.String(), again, err, got)
+		}
+	}
+
+	for _, in := range []string{"", "5", "-5ms", "gamma:5ms", "exp:5", "5ms+"} {
+		if _, err := ParseDelay(in); err == nil {
+			t.Errorf("ParseDelay(%q) = _, nil; want error", in)
+		}
+	}
+}
+
+func TestDelaySample(t *testing.T) {
+	base, jitter := 10*time.Millisecond, 20*time.Millisecond
+	for _, dist := range []Distribution{Uniform, Exponential, Normal} {
+		d := Delay{Base: base, Jitter: jitter, Distribution: dist}
+		var total time.Duration
+		for i := 0; i < 10000; i++ {
+			got := d.sample()
+			if got < base {
+				t.Fatalf("%v.sample() = %v, want >= %v", d, got, base)
+			}
+			if dist == Uniform && got > base+jitter {
+				t.Fatalf("%v.sample() = %v, want <= %v", d, got, base+jitter)
+			}
+			total += got
+		}
+		// Each distribution has a mean jitter between 0.5 (uniform) and 1
+		// (exponential) times Jitter.
+		mean := total / 10000
+		if mean < base+jitter*4/10 || mean > base+jitter*11/10 {
+			t.Errorf("%v.sample() has mean %v, want between %v and %v", d, mean, base+jitter/2, base+jitter)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	var th throttle
+	now := time.Unix(1000, 0)
+	if got := th.reserve(now, 1000, 1000); got != time.Second {
+		t.Errorf("reserve(1000 bytes at 1000 B/s) = %v, want 1s", got)
+	}
+	// The link is still busy with the first transfer.
+	if got := th.reserve(now, 500, 1000); got != 1500*time.Millisecond {
+		t.Errorf("reserve(500 bytes at 1000 B/s) while busy = %v, want 1.5s", got)
+	}
+	// Once idle, transfers start immediately.
+	if got := th.reserve(now.Add(time.Hour), 500, 1000); got != 500*time.Millisecond {
+		t.Errorf("reserve(500 bytes at 1000 B/s) when idle = %v, want 500ms", got)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 2
+
+	var noCache time.Duration
+	opts := &Options{Latency: &Latency{
+		Lookup:    Delay{Base: 50 * time.Millisecond},
+		FirstByte: Delay{Base: 200 * time.Millisecond},
+	}}
+	opts.EntryTimeout = &noCache
+	opts.AttrTimeout = &noCache
+
+	dir, srv, cleanup := mountServer(t, lib, opts)
+	defer cleanup()
+
+	timed := func(f func() error) time.Duration {
+		t.Helper()
+		start := time.Now()
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	song := filepath.Join(dir, "A/A/A.mp3")
+	readSong := func() error { _, err := ioutil.ReadFile(song); return err }
+
+	// Looks up A, A/A and A/A/A.mp3.
+	if got := timed(func() error { _, err := os.Stat(song); return err }); got < 150*time.Millisecond {
+		t.Errorf("Stat(A/A/A.mp3) took %v, want >= 150ms", got)
+	}
+	if got := timed(readSong); got < 350*time.Millisecond {
+		t.Errorf("First read of A/A/A.mp3 took %v, want >= 350ms", got)
+	}
+	if got := timed(readSong); got >= 350*time.Millisecond {
+		t.Errorf("Second read of A/A/A.mp3 took %v, want < 350ms", got)
+	}
+
+	srv.SetLatency(nil)
+	if got := timed(readSong); got >= 150*time.Millisecond {
+		t.Errorf("Read of A/A/A.mp3 without latency took %v, want < 150ms", got)
+	}
+}
+
+// Lookups are only delayed by the lookup latency, not by the getattr done
+// to fill in the looked up file's attributes.
+func TestGetattrLatency(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 2
+
+	var noCache time.Duration
+	opts := &Options{Latency: &Latency{Getattr: Delay{Base: 100 * time.Millisecond}}}
+	opts.EntryTimeout = &noCache
+	opts.AttrTimeout = &noCache
+
+	dir, _, cleanup := mountServer(t, lib, opts)
+	defer cleanup()
+
+	// Looks up A, A/A and A/A/A.mp3, without a getattr of their own.
+	start := time.Now()
+	f, err := os.Open(filepath.Join(dir, "A/A/A.mp3"))
+	if err != nil {
+		t.Fatalf("Failed to open A/A/A.mp3: %v", err)
+	}
+	defer f.Close()
+	if got := time.Since(start); got >= 100*time.Millisecond {
+		t.Errorf("Open(A/A/A.mp3) took %v, want < 100ms", got)
+	}
+
+	start = time.Now()
+	if _, err := f.Stat(); err != nil {
+		t.Fatalf("Failed to stat A/A/A.mp3: %v", err)
+	}
+	if got := time.Since(start); got < 100*time.Millisecond {
+		t.Errorf("Stat(A/A/A.mp3) took %v, want >= 100ms", got)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 11
+
+	var noCache time.Duration
+	var log bytes.Buffer
+	opts := &Options{
+		AccessLog: &log,
+		Faults:    []Fault{{Ops: OpRead, Errno: syscall.EIO, IndexLo: 1, IndexHi: 2}},
+	}
+	opts.EntryTimeout = &noCache
+	opts.AttrTimeout = &noCache
+	opts.NegativeTimeout = &noCache
+
+	dir, cleanup := mountWithOptions(t, lib, opts)
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "A/A/A.mp3")); err != nil {
+		t.Errorf("Failed to read A/A/A.mp3: %v", err)
+	}
+	ioutil.ReadFile(filepath.Join(dir, "A/A/B.mp3"))
+	os.Stat(filepath.Join(dir, "A/A/Z.mp3"))
+	if _, err := os.ReadDir(filepath.Join(dir, "A/A")); err != nil {
+		t.Errorf("Failed to list A/A: %v", err)
+	}
+	// Unmount first, so the log is no longer written.
+	cleanup()
+
+	song, err := lib.SongAt(0)
+	if err != nil {
+		t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+	}
+	var tagBytes, audioBytes int
+	seen := make(map[string]bool)
+	dec := json.NewDecoder(&log)
+	for dec.More() {
+		var e AccessEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Failed to decode access log: %v", err)
+		}
+		if e.Time.IsZero() || e.Latency < 0 {
+			t.Errorf("Access log entry %+v has no time or latency", e)
+		}
+		key := e.Op + " " + e.Path
+		if e.Errno != "" {
+			key += " " + e.Errno
+		}
+		seen[key] = true
+		if key == "lookup A/A/A.mp3" && (e.Index == nil || *e.Index != 0) {
+			t.Errorf("Lookup of A/A/A.mp3 has index %v, want 0", e.Index)
+		}
+		if key == "read A/A/A.mp3" {
+			if e.Length == 0 {
+				t.Errorf("Read of A/A/A.mp3 at offset %d has no length", e.Offset)
+			}
+			tagBytes += e.TagBytes
+			audioBytes += e.AudioBytes
+		}
+	}
+
+	for _, want := range []string{
+		"lookup A/A/A.mp3",
+		"getattr A/A/A.mp3",
+		"read A/A/A.mp3",
+		"read A/A/B.mp3 EIO",
+		"lookup A/A/Z.mp3 ENOENT",
+		"readdir A/A",
+	} {
+		if !seen[want] {
+			t.Errorf("Access log is missing %q", want)
+		}
+	}
+	if int64(tagBytes) != song.TagSize() || int64(tagBytes+audioBytes) != song.Size() {
+		t.Errorf("Reads of A/A/A.mp3 returned %d tag bytes and %d audio bytes, want %d and %d", tagBytes, audioBytes, song.TagSize(), song.Size()-song.TagSize())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	lib := loadLibrary(t)
+	lib.Tracks = 11
+
+	var noCache time.Duration
+	reg := metrics.NewRegistry()
+	opts := &Options{
+		Metrics: reg,
+		Faults:  []Fault{{Ops: OpRead, Errno: syscall.EIO, IndexLo: 1, IndexHi: 2}},
+	}
+	opts.EntryTimeout = &noCache
+	opts.AttrTimeout = &noCache
+	opts.NegativeTimeout = &noCache
+
+	dir, cleanup := mountWithOptions(t, lib, opts)
+	defer cleanup()
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "A/A/A.mp3")); err != nil {
+		t.Errorf("Failed to read A/A/A.mp3: %v", err)
+	}
+	ioutil.ReadFile(filepath.Join(dir, "A/A/B.mp3"))
+	os.Stat(filepath.Join(dir, "A/A/Z.mp3"))
+
+	song, err := lib.SongAt(0)
+	if err != nil {
+		t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+	}
+	var b strings.Builder
+	reg.WriteTo(&b)
+	got := b.String()
+	for _, want := range []string{
+		`fakelib_fuse_errors_total{op="lookup",errno="ENOENT"} 1`,
+		fmt.Sprintf(`fakelib_fuse_read_bytes_total{source="tag"} %d`, song.TagSize()),
+		fmt.Sprintf(`fakelib_fuse_read_bytes_total{source="audio"} %d`, song.Size()-song.TagSize()),
+		"fakelib_fuse_songs 11",
+		"fakelib_fuse_faults 1",
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("Metrics do not contain %s:\n%s", want, got)
+		}
+	}
+	// The kernel may retry failed reads, so only check that operations were
+	// counted.
+	for _, want := range []string{
+		`fakelib_fuse_operations_total{op="lookup"} `,
+		`fakelib_fuse_operations_total{op="getattr"} `,
+		`fakelib_fuse_operations_total{op="read"} `,
+		`fakelib_fuse_injected_errors_total{op="read",errno="EIO"} `,
+		`fakelib_fuse_operation_duration_seconds_count{op="read"} `,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Metrics have no %s series:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `fakelib_fuse_injected_errors_total{op="lookup"`) {
+		t.Errorf("Lookups of missing files were counted as injected errors:\n%s", got)
+	}
+}
@@ -0,0 +1,142 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Inode numbers are a deterministic function of the library, rather than
+// handed out by go-fuse, so they are the same every time a library is
+// mounted. MPD's database, and other caches keyed by inode number, stay valid
+// across restarts:
+//
+//   - The root is 1.
+//   - The song at index i is 2*i + 2, so a song keeps its number when other
+//     songs are added, removed or moved.
+//   - A directory takes the first free odd number from a hash of its path,
+//     so it keeps its number when songs are added, removed, moved or
+//     retagged, as long as its path doesn't change. Only directories whose
+//     hashes collide depend on the order they are created in.
+//   - Noise files and symlinks take the free odd numbers after their
+//     directory's. They are added after every song is placed, so their
+//     numbers can change when songs are added to the library.
+//
+// Inode numbers are kept within 32 bits by default, since MPD (musicpd.org)
+// stores them as C `unsigned` integers, and truncated numbers make
+// directories appear to contain themselves. This limits a library to about
+// 2^31 songs, and the same number of other files.
+
+// ErrTooManyInodes is returned (wrapped) when a library needs more inode
+// numbers than fit in 32 bits, and Options.LargeInodes is not set.
+var ErrTooManyInodes = errors.New("too many files for 32-bit inode numbers")
+
+// songInode returns the inode number of the song at index `idx`.
+func songInode(idx int) uint64 {
+	return 2*uint64(idx) + 2
+}
+
+// inodes allocates the inode numbers of nodes other than songs. It is
+// guarded by root.mu once the library is mounted.
+type inodes struct {
+	// large allows inode numbers over 32 bits.
+	large bool
+	// used is a sparse bitset of the odd inode numbers in use, from 3 up. It
+	// maps each 64 bit word of the set to its (non-zero) bits.
+	used map[uint64]uint64
+	// gen is the generation of new nodes. It is increased whenever a node is
+	// removed, so a node created later with the same inode number is not
+	// mistaken for the removed node by go-fuse or the kernel.
+	gen uint64
+}
+
+// limit returns the largest inode number that can be used.
+func (n *inodes) limit() uint64 {
+	if n.large {
+		return math.MaxUint64
+	}
+	return math.MaxUint32
+}
+
+// checkTracks returns an error if the songs of a library with `tracks`
+// songs don't fit in the inode number limit.
+func (n *inodes) checkTracks(tracks int) error {
+	if tracks > 0 && songInode(tracks-1) > n.limit() {
+		return fmt.Errorf("%w: the library has %d songs, at most %d fit; set LargeInodes to use 64-bit inode numbers", ErrTooManyInodes, tracks, (n.limit()-2)/2+1)
+	}
+	return nil
+}
+
+// song returns the stable attributes of the song at `idx`.
+func (n *inodes) song(idx int) (fs.StableAttr, error) {
+	if err := n.checkTracks(idx + 1); err != nil {
+		return fs.StableAttr{}, err
+	}
+	return fs.StableAttr{Ino: songInode(idx), Gen: n.gen}, nil
+}
+
+// dir returns the stable attributes of a new directory at `path`.
+func (n *inodes) dir(path string) (fs.StableAttr, error) {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return n.alloc(3+2*(h.Sum64()%n.slots()), fuse.S_IFDIR)
+}
+
+// near returns the stable attributes of a new node of type `mode` (e.g.
+// fuse.S_IFLNK) in the directory with inode number `dir`.
+func (n *inodes) near(dir uint64, mode uint32) (fs.StableAttr, error) {
+	return n.alloc(dir+2, mode)
+}
+
+// slots returns the number of odd inode numbers that can be used.
+func (n *inodes) slots() uint64 {
+	return (n.limit()-3)/2 + 1
+}
+
+// alloc returns the stable attributes of a new node with the first free odd
+// inode number from `want` up, wrapping around to 3 after the limit.
+func (n *inodes) alloc(want uint64, mode uint32) (fs.StableAttr, error) {
+	slots := n.slots()
+	start := (want - 3) / 2 % slots
+	for i := uint64(0); i < slots; i++ {
+		slot := (start + i) % slots
+		word, bit := slot/64, slot%64
+		if n.used[word] == math.MaxUint64 {
+			// Skip the rest of a full word.
+			i += 63 - bit
+			continue
+		}
+		if n.used[word]&(1<<bit) == 0 {
+			if n.used == nil {
+				n.used = make(map[uint64]uint64)
+			}
+			n.used[word] |= 1 << bit
+			return fs.StableAttr{Mode: mode, Ino: 3 + 2*slot, Gen: n.gen}, nil
+		}
+	}
+	return fs.StableAttr{}, fmt.Errorf("%w: no free inode numbers; set LargeInodes to use 64-bit inode numbers", ErrTooManyInodes)
+}
+
+// free records that the node with inode number `ino`, which is not a song,
+// was removed from the tree.
+func (n *inodes) free(ino uint64) {
+	if ino >= 3 && ino%2 == 1 {
+		slot := (ino - 3) / 2
+		word := slot / 64
+		if bits := n.used[word] &^ (1 << (slot % 64)); bits != 0 {
+			n.used[word] = bits
+		} else {
+			delete(n.used, word)
+		}
+	}
+	n.removed()
+}
+
+// removed records that a node was removed from the tree.
+func (n *inodes) removed() {
+	n.gen++
+}
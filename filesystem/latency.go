@@ -0,0 +1,231 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Distribution is the shape of the random part of a Delay.
+type Distribution int
+
+const (
+	// Uniform jitter is spread evenly between 0 and the Delay's Jitter.
+	Uniform Distribution = iota
+	// Exponential jitter has a mean of the Delay's Jitter, but a long tail,
+	// like the response times of a busy network server.
+	Exponential
+	// Normal jitter is the absolute value of a normal distribution with a
+	// standard deviation of the Delay's Jitter.
+	Normal
+)
+
+var distributionNames = []string{"uniform", "exp", "normal"}
+
+func (d Distribution) String() string {
+	if int(d) < len(distributionNames) {
+		return distributionNames[d]
+	}
+	return fmt.Sprintf("Distribution(%d)", int(d))
+}
+
+// Delay is a random delay: a fixed Base, plus a Jitter drawn from
+// Distribution.
+type Delay struct {
+	Base         time.Duration
+	Jitter       time.Duration
+	Distribution Distribution
+}
+
+// String formats the delay in the format accepted by ParseDelay.
+func (d Delay) String() string {
+	var parts []string
+	if d.Base > 0 || d.Jitter <= 0 {
+		parts = append(parts, d.Base.String())
+	}
+	if d.Jitter > 0 {
+		parts = append(parts, d.Distribution.String()+":"+d.Jitter.String())
+	}
+	return strings.Join(parts, "+")
+}
+
+// ParseDelay parses a delay of the form "BASE", "DIST:JITTER" or
+// "BASE+DIST:JITTER", where BASE and JITTER are durations (see
+// time.ParseDuration), and DIST is one of uniform, exp or normal. For example,
+// "5ms+exp:20ms" is a delay of at least 5ms, plus an exponentially
+// distributed delay with a mean of 20ms.
+func ParseDelay(s string) (Delay, error) {
+	var d Delay
+	for _, part := range strings.Split(s, "+") {
+		dist, jitter, ok := strings.Cut(part, ":")
+		if !ok {
+			base, err := time.ParseDuration(part)
+			if err != nil || base < 0 {
+				return Delay{}, fmt.Errorf("invalid delay %q: bad duration %q", s, part)
+			}
+			d.Base += base
+			continue
+		}
+		found := false
+		for i, name := range distributionNames {
+			if name == dist {
+				d.Distribution = Distribution(i)
+				found = true
+			}
+		}
+		if !found {
+			return Delay{}, fmt.Errorf("invalid delay %q: unknown distribution %q, want one of %s", s, dist, strings.Join(distributionNames, ", "))
+		}
+		var err error
+		if d.Jitter, err = time.ParseDuration(jitter); err != nil || d.Jitter < 0 {
+			return Delay{}, fmt.Errorf("invalid delay %q: bad duration %q", s, jitter)
+		}
+	}
+	return d, nil
+}
+
+// sample returns a random delay from the distribution.
+func (d Delay) sample() time.Duration {
+	if d.Jitter <= 0 {
+		return d.Base
+	}
+	var scale float64
+	switch d.Distribution {
+	case Exponential:
+		scale = rand.ExpFloat64()
+	case Normal:
+		scale = math.Abs(rand.NormFloat64())
+	default:
+		scale = rand.Float64()
+	}
+	return d.Base + time.Duration(scale*float64(d.Jitter))
+}
+
+// Latency makes the mounted library slow, like a library on a NAS or a
+// spinning disk. Delays are added to each operation before it is handled.
+type Latency struct {
+	// Lookup, Getattr, Readdir and Read are the delays added to each
+	// operation of that kind (see Op).
+	Lookup, Getattr, Readdir, Read Delay
+
+	// FirstByte is added to the first read of a song that is "cold", i.e.
+	// has not been read in the last ColdAfter, or ever if ColdAfter is
+	// unset. This simulates disks spinning up, or cache misses on the
+	// server.
+	FirstByte Delay
+	ColdAfter time.Duration
+
+	// Bandwidth, if set, limits the total rate of song reads to this many
+	// bytes per second. The limit is shared by all reads, like a network
+	// link.
+	Bandwidth int64
+}
+
+// delay returns the delay added to `op`.
+func (l *Latency) delay(op Op) Delay {
+	switch op {
+	case OpLookup:
+		return l.Lookup
+	case OpGetattr:
+		return l.Getattr
+	case OpReaddir:
+		return l.Readdir
+	case OpRead:
+		return l.Read
+	}
+	return Delay{}
+}
+
+// sleep waits for `d`, or until `ctx` is cancelled, in which case EINTR is
+// returned.
+func sleep(ctx context.Context, d time.Duration) syscall.Errno {
+	if d <= 0 {
+		return 0
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return 0
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+// wait delays operation `op` according to the configured Latency.
+// Operations that are part of another operation (see internal) aren't
+// delayed.
+func (r *root) wait(ctx context.Context, op Op) syscall.Errno {
+	l := r.latency.Load()
+	if l == nil || isInternal(ctx) {
+		return 0
+	}
+	return sleep(ctx, l.delay(op).sample())
+}
+
+// waitRead delays a read of `n` bytes from a song that was last read at
+// `*lastRead` (in Unix nanoseconds, or 0 if never), according to the
+// configured Latency. The delay of the read operation itself is included.
+func (r *root) waitRead(ctx context.Context, lastRead *int64, n int) syscall.Errno {
+	l := r.latency.Load()
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	d := l.Read.sample()
+	last := atomic.SwapInt64(lastRead, now.UnixNano())
+	if last == 0 || (l.ColdAfter > 0 && now.Sub(time.Unix(0, last)) > l.ColdAfter) {
+		d += l.FirstByte.sample()
+	}
+	if l.Bandwidth > 0 {
+		d += r.throttle.reserve(now.Add(d), n, l.Bandwidth)
+	}
+	return sleep(ctx, d)
+}
+
+// throttle is a bandwidth limit shared by several readers.
+type throttle struct {
+	mu sync.Mutex
+	// next is the time at which the link is free again.
+	next time.Time
+}
+
+// reserve reserves time to transfer `n` bytes at `bandwidth` bytes per
+// second, starting at `now` or when the previously reserved transfers are
+// done. It returns how long after `now` the transfer is done.
+func (t *throttle) reserve(now time.Time, n int, bandwidth int64) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(float64(n) / float64(bandwidth) * float64(time.Second)))
+	return t.next.Sub(now)
+}
+
+// SetLatency replaces the latency of the mounted library. A nil `l` removes
+// all delays.
+func (s *Server) SetLatency(l *Latency) {
+	if l != nil {
+		copied := *l
+		l = &copied
+	}
+	s.root.latency.Store(l)
+}
+
+// Latency returns the current latency of the mounted library, or nil if
+// there is none.
+func (s *Server) Latency() *Latency {
+	l := s.root.latency.Load()
+	if l == nil {
+		return nil
+	}
+	copied := *l
+	return &copied
+}
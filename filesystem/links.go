@@ -0,0 +1,153 @@
+package filesystem
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Links configures symbolic links and hard links that are added to
+// directories containing songs. Each rate is the probability (0 to 1) that a
+// single link of that kind is added to any given directory. Like Noise, which
+// links are added, and where they point, is determined by the directory path
+// and Seed.
+//
+// These structures are useful to test link handling in consumers, like MPD's
+// `follow_inside_symlinks` and `follow_outside_symlinks` options, and its
+// recursive directory detection.
+type Links struct {
+	// Songs is the rate of symlinks to a song elsewhere in the library. They
+	// are named "symlink - <song>".
+	Songs float64
+	// Dirs is the rate of symlinks to another directory in the library. They
+	// are named "symlink - <directory>".
+	Dirs float64
+	// Outside is the rate of symlinks to OutsideTarget, a directory outside
+	// of the library. They are named "outside".
+	Outside float64
+	// Dangling is the rate of symlinks to a path that does not exist. They
+	// are named "dangling.mp3".
+	Dangling float64
+	// Loops is the rate of symlinks to the directory's parent, which forms a
+	// directory loop. They are named "loop".
+	Loops float64
+	// HardLinks is the rate of additional names for a song elsewhere in the
+	// library. The additional name refers to the same inode as the original
+	// song. They are named "hardlink - <song>".
+	HardLinks float64
+
+	// OutsideTarget is the target of Outside links. Defaults to "/tmp" if
+	// unset.
+	OutsideTarget string
+	// Seed is mixed into the selection of links for each directory.
+	Seed int64
+}
+
+// relativeTo returns a relative symlink target that resolves to `target`
+// (relative to the library root) from a link in directory `dir`.
+func relativeTo(dir, target string) string {
+	up := ""
+	if dir != "" {
+		up = strings.Repeat("../", strings.Count(dir, "/")+1)
+	}
+	if target == "" || target == "." {
+		if up == "" {
+			return "."
+		}
+		return strings.TrimSuffix(up, "/")
+	}
+	return up + target
+}
+
+// lookup returns the inode at path `p` relative to the root, or nil if no
+// such inode exists.
+func (r *root) lookup(p string) *fs.Inode {
+	wd := &r.Inode
+	for _, component := range strings.Split(p, "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		wd = wd.GetChild(component)
+		if wd == nil {
+			return nil
+		}
+	}
+	return wd
+}
+
+func (r *root) addSymlink(ctx context.Context, wd *fs.Inode, name, target string) error {
+	if wd.GetChild(name) != nil {
+		return nil
+	}
+	link := &fs.MemSymlink{Data: []byte(target)}
+	setTimes(&link.Attr, wd.Operations().(toucher).modTime())
+	attr, err := r.inodes.near(wd.StableAttr().Ino, fuse.S_IFLNK)
+	if err != nil {
+		return err
+	}
+	node := wd.NewPersistentInode(ctx, link, attr)
+	wd.AddChild(name, node, true)
+	return nil
+}
+
+// addLinks adds the links configured in r.opts.Links to the directory `dir`
+// (whose inode is `wd`). An error is returned if the links can't be given
+// inode numbers.
+func (r *root) addLinks(ctx context.Context, dir string, wd *fs.Inode) error {
+	l := r.opts.Links
+	if r.paths.Len() == 0 {
+		return nil
+	}
+	// addSymlink adds a symlink, unless adding an earlier one failed.
+	var err error
+	addSymlink := func(name, target string) {
+		if err == nil {
+			err = r.addSymlink(ctx, wd, name, target)
+		}
+	}
+	// pickSong deterministically picks a song for the link of the given
+	// kind. It returns "" if the picked song has been removed.
+	pickSong := func(kind string) string {
+		idx := int(roll(l.Seed, dir, kind, "target") * float64(r.paths.Len()))
+		p, _ := r.paths.PathAt(idx)
+		return p
+	}
+
+	if roll(l.Seed, dir, "song") < l.Songs {
+		if target := pickSong("song"); target != "" {
+			addSymlink("symlink - "+path.Base(target), relativeTo(dir, target))
+		}
+	}
+	if roll(l.Seed, dir, "dir") < l.Dirs && pickSong("dir") != "" {
+		target := path.Dir(pickSong("dir"))
+		name := "symlink - " + path.Base(target)
+		if target == "." {
+			name = "symlink - library"
+		}
+		addSymlink(name, relativeTo(dir, target))
+	}
+	if roll(l.Seed, dir, "outside") < l.Outside {
+		target := l.OutsideTarget
+		if target == "" {
+			target = "/tmp"
+		}
+		addSymlink("outside", target)
+	}
+	if roll(l.Seed, dir, "dangling") < l.Dangling {
+		addSymlink("dangling.mp3", "does not exist.mp3")
+	}
+	if roll(l.Seed, dir, "loop") < l.Loops {
+		addSymlink("loop", relativeTo(dir, path.Dir(dir)))
+	}
+	if roll(l.Seed, dir, "hardlink") < l.HardLinks && pickSong("hardlink") != "" {
+		target := pickSong("hardlink")
+		name := "hardlink - " + path.Base(target)
+		if node := r.lookup(target); node != nil && wd.GetChild(name) == nil {
+			wd.AddChild(name, node, true)
+		}
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package filesystem
+
+import (
+	"github.com/joshkunz/fakelib/metrics"
+)
+
+// fsMetrics are the metrics of a mounted library, see Options.Metrics.
+type fsMetrics struct {
+	ops       *metrics.Counter
+	errors    *metrics.Counter
+	injected  *metrics.Counter
+	readBytes *metrics.Counter
+	latency   *metrics.Histogram
+}
+
+// newMetrics adds the metrics of `r` to `reg`.
+func newMetrics(reg *metrics.Registry, r *root) *fsMetrics {
+	m := &fsMetrics{
+		ops:       reg.Counter("fakelib_fuse_operations_total", "Filesystem operations, by operation.", "op"),
+		errors:    reg.Counter("fakelib_fuse_errors_total", "Filesystem operations that failed, by operation and error, including injected errors.", "op", "errno"),
+		injected:  reg.Counter("fakelib_fuse_injected_errors_total", "Filesystem operations that failed because of an injected fault, by operation and error.", "op", "errno"),
+		readBytes: reg.Counter("fakelib_fuse_read_bytes_total", "Bytes returned by reads, by source: the generated id3v2 tags (tag), or the golden MP3's audio data (audio).", "source"),
+		latency:   reg.Histogram("fakelib_fuse_operation_duration_seconds", "Latency of filesystem operations, including injected latency, by operation.", metrics.DurationBuckets, "op"),
+	}
+	// Report every source, even before anything is read.
+	m.readBytes.Add(0, "tag")
+	m.readBytes.Add(0, "audio")
+
+	stat := func(f func(Stats) int) func() float64 {
+		return func() float64 { return float64(f(r.stats())) }
+	}
+	reg.GaugeFunc("fakelib_fuse_tracks", "Tracks in the mounted library, including removed songs.",
+		stat(func(s Stats) int { return s.Tracks }))
+	reg.GaugeFunc("fakelib_fuse_songs", "Songs in the mounted library.",
+		stat(func(s Stats) int { return s.Songs }))
+	reg.GaugeFunc("fakelib_fuse_dirs", "Directories in the mounted library.",
+		stat(func(s Stats) int { return s.Dirs }))
+	reg.GaugeFunc("fakelib_fuse_faults", "Faults currently injected.",
+		func() float64 {
+			if faults := r.faults.Load(); faults != nil {
+				return float64(len(*faults))
+			}
+			return 0
+		})
+	return m
+}
+
+// record adds a finished operation to the metrics. `injected` is true if
+// it failed because of a Fault.
+func (m *fsMetrics) record(e *AccessEntry, injected bool) {
+	m.ops.Inc(e.Op)
+	m.latency.ObserveDuration(e.Latency, e.Op)
+	if e.Errno != "" {
+		m.errors.Inc(e.Op, e.Errno)
+		if injected {
+			m.injected.Inc(e.Op, e.Errno)
+		}
+	}
+	if e.TagBytes > 0 {
+		m.readBytes.Add(float64(e.TagBytes), "tag")
+	}
+	if e.AudioBytes > 0 {
+		m.readBytes.Add(float64(e.AudioBytes), "audio")
+	}
+}
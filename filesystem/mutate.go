@@ -0,0 +1,359 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bogem/id3v2/v2"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/joshkunz/fakelib/library"
+)
+
+// Server is a mounted library. In addition to the go-fuse server methods
+// (e.g. Unmount), it provides methods to change the library while it is
+// mounted. Changes are applied to the mounted filesystem immediately: the
+// kernel is notified so cached entries and file contents are invalidated,
+// and the modification times of changed songs and their directories are
+// updated to the time of the change.
+//
+// The library passed to Mount must not be modified directly while mounted,
+// only through these methods. All methods are safe for concurrent use.
+type Server struct {
+	*fuse.Server
+
+	root *root
+}
+
+// Tracks returns the number of tracks in the mounted library, including
+// removed songs.
+func (s *Server) Tracks() int {
+	s.root.mu.Lock()
+	defer s.root.mu.Unlock()
+	return s.root.l.Tracks
+}
+
+// PathAt returns the path of the idx-th song in the mounted library. If the
+// song was removed, the returned error wraps library.ErrRemoved.
+func (s *Server) PathAt(idx int) (string, error) {
+	s.root.mu.Lock()
+	defer s.root.mu.Unlock()
+	return s.root.paths.PathAt(idx)
+}
+
+// Index returns the index of the song at path `p` in the mounted library,
+// and whether a song exists at that path.
+func (s *Server) Index(p string) (int, bool) {
+	s.root.mu.Lock()
+	defer s.root.mu.Unlock()
+	return s.root.paths.Index(p)
+}
+
+// Stats are counts of the files in a mounted library.
+type Stats struct {
+	// Tracks is the number of tracks, including removed songs.
+	Tracks int
+	// Songs is the number of songs, excluding removed songs.
+	Songs int
+	// Dirs is the number of directories, excluding the root.
+	Dirs int
+	// TagCache is the Stats of the library's TagCache, or nil if it has
+	// none.
+	TagCache *library.CacheStats
+}
+
+// Stats returns counts of the files in the mounted library.
+func (s *Server) Stats() Stats {
+	return s.root.stats()
+}
+
+func (r *root) stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := Stats{Tracks: r.l.Tracks, Songs: r.paths.Songs(), Dirs: r.paths.Dirs()}
+	if r.l.TagCache != nil {
+		cache := r.l.TagCache.Stats()
+		stats.TagCache = &cache
+	}
+	return stats
+}
+
+// Resize grows or shrinks the mounted library to `tracks` songs. Songs added
+// by growing the library are generated by the library's Tagger and Pather as
+// usual.
+func (s *Server) Resize(tracks int) error {
+	r := s.root
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if tracks < 0 {
+		return fmt.Errorf("invalid number of tracks %d", tracks)
+	}
+
+	now := time.Now()
+	old := r.l.Tracks
+	if tracks < old {
+		for idx := tracks; idx < old; idx++ {
+			r.removeSong(idx, now)
+		}
+		r.paths.Truncate(tracks)
+		return r.l.Resize(tracks)
+	}
+
+	if err := r.l.Resize(tracks); err != nil {
+		return err
+	}
+	for idx := old; idx < tracks; idx++ {
+		if err := r.updateSong(idx, now); err != nil {
+			// Keep the library consistent with the mounted tree, by
+			// removing the songs added so far.
+			for added := old; added <= idx; added++ {
+				r.removeSong(added, now)
+			}
+			r.paths.Truncate(old)
+			r.l.Resize(old)
+			return err
+		}
+	}
+	return nil
+}
+
+// Retag calls `f` to edit the tag of every song with an index in [lo, hi).
+// The tag passed to `f` is a copy of the song's current tag. Songs are moved
+// if their path changes as a result of the new tag.
+func (s *Server) Retag(lo, hi int, f func(idx int, tag *id3v2.Tag)) error {
+	r := s.root
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for idx := lo; idx < hi; idx++ {
+		// Songs without an edited tag have a nil `prev`, and restoring it
+		// restores the generated tag.
+		prev, err := r.l.EditedTag(idx)
+		if err != nil {
+			return err
+		}
+		if err := r.l.EditTag(idx, func(tag *id3v2.Tag) { f(idx, tag) }); err != nil {
+			return err
+		}
+		if err := r.updateSong(idx, now); err != nil {
+			// Keep the library consistent with the mounted tree.
+			r.l.SetTag(idx, prev)
+			return err
+		}
+	}
+	return nil
+}
+
+// Move moves the idx-th song to path `p`, overriding the path generated by
+// the library's Pather. If `p` collides with another song it is resolved
+// according to the library's Collisions strategy.
+func (s *Server) Move(idx int, p string) error {
+	r := s.root
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	prev, err := r.l.PathAt(idx)
+	if err != nil {
+		return err
+	}
+	if err := r.l.SetPath(idx, p); err != nil {
+		return err
+	}
+	if err := r.updateSong(idx, now); err != nil {
+		// Keep the library consistent with the mounted tree.
+		r.l.SetPath(idx, prev)
+		return err
+	}
+	return nil
+}
+
+// Remove removes every song with an index in [lo, hi) from the mounted
+// library. The indices of other songs are unchanged.
+func (s *Server) Remove(lo, hi int) error {
+	r := s.root
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for idx := lo; idx < hi; idx++ {
+		if err := r.l.Remove(idx); err != nil {
+			return err
+		}
+		r.removeSong(idx, now)
+	}
+	return nil
+}
+
+// notifyEntry tells the kernel to drop any cached lookup of `name` in
+// `parent`. Errors are ignored, they usually just mean the kernel had
+// nothing cached.
+func notifyEntry(parent *fs.Inode, name string) {
+	parent.NotifyEntry(name)
+	parent.NotifyContent(0, 0)
+}
+
+// lookupParent returns the inode of the directory containing `p`, and the
+// name of `p` in that directory.
+func (r *root) lookupParent(p string) (*fs.Inode, string) {
+	dir, name := path.Split(p)
+	return r.lookup(dir), name
+}
+
+// ancestorsOf returns the inodes of every directory from the root down to
+// `dir`.
+func (r *root) ancestorsOf(dir string) []*fs.Inode {
+	ancestors := []*fs.Inode{&r.Inode}
+	wd := &r.Inode
+	for dir != "" && dir != "." {
+		var component string
+		component, dir, _ = strings.Cut(dir, "/")
+		if wd = wd.GetChild(component); wd == nil {
+			break
+		}
+		ancestors = append(ancestors, wd)
+	}
+	return ancestors
+}
+
+// pruneEmpty removes `dir` and its parents if they no longer contain any
+// entries.
+func (r *root) pruneEmpty(dir string) {
+	for dir != "" && dir != "." && dir != "/" {
+		node := r.lookup(dir)
+		if node == nil || len(node.Children()) > 0 {
+			return
+		}
+		parent, name := r.lookupParent(dir)
+		if parent == nil {
+			return
+		}
+		parent.RmChild(name)
+		r.forget(node)
+		notifyEntry(parent, name)
+		dir = path.Dir(dir)
+	}
+}
+
+// forget releases `node`, which was removed from its parent, so the kernel
+// can forget it, unless it still has another name in the tree (a hard link,
+// see Links.HardLinks). Its inode number is freed either way: a node created
+// later with the same number gets a new generation, so it is not mistaken
+// for `node`. `r.mu` must be held.
+func (r *root) forget(node *fs.Inode) {
+	if _, parent := node.Parent(); parent == nil {
+		node.ForgetPersistent()
+	}
+	r.inodes.free(node.StableAttr().Ino)
+}
+
+// removeSong removes the idx-th song from the tree and the path map, if it
+// is present. `r.mu` must be held.
+func (r *root) removeSong(idx int, now time.Time) {
+	old, err := r.paths.PathAt(idx)
+	if err != nil {
+		return
+	}
+	r.paths.Delete(idx)
+
+	parent, name := r.lookupParent(old)
+	if parent == nil {
+		return
+	}
+	node := parent.GetChild(name)
+	parent.RmChild(name)
+	if node != nil {
+		r.forget(node)
+	}
+	dir := path.Dir(old)
+	touchAll(r.ancestorsOf(dir), now)
+	notifyEntry(parent, name)
+	r.pruneEmpty(dir)
+}
+
+// rmShadowed removes the entry `name` from `parent`, if there is one, so a
+// song can take its place. Noise files and links aren't in the PathMap, so a
+// song can get the same name as one. The song wins, like in mkdirAll. `r.mu`
+// must be held.
+func (r *root) rmShadowed(parent *fs.Inode, name string) {
+	node := parent.GetChild(name)
+	if node == nil {
+		return
+	}
+	parent.RmChild(name)
+	r.forget(node)
+	notifyEntry(parent, name)
+}
+
+// updateSong regenerates the idx-th song from the library, and moves it to
+// its (possibly new) path, adding it to the tree if it is new. `r.mu` must
+// be held.
+func (r *root) updateSong(idx int, now time.Time) error {
+	if r.l.Removed(idx) {
+		r.removeSong(idx, now)
+		return nil
+	}
+
+	if err := r.l.SetModTime(idx, now); err != nil {
+		return err
+	}
+	lSong, err := r.l.SongAt(idx)
+	if err != nil {
+		return err
+	}
+	p, err := r.l.PathAt(idx)
+	if err != nil {
+		return err
+	}
+
+	// Songs that are new, or were removed, have no old path.
+	old, _ := r.paths.PathAt(idx)
+	resolved, err := r.paths.Set(idx, p)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	newDir, newName := path.Split(resolved)
+	newParent, ancestors, err := r.mkdirAll(ctx, newDir)
+	if err != nil {
+		return err
+	}
+
+	var node *fs.Inode
+	if old != "" {
+		oldParent, oldName := r.lookupParent(old)
+		if oldParent != nil {
+			node = oldParent.GetChild(oldName)
+		}
+		if node != nil && old != resolved {
+			r.rmShadowed(newParent, newName)
+			oldParent.MvChild(oldName, newParent, newName, true)
+			touchAll(r.ancestorsOf(path.Dir(old)), now)
+			notifyEntry(oldParent, oldName)
+			r.pruneEmpty(path.Dir(old))
+		}
+	}
+
+	if node != nil {
+		node.Operations().(*song).set(lSong)
+		node.NotifyContent(0, 0)
+	} else {
+		attr, err := r.inodes.song(idx)
+		if err != nil {
+			return err
+		}
+		r.rmShadowed(newParent, newName)
+		node = newParent.NewPersistentInode(ctx, &song{idx: idx, song: lSong}, attr)
+		newParent.AddChild(newName, node, true)
+	}
+	touchAll(ancestors, lSong.ModTime())
+	notifyEntry(newParent, newName)
+	return nil
+}
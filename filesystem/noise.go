@@ -0,0 +1,138 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// NoiseFile is a non-music file that can be placed alongside songs.
+type NoiseFile struct {
+	// Name is the file name. A `*` in the name is replaced with the name of
+	// the directory the file is placed in, so "*.nfo" in the directory
+	// "Artist/Album" is named "Album.nfo".
+	Name string
+	// Contents is the data returned when the file is read.
+	Contents []byte
+}
+
+// DefaultNoiseFiles are the files used by Noise when no files are
+// configured. They approximate the clutter found in real music directories:
+// rip logs, cue sheets, release notes, and OS metadata files.
+var DefaultNoiseFiles = []NoiseFile{
+	{Name: "*.nfo", Contents: []byte("Release notes\n\nRipped for testing purposes.\n")},
+	{Name: "*.log", Contents: []byte("Exact Audio Copy V1.0 beta 3 from 29. August 2011\n\nEAC extraction logfile\n\nNo errors occurred\n")},
+	{Name: "*.cue", Contents: []byte("REM COMMENT \"fakelib\"\nFILE \"range.wav\" WAVE\n  TRACK 01 AUDIO\n    INDEX 01 00:00:00\n")},
+	{Name: "*.sfv", Contents: []byte("; Generated by fakelib\n")},
+	{Name: "notes.txt", Contents: []byte("TODO: re-rip track 3\n")},
+	{Name: "Thumbs.db", Contents: []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1\x00\x00\x00\x00")},
+	{Name: "desktop.ini", Contents: []byte("[.ShellClassInfo]\r\nIconResource=C:\\Windows\\system32\\imageres.dll,-108\r\n")},
+	{Name: ".DS_Store", Contents: []byte("\x00\x00\x00\x01Bud1\x00\x00\x10\x00")},
+	{Name: ".directory", Contents: []byte("[Desktop Entry]\nIcon=folder-sound\n")},
+	{Name: "cover.jpg.part", Contents: []byte("\xff\xd8\xff\xe0")},
+}
+
+// Noise configures non-music "noise" files that are placed in directories
+// containing songs. It is useful to test that consumers correctly skip files
+// they can't handle. Which files are placed in each directory is determined
+// by the directory path and Seed, so the same library always has the same
+// noise files.
+type Noise struct {
+	// Rate is the probability (0 to 1) that each file in Files is placed in
+	// any given directory.
+	Rate float64
+	// Files are the candidate noise files. Defaults to DefaultNoiseFiles
+	// if unset.
+	Files []NoiseFile
+	// Seed is mixed into the selection of noise files for each directory.
+	Seed int64
+}
+
+// roll returns a pseudo-random number in [0, 1) for the given seed and key
+// parts (e.g. a directory and file name). The same seed and parts always
+// give the same number, and the numbers for the directories of a library
+// are spread evenly, so they can be compared with a rate. Parts are
+// separated, so e.g. ("ab", "c") and ("a", "bc") are different keys.
+func roll(seed int64, parts ...string) float64 {
+	h := fnv.New64a()
+	var seedBytes [8]byte
+	binary.LittleEndian.PutUint64(seedBytes[:], uint64(seed))
+	h.Write(seedBytes[:])
+	for i, p := range parts {
+		if i > 0 {
+			h.Write([]byte{0})
+		}
+		h.Write([]byte(p))
+	}
+	// Use the top 53 bits, so the result is uniform over float64.
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+// filesFor returns the noise files that should be placed in the directory
+// `dir`, with their names expanded.
+func (n *Noise) filesFor(dir string) []NoiseFile {
+	files := n.Files
+	if files == nil {
+		files = DefaultNoiseFiles
+	}
+
+	var out []NoiseFile
+	for _, f := range files {
+		if roll(n.Seed, dir, f.Name) >= n.Rate {
+			continue
+		}
+		base := "library"
+		if dir != "" {
+			base = path.Base(dir)
+		}
+		out = append(out, NoiseFile{
+			Name:     strings.ReplaceAll(f.Name, "*", base),
+			Contents: f.Contents,
+		})
+	}
+	return out
+}
+
+type noiseFile struct {
+	fs.Inode
+
+	data  []byte
+	mtime time.Time
+}
+
+var _ fs.NodeOpener = (*noiseFile)(nil)
+var _ fs.NodeReader = (*noiseFile)(nil)
+var _ fs.NodeGetattrer = (*noiseFile)(nil)
+
+func (n *noiseFile) Open(context.Context, uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	return nil, 0, fs.OK
+}
+
+func (n *noiseFile) Read(ctx context.Context, _ fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	a := rootOf(&n.Inode).begin(ctx, OpRead, &n.Inode, "", -1)
+	defer a.done(fs.OK)
+	if off >= int64(len(n.data)) {
+		a.read(off, len(dest), 0, 0)
+		return fuse.ReadResultData(nil), fs.OK
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(n.data)) {
+		end = int64(len(n.data))
+	}
+	a.read(off, len(dest), int(end-off), 0)
+	return fuse.ReadResultData(n.data[off:end]), fs.OK
+}
+
+func (n *noiseFile) Getattr(ctx context.Context, _ fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	defer rootOf(&n.Inode).begin(ctx, OpGetattr, &n.Inode, "", -1).done(fs.OK)
+	out.Size = uint64(len(n.data))
+	setTimes(&out.Attr, n.mtime)
+	return fs.OK
+}
@@ -0,0 +1,115 @@
+package library
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// benchSizes are the library sizes used by benchmarks. Sizes over a million
+// tracks need several GiB of memory, and are skipped with -short.
+var benchSizes = []int{1_000, 100_000, 1_000_000, 10_000_000}
+
+// benchLibrary returns a library with `tracks` songs, generated on
+// `workers` goroutines.
+func benchLibrary(b *testing.B, tracks, workers int) *Library {
+	b.Helper()
+	if testing.Short() && tracks > 1_000_000 {
+		b.Skipf("skipping %d tracks in short mode", tracks)
+	}
+	lib, err := New(EmbeddedGoldMP3())
+	if err != nil {
+		b.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = tracks
+	lib.Workers = workers
+	return lib
+}
+
+// benchWorkers are the numbers of workers used to build libraries in
+// benchmarks: sequential, and one per CPU.
+func benchWorkers() []int {
+	if runtime.NumCPU() == 1 {
+		return []int{1}
+	}
+	return []int{1, runtime.NumCPU()}
+}
+
+// heapAlloc returns the bytes allocated on the heap, after a GC.
+func heapAlloc() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+func BenchmarkPaths(b *testing.B) {
+	for _, tracks := range benchSizes {
+		for _, workers := range benchWorkers() {
+			b.Run(fmt.Sprintf("tracks=%d/workers=%d", tracks, workers), func(b *testing.B) {
+				lib := benchLibrary(b, tracks, workers)
+				var m *PathMap
+				b.StopTimer()
+				for i := 0; i < b.N; i++ {
+					m = nil
+					before := heapAlloc()
+					b.StartTimer()
+					var err error
+					if m, err = lib.Paths(); err != nil {
+						b.Fatalf("lib.Paths() = _, %v; want _, nil", err)
+					}
+					b.StopTimer()
+					b.ReportMetric(float64(heapAlloc()-before)/float64(tracks), "B/track")
+				}
+				b.ReportMetric(float64(tracks)*float64(b.N)/b.Elapsed().Seconds(), "tracks/s")
+				runtime.KeepAlive(m)
+			})
+		}
+	}
+}
+
+func BenchmarkPrecomputeTags(b *testing.B) {
+	for _, tracks := range benchSizes {
+		b.Run(fmt.Sprintf("tracks=%d", tracks), func(b *testing.B) {
+			lib := benchLibrary(b, tracks, runtime.NumCPU())
+			for i := 0; i < b.N; i++ {
+				arena, err := PrecomputeTags(lib, 0)
+				if err != nil {
+					b.Fatalf("PrecomputeTags() = _, %v; want _, nil", err)
+				}
+				b.ReportMetric(float64(arena.Stats().Bytes)/float64(tracks), "B/track")
+			}
+			b.ReportMetric(float64(tracks)*float64(b.N)/b.Elapsed().Seconds(), "tracks/s")
+		})
+	}
+}
+
+// BenchmarkSongAt measures the cost of generating songs from many
+// goroutines, like a server under a parallel scan, with each tag cache.
+func BenchmarkSongAt(b *testing.B) {
+	const tracks = 100_000
+	for _, cache := range []string{"none", "lru", "arena"} {
+		b.Run("cache="+cache, func(b *testing.B) {
+			lib := benchLibrary(b, tracks, runtime.NumCPU())
+			switch cache {
+			case "lru":
+				lib.TagCache = NewLRUTagCache(1 << 30)
+			case "arena":
+				arena, err := PrecomputeTags(lib, 0)
+				if err != nil {
+					b.Fatalf("PrecomputeTags() = _, %v; want _, nil", err)
+				}
+				lib.TagCache = arena
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for idx := 0; pb.Next(); idx = (idx + 7919) % tracks {
+					if _, err := lib.SongAt(idx); err != nil {
+						b.Errorf("lib.SongAt(%d) = _, %v; want _, nil", idx, err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package library
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// TagCache caches the encoded id3v2 tags of songs by index. See
+// Library.TagCache. Implementations must be safe for concurrent use. Cached
+// tags are shared, and must not be modified.
+type TagCache interface {
+	// Get returns the cached tag of the song at `index`, and false if it is
+	// not cached.
+	Get(index int) ([]byte, bool)
+	// Add caches the encoded tag of the song at `index`. The cache may
+	// ignore it, e.g. if it is full.
+	Add(index int, tag []byte)
+	// Stats returns metrics about the cache.
+	Stats() CacheStats
+}
+
+// CacheStats are metrics about a TagCache.
+type CacheStats struct {
+	// Hits and Misses count calls to Get that did, and did not find a tag.
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	// Evictions counts tags removed from the cache to stay within its
+	// memory budget.
+	Evictions uint64 `json:"evictions"`
+	// Entries is the number of cached tags.
+	Entries int `json:"entries"`
+	// Bytes is the approximate memory used by the cache.
+	Bytes int64 `json:"bytes"`
+}
+
+// lruEntryOverhead is the approximate memory used by each entry of an
+// LRUTagCache, in addition to the tag itself: the list element, the map
+// entry, and the slice header.
+const lruEntryOverhead = 128
+
+// LRUTagCache is a TagCache that keeps the most recently used tags, within a
+// memory budget. It suits large libraries that are accessed unevenly, e.g.
+// by a few clients playing some songs repeatedly. It is created with
+// NewLRUTagCache.
+type LRUTagCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[int]*list.Element
+	// order has the most recently used entry at the front.
+	order *list.List
+	stats CacheStats
+}
+
+type lruEntry struct {
+	index int
+	tag   []byte
+}
+
+// NewLRUTagCache returns an empty LRUTagCache that uses about `maxBytes` of
+// memory at most.
+func NewLRUTagCache(maxBytes int64) *LRUTagCache {
+	return &LRUTagCache{
+		maxBytes: maxBytes,
+		entries:  make(map[int]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get implements TagCache.
+func (c *LRUTagCache) Get(index int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[index]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).tag, true
+}
+
+// Add implements TagCache. The least recently used tags are evicted to make
+// room for the new tag. Tags larger than the whole budget are not cached.
+func (c *LRUTagCache) Add(index int, tag []byte) {
+	size := int64(len(tag)) + lruEntryOverhead
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[index]; ok {
+		c.remove(e)
+	}
+	for c.stats.Bytes+size > c.maxBytes {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+	c.entries[index] = c.order.PushFront(&lruEntry{index: index, tag: tag})
+	c.stats.Entries++
+	c.stats.Bytes += size
+}
+
+func (c *LRUTagCache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*lruEntry)
+	delete(c.entries, entry.index)
+	c.stats.Entries--
+	c.stats.Bytes -= int64(len(entry.tag)) + lruEntryOverhead
+}
+
+// Stats implements TagCache.
+func (c *LRUTagCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// TagArena is a TagCache with the tags of every song in a library encoded
+// ahead of time, back to back in a single buffer. It suits libraries that
+// are scanned in full, e.g. by a media server indexing the library, since no
+// song is encoded twice, and there is no per-tag overhead. It is created with
+// PrecomputeTags.
+type TagArena struct {
+	data []byte
+	// offsets[i] is the start of the i-th tag in data. There is one extra
+	// offset at the end, so the i-th tag ends at offsets[i+1].
+	offsets []int64
+
+	hits, misses atomic.Uint64
+}
+
+// PrecomputeTags encodes the tag generated by the Tagger for every song in
+// `l`, and returns them as a TagArena. Tags are encoded on up to l.Workers
+// goroutines. An error is returned if the arena would use more than
+// `maxBytes` of memory. A `maxBytes` of 0 is unlimited.
+//
+// Songs added to the library later are not in the arena, and are encoded
+// every time they are read.
+func PrecomputeTags(l *Library, maxBytes int64) (*TagArena, error) {
+	a := &TagArena{offsets: make([]int64, 0, l.Tracks+1)}
+	batch := make([][]byte, min(l.Tracks, max(l.Workers, 1)*chunkSize*16))
+	for lo := 0; lo < l.Tracks; lo += len(batch) {
+		encoded := batch[:min(len(batch), l.Tracks-lo)]
+		err := forEach(lo, lo+len(encoded), l.Workers, func(idx int) error {
+			var err error
+			if encoded[idx-lo], err = encodeTag(l.Tagger(idx)); err != nil {
+				return fmt.Errorf("failed to encode tag of song %d: %w", idx, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range encoded {
+			a.offsets = append(a.offsets, int64(len(a.data)))
+			a.data = append(a.data, tag...)
+		}
+		if maxBytes > 0 && a.size() > maxBytes {
+			return nil, fmt.Errorf("tags of %d songs need more than %d bytes", l.Tracks, maxBytes)
+		}
+	}
+	a.offsets = append(a.offsets, int64(len(a.data)))
+	return a, nil
+}
+
+// size returns the memory used by the arena's tags and offsets.
+func (a *TagArena) size() int64 {
+	return int64(len(a.data)) + 8*int64(len(a.offsets))
+}
+
+// Get implements TagCache.
+func (a *TagArena) Get(index int) ([]byte, bool) {
+	if index < 0 || index >= len(a.offsets)-1 {
+		a.misses.Add(1)
+		return nil, false
+	}
+	a.hits.Add(1)
+	start, end := a.offsets[index], a.offsets[index+1]
+	if start == end {
+		// Tags without frames aren't written at all. Return nil, like
+		// encodeTag does.
+		return nil, true
+	}
+	// Limit the capacity, so appending to the tag can't overwrite the next
+	// one.
+	return a.data[start:end:end], true
+}
+
+// Add implements TagCache. The arena is never changed, so it does nothing.
+func (a *TagArena) Add(int, []byte) {}
+
+// Stats implements TagCache.
+func (a *TagArena) Stats() CacheStats {
+	return CacheStats{
+		Hits:    a.hits.Load(),
+		Misses:  a.misses.Load(),
+		Entries: len(a.offsets) - 1,
+		Bytes:   a.size(),
+	}
+}
@@ -0,0 +1,98 @@
+package library
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+func TestLRUTagCache(t *testing.T) {
+	c := NewLRUTagCache(3 * (lruEntryOverhead + 10))
+	tag := func(b byte) []byte { return bytes.Repeat([]byte{b}, 10) }
+	for idx := 0; idx < 3; idx++ {
+		c.Add(idx, tag(byte(idx)))
+	}
+	// Use 0, so 1 is the least recently used.
+	if got, ok := c.Get(0); !ok || !bytes.Equal(got, tag(0)) {
+		t.Errorf("c.Get(0) = %q, %v; want %q, true", got, ok, tag(0))
+	}
+	c.Add(3, tag(3))
+	if _, ok := c.Get(1); ok {
+		t.Errorf("c.Get(1) = _, true; want _, false after eviction")
+	}
+	for _, idx := range []int{0, 2, 3} {
+		if got, ok := c.Get(idx); !ok || !bytes.Equal(got, tag(byte(idx))) {
+			t.Errorf("c.Get(%d) = %q, %v; want %q, true", idx, got, ok, tag(byte(idx)))
+		}
+	}
+	// Too large to ever fit.
+	c.Add(4, make([]byte, 1000))
+	if _, ok := c.Get(4); ok {
+		t.Errorf("c.Get(4) = _, true; want _, false for a tag larger than the budget")
+	}
+
+	want := CacheStats{Hits: 4, Misses: 2, Evictions: 1, Entries: 3, Bytes: 3 * (lruEntryOverhead + 10)}
+	if got := c.Stats(); got != want {
+		t.Errorf("c.Stats() = %+v; want %+v", got, want)
+	}
+}
+
+// checkCachedSongs checks that every song in `lib` is the same with and
+// without `cache`, twice, so cached tags are used the second time.
+func checkCachedSongs(t *testing.T, lib *Library, cache TagCache) {
+	t.Helper()
+	for pass := 0; pass < 2; pass++ {
+		for idx := 0; idx < lib.Tracks; idx++ {
+			lib.TagCache = nil
+			want, err := lib.SongAt(idx)
+			if err != nil {
+				t.Fatalf("lib.SongAt(%d) = _, %v; want _, nil", idx, err)
+			}
+			lib.TagCache = cache
+			got, err := lib.SongAt(idx)
+			if err != nil {
+				t.Fatalf("lib.SongAt(%d) with cache = _, %v; want _, nil", idx, err)
+			}
+			if !bytes.Equal(got.tag, want.tag) {
+				t.Errorf("lib.SongAt(%d) with cache has tag %q; want %q", idx, got.tag, want.tag)
+			}
+		}
+	}
+	lib.TagCache = nil
+}
+
+func TestTagCaches(t *testing.T) {
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 50
+	// Edited tags are never cached, so they are always current.
+	if err := lib.EditTag(7, func(tag *id3v2.Tag) { tag.SetTitle("Edited") }); err != nil {
+		t.Fatalf("lib.EditTag(7) = %v; want nil", err)
+	}
+
+	lru := NewLRUTagCache(1 << 20)
+	checkCachedSongs(t, lib, lru)
+	if s := lru.Stats(); s.Entries != lib.Tracks-1 || s.Hits != uint64(lib.Tracks-1) {
+		t.Errorf("lru.Stats() = %+v; want %d entries and hits", s, lib.Tracks-1)
+	}
+
+	arena, err := PrecomputeTags(lib, 0)
+	if err != nil {
+		t.Fatalf("PrecomputeTags() = _, %v; want _, nil", err)
+	}
+	checkCachedSongs(t, lib, arena)
+	if s := arena.Stats(); s.Entries != lib.Tracks || s.Misses != 0 {
+		t.Errorf("arena.Stats() = %+v; want %d entries, and no misses", s, lib.Tracks)
+	}
+
+	if _, err := PrecomputeTags(lib, 100); err == nil {
+		t.Errorf("PrecomputeTags(_, 100) = _, nil; want an error for exceeding the budget")
+	}
+
+	// Songs added after the arena was built are encoded as usual.
+	lib.Tracks = 60
+	checkCachedSongs(t, lib, arena)
+}
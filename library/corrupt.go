@@ -0,0 +1,375 @@
+package library
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// CorruptFunc is a function that damages the encoded data of the song at the
+// given index, and returns the damaged data. It may return `data` unchanged,
+// or a sub-slice of it, but it must not modify `data`, which may be shared
+// between songs.
+type CorruptFunc func(index int, data []byte) []byte
+
+// Audio is the audio data of a song, as returned by an AudioFunc.
+type Audio struct {
+	// Data is the audio. It is the data passed to the AudioFunc, a
+	// sub-slice of it, or other data that is shared between songs, since
+	// songs keep a reference to it.
+	Data []byte
+	// Patch, if set, replaces the bytes of Data starting at PatchAt when
+	// the song is read, so damaging a small part of the audio doesn't
+	// need a copy of all of it.
+	Patch   []byte
+	PatchAt int
+	// Hash, if not zero, is a hash of Data that is used instead of hashing
+	// Data for every song, e.g. for song ETags. Set it for data that is
+	// shared between songs.
+	Hash uint64
+}
+
+// AudioFunc is a function that damages the audio `data` of the song at the
+// given index, and returns the damaged audio. It must not modify `data`,
+// which is shared between songs.
+type AudioFunc func(index int, data []byte) Audio
+
+// TagCorruption is a kind of damage to an encoded id3v2 tag.
+type TagCorruption int
+
+const (
+	// TruncatedHeader cuts the tag off part way through the 10 byte tag
+	// header.
+	TruncatedHeader TagCorruption = iota
+	// BadSynchsafeSize sets the high bit of every byte of the tag size,
+	// which must be zero in a synchsafe integer.
+	BadSynchsafeSize
+	// ShortSize makes the tag size half the real size of the tag's frames,
+	// so the remaining frames appear to be part of the audio.
+	ShortSize
+	// InvalidFrameID replaces the ID of the first frame with characters
+	// that are not allowed in frame IDs.
+	InvalidFrameID
+	// BadEncoding sets the text encoding of the first frame to an unknown
+	// encoding.
+	BadEncoding
+	// ZeroLengthFrame inserts a frame with no content (which must have at
+	// least one byte) before the first frame.
+	ZeroLengthFrame
+	// OversizedTag sets the tag size to the largest possible size (256MiB),
+	// which is larger than the whole file.
+	OversizedTag
+)
+
+var tagCorruptionNames = []string{
+	"truncated-header",
+	"bad-synchsafe-size",
+	"short-size",
+	"invalid-frame-id",
+	"bad-encoding",
+	"zero-length-frame",
+	"oversized-tag",
+}
+
+// AllTagCorruptions are all kinds of tag corruption.
+var AllTagCorruptions = []TagCorruption{
+	TruncatedHeader,
+	BadSynchsafeSize,
+	ShortSize,
+	InvalidFrameID,
+	BadEncoding,
+	ZeroLengthFrame,
+	OversizedTag,
+}
+
+func (c TagCorruption) String() string {
+	if int(c) >= 0 && int(c) < len(tagCorruptionNames) {
+		return tagCorruptionNames[c]
+	}
+	return fmt.Sprintf("TagCorruption(%d)", int(c))
+}
+
+// ParseTagCorruptions parses a comma-separated list of tag corruption
+// names, e.g. "truncated-header,bad-encoding". "all" is every kind.
+func ParseTagCorruptions(s string) ([]TagCorruption, error) {
+	kinds, err := parseKinds(s, "tag corruption", tagCorruptionNames)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]TagCorruption, len(kinds))
+	for i, k := range kinds {
+		out[i] = TagCorruption(k)
+	}
+	return out, nil
+}
+
+const (
+	// tagHeaderSize is the size of the id3v2 tag header, and frame headers.
+	tagHeaderSize = 10
+)
+
+// putSynchsafe writes `n` as a 4 byte synchsafe integer.
+func putSynchsafe(b []byte, n uint32) {
+	for i := 3; i >= 0; i-- {
+		b[i] = byte(n & 0x7f)
+		n >>= 7
+	}
+}
+
+// corrupt applies corruption `c` to the encoded tag `tag`. Tags without any
+// frames are returned unchanged.
+func (c TagCorruption) corrupt(tag []byte, h uint64) []byte {
+	if len(tag) < 2*tagHeaderSize+1 {
+		return tag
+	}
+	out := append([]byte(nil), tag...)
+	size := out[6:10]
+	switch c {
+	case TruncatedHeader:
+		// Keep at least the "ID3" identifier.
+		return out[:3+h%(tagHeaderSize-3)]
+	case BadSynchsafeSize:
+		for i := range size {
+			size[i] |= 0x80
+		}
+	case ShortSize:
+		putSynchsafe(size, uint32(len(out)-tagHeaderSize)/2)
+	case InvalidFrameID:
+		copy(out[tagHeaderSize:], "T!?\x00")
+	case BadEncoding:
+		out[2*tagHeaderSize] = 0x7f
+	case ZeroLengthFrame:
+		empty := make([]byte, tagHeaderSize)
+		copy(empty, "TCOM")
+		out = append(out[:tagHeaderSize:tagHeaderSize], append(empty, tag[tagHeaderSize:]...)...)
+		putSynchsafe(out[6:10], uint32(len(out)-tagHeaderSize))
+	case OversizedTag:
+		putSynchsafe(size, 1<<28-1)
+	}
+	return out
+}
+
+// pick decides whether the song at `index` is corrupted, with probability
+// `rate`, and if so picks one of `n` kinds of corruption.
+func pick(rate float64, seed int64, index, n int) (int, bool) {
+	h := splitmix64(uint64(seed) ^ splitmix64(uint64(index)))
+	if unitFloat(h) >= rate {
+		return 0, false
+	}
+	return int(splitmix64(h) % uint64(n)), true
+}
+
+// damageAt returns a hash that picks where the song at `index` is damaged
+// by corruption `kind`. The seed is mixed in, so libraries with different
+// seeds damage the same song in different places.
+func damageAt(seed int64, index, kind int) uint64 {
+	h := splitmix64(uint64(seed) ^ splitmix64(uint64(index)))
+	return splitmix64(h ^ splitmix64(uint64(kind)+1))
+}
+
+// parseKinds parses a comma-separated list of the given names, returning
+// their indices. "all" is every name.
+func parseKinds(s, what string, names []string) ([]int, error) {
+	var out []int
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for i, n := range names {
+			if n == name || name == "all" {
+				out = append(out, i)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown %s %q, want one of %s, all", what, name, strings.Join(names, ", "))
+		}
+	}
+	return out, nil
+}
+
+// CorruptTags implements a CorruptFunc for tags. A fraction (Rate) of songs
+// get one kind of corruption from Kinds. Which songs are corrupted, and how,
+// is a deterministic function of the song's index and Seed.
+type CorruptTags struct {
+	// Rate is the fraction (0 to 1) of songs with a corrupted tag.
+	Rate float64
+	// Kinds are the kinds of corruption to pick from. Defaults to
+	// AllTagCorruptions if empty.
+	Kinds []TagCorruption
+	// Seed is mixed into the selection of corrupted songs.
+	Seed int64
+}
+
+// Corruption returns the kind of corruption applied to the song at `index`,
+// and false if the song is not corrupted.
+func (c CorruptTags) Corruption(index int) (TagCorruption, bool) {
+	kinds := c.Kinds
+	if len(kinds) == 0 {
+		kinds = AllTagCorruptions
+	}
+	k, ok := pick(c.Rate, c.Seed, index, len(kinds))
+	if !ok {
+		return 0, false
+	}
+	return kinds[k], true
+}
+
+// Corrupt implements CorruptFunc.
+func (c CorruptTags) Corrupt(index int, tag []byte) []byte {
+	kind, ok := c.Corruption(index)
+	if !ok {
+		return tag
+	}
+	return kind.corrupt(tag, damageAt(c.Seed, index, int(kind)))
+}
+
+// AudioCorruption is a kind of damage to the audio data of a song.
+type AudioCorruption int
+
+const (
+	// Truncated cuts the audio off part way through.
+	Truncated AudioCorruption = iota
+	// Garbage overwrites a run of bytes in the middle of the audio with
+	// random bytes.
+	Garbage
+	// MissingSync removes every MPEG frame sync word from the audio, so
+	// decoders can't find any frames.
+	MissingSync
+	// ZeroLength removes all of the audio. Songs without audio are empty
+	// files, they don't have a tag either.
+	ZeroLength
+)
+
+var audioCorruptionNames = []string{
+	"truncated",
+	"garbage",
+	"missing-sync",
+	"zero-length",
+}
+
+// AllAudioCorruptions are all kinds of audio corruption.
+var AllAudioCorruptions = []AudioCorruption{
+	Truncated,
+	Garbage,
+	MissingSync,
+	ZeroLength,
+}
+
+func (c AudioCorruption) String() string {
+	if int(c) >= 0 && int(c) < len(audioCorruptionNames) {
+		return audioCorruptionNames[c]
+	}
+	return fmt.Sprintf("AudioCorruption(%d)", int(c))
+}
+
+// ParseAudioCorruptions parses a comma-separated list of audio corruption
+// names, e.g. "truncated,garbage". "all" is every kind.
+func ParseAudioCorruptions(s string) ([]AudioCorruption, error) {
+	kinds, err := parseKinds(s, "audio corruption", audioCorruptionNames)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]AudioCorruption, len(kinds))
+	for i, k := range kinds {
+		out[i] = AudioCorruption(k)
+	}
+	return out, nil
+}
+
+// corrupt applies corruption `c` to the audio `data`, using `h` to pick
+// where to damage it. `noSync` returns `data` without sync words.
+func (c AudioCorruption) corrupt(data []byte, h uint64, noSync func() Audio) Audio {
+	if len(data) == 0 {
+		return Audio{Data: data}
+	}
+	// Damage somewhere between 10% and 90% of the way through.
+	at := len(data)/10 + int(h%uint64(len(data)*8/10+1))
+	switch c {
+	case Truncated:
+		return Audio{Data: data[:at]}
+	case Garbage:
+		patch := make([]byte, min(len(data)/20+1, len(data)-at))
+		for i := range patch {
+			h = splitmix64(h)
+			patch[i] = byte(h)
+		}
+		return Audio{Data: data, Patch: patch, PatchAt: at}
+	case MissingSync:
+		return noSync()
+	case ZeroLength:
+		return Audio{Data: data[:0]}
+	}
+	return Audio{Data: data}
+}
+
+// removeSync returns a copy of `data` without any MPEG frame sync words.
+func removeSync(data []byte) []byte {
+	out := append([]byte(nil), data...)
+	for i := 0; i+1 < len(out); i++ {
+		// A sync word is 11 set bits.
+		if out[i] == 0xff && out[i+1]&0xe0 == 0xe0 {
+			out[i] = 0
+		}
+	}
+	return out
+}
+
+// CorruptAudio implements an AudioFunc. A fraction (Rate) of songs get one
+// kind of corruption from Kinds. Which songs are corrupted, and how, is a
+// deterministic function of the song's index and Seed. Corrupt must be
+// called on a pointer, e.g. (&CorruptAudio{...}).Corrupt, so audio that is
+// the same for every song (MissingSync) is only generated once.
+type CorruptAudio struct {
+	// Rate is the fraction (0 to 1) of songs with corrupted audio.
+	Rate float64
+	// Kinds are the kinds of corruption to pick from. Defaults to
+	// AllAudioCorruptions if empty.
+	Kinds []AudioCorruption
+	// Seed is mixed into the selection of corrupted songs.
+	Seed int64
+
+	mu sync.Mutex
+	// noSync is noSyncOf without sync words, and its hash, shared by every
+	// song with MissingSync.
+	noSync   Audio
+	noSyncOf []byte
+}
+
+// Corruption returns the kind of corruption applied to the song at `index`,
+// and false if the song is not corrupted.
+func (c *CorruptAudio) Corruption(index int) (AudioCorruption, bool) {
+	kinds := c.Kinds
+	if len(kinds) == 0 {
+		kinds = AllAudioCorruptions
+	}
+	k, ok := pick(c.Rate, c.Seed, index, len(kinds))
+	if !ok {
+		return 0, false
+	}
+	return kinds[k], true
+}
+
+// removeSync returns `data` without sync words. It is generated and hashed
+// once, and shared as long as Corrupt is called with the same data.
+func (c *CorruptAudio) removeSync(data []byte) Audio {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The golden data is the same slice for every song of a library.
+	same := len(c.noSyncOf) == len(data) && (len(data) == 0 || &c.noSyncOf[0] == &data[0])
+	if !same || c.noSync.Data == nil {
+		noSync := removeSync(data)
+		h := fnv.New64a()
+		h.Write(noSync)
+		c.noSync, c.noSyncOf = Audio{Data: noSync, Hash: h.Sum64()}, data
+	}
+	return c.noSync
+}
+
+// Corrupt implements AudioFunc.
+func (c *CorruptAudio) Corrupt(index int, data []byte) Audio {
+	kind, ok := c.Corruption(index)
+	if !ok {
+		return Audio{Data: data}
+	}
+	return kind.corrupt(data, damageAt(c.Seed, index, int(kind)), func() Audio { return c.removeSync(data) })
+}
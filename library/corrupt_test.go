@@ -0,0 +1,249 @@
+package library
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCorruptTags(t *testing.T) {
+	valid, err := testLibrary.SongAt(0)
+	if err != nil {
+		t.Fatalf("testLibrary.SongAt(0) = _, %v; want _, nil", err)
+	}
+	want, err := songInfo(valid)
+	if err != nil {
+		t.Fatalf("failed to parse valid song: %v", err)
+	}
+
+	original := append([]byte(nil), valid.tag...)
+	for _, kind := range AllTagCorruptions {
+		c := CorruptTags{Rate: 1, Kinds: []TagCorruption{kind}}
+		song := valid
+		song.tag = c.Corrupt(0, valid.tag)
+		if !bytes.Equal(valid.tag, original) {
+			t.Fatalf("%v: corrupting a tag modified the original tag", kind)
+		}
+		if bytes.Equal(song.tag, valid.tag) {
+			t.Errorf("%v: tag was not corrupted", kind)
+			continue
+		}
+		if !bytes.HasPrefix(song.tag, []byte("ID3")) {
+			t.Errorf("%v: corrupted tag %q does not start with ID3", kind, song.tag)
+		}
+		if kind == BadEncoding || kind == OversizedTag {
+			// id3v2 tolerates these, other parsers may not.
+			continue
+		}
+		// The damage must be visible to a parser, either as an error or as
+		// missing or wrong tag values.
+		if got, err := songInfo(song); err == nil && cmp.Equal(got, want) {
+			t.Errorf("%v: corrupted tag parsed as %+v, the same as the valid tag", kind, got)
+		}
+	}
+
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("failed to load library: %v", err)
+	}
+	lib.TagCorrupter = CorruptTags{Rate: 1, Kinds: []TagCorruption{TruncatedHeader}}.Corrupt
+	song, err := lib.SongAt(0)
+	if err != nil {
+		t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+	}
+	if len(song.tag) >= tagHeaderSize {
+		t.Errorf("lib.SongAt(0) with a TagCorrupter has a %d byte tag, want a truncated header", len(song.tag))
+	}
+}
+
+func TestCorruptTagsRate(t *testing.T) {
+	c := CorruptTags{Rate: 0.1, Kinds: []TagCorruption{ShortSize, OversizedTag}, Seed: 3}
+	var corrupted int
+	kinds := make(map[TagCorruption]int)
+	for i := 0; i < 10_000; i++ {
+		kind, ok := c.Corruption(i)
+		if again, againOK := c.Corruption(i); again != kind || againOK != ok {
+			t.Fatalf("c.Corruption(%d) is not deterministic", i)
+		}
+		if ok {
+			corrupted++
+			kinds[kind]++
+		}
+	}
+	if corrupted < 900 || corrupted > 1100 {
+		t.Errorf("CorruptTags{Rate: 0.1} corrupted %d/10000 tags, want ~1000", corrupted)
+	}
+	if len(kinds) != 2 || kinds[ShortSize] == 0 || kinds[OversizedTag] == 0 {
+		t.Errorf("CorruptTags picked kinds %v, want both of %v", kinds, c.Kinds)
+	}
+
+	if _, ok := (CorruptTags{}).Corruption(0); ok {
+		t.Errorf("CorruptTags{}.Corruption(0) = _, true; want no corruption")
+	}
+}
+
+func TestParseTagCorruptions(t *testing.T) {
+	got, err := ParseTagCorruptions("short-size,bad-encoding")
+	if err != nil {
+		t.Fatalf("ParseTagCorruptions(...) = _, %v; want _, nil", err)
+	}
+	if diff := cmp.Diff([]TagCorruption{ShortSize, BadEncoding}, got); diff != "" {
+		t.Errorf("ParseTagCorruptions(...) diff (want -> got):\n%s", diff)
+	}
+	if all, err := ParseTagCorruptions("all"); err != nil || len(all) != len(AllTagCorruptions) {
+		t.Errorf("ParseTagCorruptions(\"all\") = %v, %v; want %v, nil", all, err, AllTagCorruptions)
+	}
+	if _, err := ParseTagCorruptions("nope"); err == nil {
+		t.Errorf("ParseTagCorruptions(\"nope\") = _, nil; want error")
+	}
+}
+
+// hasSync returns true if `data` contains an MPEG frame sync word.
+func hasSync(data []byte) bool {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] == 0xff && data[i+1]&0xe0 == 0xe0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCorruptAudio(t *testing.T) {
+	lib, err := New(EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("failed to load library: %v", err)
+	}
+	valid, err := lib.SongAt(0)
+	if err != nil {
+		t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+	}
+	if !hasSync(valid.data) {
+		t.Fatalf("golden MP3 has no frame sync words")
+	}
+	original := append([]byte(nil), valid.data...)
+
+	for _, test := range []struct {
+		kind  AudioCorruption
+		check func(audio []byte) bool
+	}{
+		{Truncated, func(a []byte) bool {
+			return len(a) < len(original) && bytes.HasPrefix(original, a)
+		}},
+		{Garbage, func(a []byte) bool {
+			return len(a) == len(original) && !bytes.Equal(a, original)
+		}},
+		{MissingSync, func(a []byte) bool {
+			return len(a) == len(original) && !hasSync(a)
+		}},
+		{ZeroLength, func(a []byte) bool { return len(a) == 0 }},
+	} {
+		lib.AudioCorrupter = (&CorruptAudio{Rate: 1, Kinds: []AudioCorruption{test.kind}}).Corrupt
+		song, err := lib.SongAt(0)
+		if err != nil {
+			t.Errorf("%v: lib.SongAt(0) = _, %v; want _, nil", test.kind, err)
+			continue
+		}
+		got := audioOf(song)
+		if !test.check(got) {
+			t.Errorf("%v: song has %d bytes of audio, not corrupted as expected", test.kind, len(got))
+		}
+		if again, _ := lib.SongAt(0); !bytes.Equal(audioOf(again), got) {
+			t.Errorf("%v: corruption is not deterministic", test.kind)
+		}
+		if !bytes.Equal(lib.golden, original) {
+			t.Fatalf("%v: corrupting audio modified the golden data", test.kind)
+		}
+	}
+}
+
+// audioOf returns the audio data of `song`, as read by ReadAt.
+func audioOf(song Song) []byte {
+	buf := make([]byte, song.Size())
+	song.ReadAt(buf, 0)
+	return buf[song.TagSize():]
+}
+
+func TestCorruptAudioShared(t *testing.T) {
+	lib, err := New(EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("failed to load library: %v", err)
+	}
+	lib.AudioCorrupter = (&CorruptAudio{Rate: 1, Kinds: []AudioCorruption{Garbage, MissingSync}}).Corrupt
+
+	var noSync []byte
+	for idx := 0; idx < 100; idx++ {
+		song, err := lib.SongAt(idx)
+		if err != nil {
+			t.Fatalf("lib.SongAt(%d) = _, %v; want _, nil", idx, err)
+		}
+		switch {
+		case song.patch != nil:
+			if &song.data[0] != &lib.golden[0] {
+				t.Errorf("Song %d with garbage has a copy of the golden data", idx)
+			}
+		case noSync == nil:
+			noSync = song.data
+		case &song.data[0] != &noSync[0]:
+			t.Errorf("Song %d without sync words has its own copy of the audio", idx)
+		}
+	}
+	if noSync == nil {
+		t.Errorf("No song without sync words in 100 songs")
+	}
+
+	// Reads across the patch return the same bytes as one large read.
+	song, err := lib.SongAt(0)
+	for idx := 1; song.patch == nil && err == nil; idx++ {
+		song, err = lib.SongAt(idx)
+	}
+	if err != nil {
+		t.Fatalf("No song with garbage: %v", err)
+	}
+	want := make([]byte, song.Size())
+	song.ReadAt(want, 0)
+	got := make([]byte, 0, len(want))
+	buf := make([]byte, 7)
+	for off := int64(0); off < song.Size(); off += int64(len(buf)) {
+		n, _ := song.ReadAt(buf, off)
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Small reads of a song with garbage differ from a single read")
+	}
+}
+
+func TestCorruptAudioSeed(t *testing.T) {
+	lib, err := New(EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("failed to load library: %v", err)
+	}
+	// lengths returns the lengths of the first songs, truncated with `seed`.
+	lengths := func(seed int64) []int {
+		c := &CorruptAudio{Rate: 1, Kinds: []AudioCorruption{Truncated}, Seed: seed}
+		var out []int
+		for idx := 0; idx < 10; idx++ {
+			out = append(out, len(c.Corrupt(idx, lib.golden).Data))
+		}
+		return out
+	}
+	if a, b := lengths(1), lengths(2); cmp.Equal(a, b) {
+		t.Errorf("Songs truncated with seeds 1 and 2 have the same lengths %v", a)
+	}
+	if a, b := lengths(1), lengths(1); !cmp.Equal(a, b) {
+		t.Errorf("Songs truncated with seed 1 have lengths %v, then %v", a, b)
+	}
+}
+
+func TestParseAudioCorruptions(t *testing.T) {
+	got, err := ParseAudioCorruptions("garbage,zero-length")
+	if err != nil {
+		t.Fatalf("ParseAudioCorruptions(...) = _, %v; want _, nil", err)
+	}
+	if diff := cmp.Diff([]AudioCorruption{Garbage, ZeroLength}, got); diff != "" {
+		t.Errorf("ParseAudioCorruptions(...) diff (want -> got):\n%s", diff)
+	}
+	if _, err := ParseAudioCorruptions("truncated,"); err == nil {
+		t.Errorf("ParseAudioCorruptions(\"truncated,\") = _, nil; want error")
+	}
+}
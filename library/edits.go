@@ -0,0 +1,194 @@
+package library
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+// ErrRemoved is returned (wrapped) when accessing a song that has been
+// removed from the library with Remove.
+var ErrRemoved = errors.New("song was removed from the library")
+
+// edit records changes made to a single song after the library was created.
+// Zero fields are unchanged.
+type edit struct {
+	tag     *id3v2.Tag
+	path    string
+	modTime time.Time
+	removed bool
+}
+
+func (l *Library) checkIndex(idx int) error {
+	if idx < 0 || idx > (l.Tracks-1) {
+		return fmt.Errorf("index %d out of range [0, %d)", idx, l.Tracks)
+	}
+	return nil
+}
+
+// editAt returns the edit of the idx-th song, creating it if needed. `l.mu`
+// must be held for writing.
+func (l *Library) editAt(idx int) *edit {
+	if l.edits == nil {
+		l.edits = make(map[int]*edit)
+	}
+	e, ok := l.edits[idx]
+	if !ok {
+		e = &edit{}
+		l.edits[idx] = e
+	}
+	return e
+}
+
+// editOf returns a copy of the edit of the idx-th song, which is zero if the
+// song was never edited.
+func (l *Library) editOf(idx int) edit {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if e := l.edits[idx]; e != nil {
+		return *e
+	}
+	return edit{}
+}
+
+// TagAt returns the tag of the idx-th song in the library. This is the tag
+// set with SetTag if there is one, otherwise it is generated by the Tagger.
+func (l *Library) TagAt(idx int) (*id3v2.Tag, error) {
+	if err := l.checkIndex(idx); err != nil {
+		return nil, err
+	}
+	if e := l.editOf(idx); e.tag != nil {
+		return e.tag, nil
+	}
+	return l.Tagger(idx), nil
+}
+
+// EditedTag returns the tag set with SetTag for the idx-th song, or nil if it
+// has the tag generated by the Tagger.
+func (l *Library) EditedTag(idx int) (*id3v2.Tag, error) {
+	if err := l.checkIndex(idx); err != nil {
+		return nil, err
+	}
+	return l.editOf(idx).tag, nil
+}
+
+// SetTag replaces the tag of the idx-th song. The new tag is also passed to
+// the Pather, so it may change the song's path. A nil `tag` restores the
+// tag generated by the Tagger.
+func (l *Library) SetTag(idx int, tag *id3v2.Tag) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkIndex(idx); err != nil {
+		return err
+	}
+	l.editAt(idx).tag = tag
+	return nil
+}
+
+// EditTag calls `f` with a copy of the idx-th song's current tag, and then
+// sets the song's tag to the edited copy, like SetTag. The original tag is
+// never modified, so it is safe to use with Taggers that share tags between
+// songs. Concurrent edits of the same song are applied one after the other,
+// so `f` must not use the library.
+func (l *Library) EditTag(idx int, f func(tag *id3v2.Tag)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkIndex(idx); err != nil {
+		return err
+	}
+	tag := l.Tagger(idx)
+	if e := l.edits[idx]; e != nil && e.tag != nil {
+		tag = e.tag
+	}
+
+	var buf bytes.Buffer
+	if _, err := tag.WriteTo(&buf); err != nil {
+		return fmt.Errorf("failed to copy tag of song %d: %w", idx, err)
+	}
+	edited, err := id3v2.ParseReader(&buf, id3v2.Options{Parse: true})
+	if err != nil {
+		return fmt.Errorf("failed to copy tag of song %d: %w", idx, err)
+	}
+
+	f(edited)
+	l.editAt(idx).tag = edited
+	return nil
+}
+
+// SetPath overrides the path of the idx-th song, bypassing the Pather. An
+// empty `p` restores the path generated by the Pather.
+func (l *Library) SetPath(idx int, p string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkIndex(idx); err != nil {
+		return err
+	}
+	l.editAt(idx).path = p
+	return nil
+}
+
+// SetModTime overrides the modification time of the idx-th song. The zero
+// time restores the time generated by the Timestamper.
+func (l *Library) SetModTime(idx int, t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkIndex(idx); err != nil {
+		return err
+	}
+	l.editAt(idx).modTime = t
+	return nil
+}
+
+// Remove removes the idx-th song from the library. Indices of other songs
+// are unchanged, the removed song is just skipped by Paths. Removed songs
+// are restored by Restore, or when the library is shrunk with Resize.
+func (l *Library) Remove(idx int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkIndex(idx); err != nil {
+		return err
+	}
+	l.editAt(idx).removed = true
+	return nil
+}
+
+// Restore undoes Remove for the idx-th song.
+func (l *Library) Restore(idx int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkIndex(idx); err != nil {
+		return err
+	}
+	if e := l.edits[idx]; e != nil {
+		e.removed = false
+	}
+	return nil
+}
+
+// Removed returns true if the idx-th song has been removed with Remove.
+func (l *Library) Removed(idx int) bool {
+	return l.editOf(idx).removed
+}
+
+// Resize changes the number of tracks in the library to `tracks`. When the
+// library shrinks, any edits to songs past the new end are discarded, so
+// songs added by growing the library again are always generated fresh.
+// Unlike the other edits, Resize must not be called while the library is
+// used by other goroutines, since it changes Tracks.
+func (l *Library) Resize(tracks int) error {
+	if tracks < 0 {
+		return fmt.Errorf("invalid number of tracks %d", tracks)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for idx := range l.edits {
+		if idx >= tracks {
+			delete(l.edits, idx)
+		}
+	}
+	l.Tracks = tracks
+	return nil
+}
@@ -0,0 +1,231 @@
+package library
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+func TestEditTag(t *testing.T) {
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+
+	if err := lib.EditTag(1, func(tag *id3v2.Tag) { tag.SetTitle("Edited") }); err != nil {
+		t.Fatalf("lib.EditTag(1, ...) = %v, want nil", err)
+	}
+
+	song, err := lib.SongAt(1)
+	if err != nil {
+		t.Fatalf("lib.SongAt(1) = _, %v; want _, nil", err)
+	}
+	info, err := songInfo(song)
+	if err != nil {
+		t.Fatalf("songInfo(...) = _, %v; want _, nil", err)
+	}
+	want := trackInfo{Artist: "A", Album: "A", Title: "Edited", Track: "2"}
+	if info != want {
+		t.Errorf("lib.SongAt(1) after EditTag = %+v, want %+v", info, want)
+	}
+	if got, _ := lib.PathAt(1); got != "A/A/Edited.mp3" {
+		t.Errorf("lib.PathAt(1) after EditTag = %q, want %q", got, "A/A/Edited.mp3")
+	}
+	// Other songs must be unaffected.
+	if got, _ := lib.PathAt(2); got != "A/A/C.mp3" {
+		t.Errorf("lib.PathAt(2) after EditTag(1) = %q, want %q", got, "A/A/C.mp3")
+	}
+
+	if err := lib.SetTag(1, nil); err != nil {
+		t.Fatalf("lib.SetTag(1, nil) = %v, want nil", err)
+	}
+	if got, _ := lib.PathAt(1); got != "A/A/B.mp3" {
+		t.Errorf("lib.PathAt(1) after SetTag(1, nil) = %q, want %q", got, "A/A/B.mp3")
+	}
+}
+
+func TestEditTagSharedTag(t *testing.T) {
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	shared := id3v2.NewEmptyTag()
+	shared.SetTitle("Shared")
+	lib.Tagger = func(int) *id3v2.Tag { return shared }
+
+	if err := lib.EditTag(0, func(tag *id3v2.Tag) { tag.SetTitle("Edited") }); err != nil {
+		t.Fatalf("lib.EditTag(0, ...) = %v, want nil", err)
+	}
+	if shared.Title() != "Shared" {
+		t.Errorf("EditTag modified the Tagger's tag, title = %q, want %q", shared.Title(), "Shared")
+	}
+}
+
+func TestSetPathAndModTime(t *testing.T) {
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+
+	if err := lib.SetPath(0, "Moved/Song.mp3"); err != nil {
+		t.Fatalf("lib.SetPath(0, ...) = %v, want nil", err)
+	}
+	if got, _ := lib.PathAt(0); got != "Moved/Song.mp3" {
+		t.Errorf("lib.PathAt(0) = %q, want %q", got, "Moved/Song.mp3")
+	}
+
+	want := time.Unix(1234567890, 0)
+	if err := lib.SetModTime(0, want); err != nil {
+		t.Fatalf("lib.SetModTime(0, ...) = %v, want nil", err)
+	}
+	song, _ := lib.SongAt(0)
+	if !song.ModTime().Equal(want) {
+		t.Errorf("lib.SongAt(0).ModTime() = %v, want %v", song.ModTime(), want)
+	}
+
+	if err := lib.SetPath(lib.Tracks, "x.mp3"); err == nil {
+		t.Errorf("lib.SetPath(%d, ...) = nil, want out of range error", lib.Tracks)
+	}
+}
+
+func TestRemoveAndResize(t *testing.T) {
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 5
+
+	if err := lib.Remove(1); err != nil {
+		t.Fatalf("lib.Remove(1) = %v, want nil", err)
+	}
+	m, err := lib.Paths()
+	if err != nil {
+		t.Fatalf("lib.Paths() = _, %v; want _, nil", err)
+	}
+	if _, err := m.PathAt(1); !errors.Is(err, ErrRemoved) {
+		t.Errorf("m.PathAt(1) = _, %v; want _, ErrRemoved", err)
+	}
+	if _, ok := m.Index("A/A/B.mp3"); ok {
+		t.Errorf("m.Index(%q) found removed song", "A/A/B.mp3")
+	}
+
+	if err := lib.Resize(1); err != nil {
+		t.Fatalf("lib.Resize(1) = %v, want nil", err)
+	}
+	if err := lib.Resize(3); err != nil {
+		t.Fatalf("lib.Resize(3) = %v, want nil", err)
+	}
+	if lib.Removed(1) {
+		t.Errorf("lib.Removed(1) = true after shrinking and growing, want false")
+	}
+	if err := lib.Resize(-1); err == nil {
+		t.Errorf("lib.Resize(-1) = nil, want error")
+	}
+}
+
+// Concurrent edits of the same tag are all applied.
+func TestConcurrentEditTag(t *testing.T) {
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 1
+
+	const edits = 50
+	var wg sync.WaitGroup
+	for i := 0; i < edits; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lib.EditTag(0, func(tag *id3v2.Tag) {
+				// Give other edits a chance to read the same tag.
+				time.Sleep(time.Millisecond)
+				tag.SetTitle(tag.Title() + "x")
+			})
+		}()
+	}
+	wg.Wait()
+
+	tag, err := lib.EditedTag(0)
+	if err != nil || tag == nil {
+		t.Fatalf("lib.EditedTag(0) = %v, %v; want a tag, nil", tag, err)
+	}
+	if got, want := tag.Title(), lib.Tagger(0).Title()+strings.Repeat("x", edits); got != want {
+		t.Errorf("Title after %d concurrent edits = %q, want %q", edits, got, want)
+	}
+}
+
+// Songs can be edited while other goroutines read the library. Run with
+// -race to check.
+func TestConcurrentEdits(t *testing.T) {
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 100
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for idx := 0; idx < lib.Tracks; idx++ {
+			lib.SetPath(idx, "X/X/X.mp3")
+			lib.SetModTime(idx, time.Unix(int64(idx), 0))
+			lib.EditTag(idx, func(tag *id3v2.Tag) { tag.SetArtist("X") })
+			lib.Remove(idx)
+		}
+	}()
+	for idx := 0; idx < lib.Tracks; idx++ {
+		if _, err := lib.SongAt(idx); err != nil {
+			t.Errorf("lib.SongAt(%d) = _, %v; want _, nil", idx, err)
+		}
+		if _, err := lib.PathAt(idx); err != nil {
+			t.Errorf("lib.PathAt(%d) = _, %v; want _, nil", idx, err)
+		}
+		lib.Removed(idx)
+	}
+	wg.Wait()
+}
+
+func TestPathMapUpdates(t *testing.T) {
+	m, err := collidingLibrary(t, CollisionSuffixCount, "A/A.mp3", "A/B.mp3").Paths()
+	if err != nil {
+		t.Fatalf("Paths() = _, %v; want _, nil", err)
+	}
+
+	if got, err := m.Set(1, "A/A.mp3"); err != nil || got != "A/A (2).mp3" {
+		t.Errorf("m.Set(1, %q) = %q, %v; want %q, nil", "A/A.mp3", got, err, "A/A (2).mp3")
+	}
+	if got, err := m.Set(3, "B/C.mp3"); err != nil || got != "B/C.mp3" {
+		t.Errorf("m.Set(3, %q) = %q, %v; want %q, nil", "B/C.mp3", got, err, "B/C.mp3")
+	}
+	if m.Len() != 4 {
+		t.Errorf("m.Len() = %d, want 4", m.Len())
+	}
+
+	m.Delete(0)
+	if _, ok := m.Index("A/A.mp3"); ok {
+		t.Errorf("m.Index(%q) found deleted song", "A/A.mp3")
+	}
+	// The path of the deleted song is free again.
+	if got, err := m.Set(1, "A/A.mp3"); err != nil || got != "A/A.mp3" {
+		t.Errorf("m.Set(1, %q) = %q, %v; want %q, nil", "A/A.mp3", got, err, "A/A.mp3")
+	}
+	if c := m.Collisions(); len(c) != 0 {
+		t.Errorf("m.Collisions() = %v, want none", c)
+	}
+
+	m.Truncate(2)
+	if _, ok := m.Index("B/C.mp3"); ok || m.Len() != 2 {
+		t.Errorf("after m.Truncate(2), m.Len() = %d, m.Index(%q) found = %v; want 2, false", m.Len(), "B/C.mp3", ok)
+	}
+	// The B directory is gone, so a song can use its path.
+	if got, err := m.Set(1, "B"); err != nil || got != "B" {
+		t.Errorf("m.Set(1, %q) = %q, %v; want %q, nil", "B", got, err, "B")
+	}
+}
@@ -0,0 +1,209 @@
+package library
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+// FS is a read-only io/fs.FS of a library, with the same files and
+// directories as the library mounted with the filesystem package. It can be
+// used with fs.WalkDir, http.FS, testing/fstest and the like, without
+// mounting the library. It is created with Library.FS.
+//
+// Paths are resolved when the FS is created, so the library must not be
+// modified while the FS is used.
+type FS struct {
+	lib   *Library
+	paths *PathMap
+	// times is the modification time of each directory, which is the time
+	// of its newest song. The root is ".".
+	times map[string]time.Time
+}
+
+var _ fs.ReadDirFS = (*FS)(nil)
+var _ fs.StatFS = (*FS)(nil)
+
+// FS returns an io/fs.FS of the library. Like Paths, an error is returned if
+// the songs' paths collide, and the Collisions strategy does not resolve
+// them.
+func (l *Library) FS() (*FS, error) {
+	paths, err := l.Paths()
+	if err != nil {
+		return nil, err
+	}
+	f := &FS{lib: l, paths: paths, times: make(map[string]time.Time)}
+	for idx := 0; idx < paths.Len(); idx++ {
+		p, err := paths.PathAt(idx)
+		if err != nil {
+			continue
+		}
+		t := l.modTimeAt(idx)
+		for dir := path.Dir(p); ; dir = path.Dir(dir) {
+			if t.After(f.times[dir]) {
+				f.times[dir] = t
+			}
+			if dir == "." {
+				break
+			}
+		}
+	}
+	return f, nil
+}
+
+// stat returns information about the file or directory `name`, and the song
+// if it is a file.
+func (f *FS) stat(op, name string) (*fileInfo, Song, error) {
+	if !fs.ValidPath(name) {
+		return nil, Song{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if idx, ok := f.paths.Index(name); ok {
+		song, err := f.lib.SongAt(idx)
+		if err != nil {
+			return nil, Song{}, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		info := &fileInfo{name: path.Base(name), size: song.Size(), mode: 0444, modTime: song.ModTime()}
+		return info, song, nil
+	}
+	if f.paths.IsDir(name) {
+		return &fileInfo{name: path.Base(name), mode: fs.ModeDir | 0555, modTime: f.times[name]}, Song{}, nil
+	}
+	return nil, Song{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// Open implements fs.FS. Songs are generated when they are opened.
+func (f *FS) Open(name string) (fs.File, error) {
+	info, song, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return &songFile{info: info, SectionReader: song.Reader()}, nil
+	}
+	entries, err := f.readDir("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{path: name, info: info, entries: entries}, nil
+}
+
+// Stat implements fs.StatFS.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	info, _, err := f.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ReadDir implements fs.ReadDirFS. Entries are sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return f.readDir("readdir", name)
+}
+
+func (f *FS) readDir(op, name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if _, ok := f.paths.Index(name); ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	entries, err := f.paths.ReadDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	out := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		out[i] = &dirEntry{fs: f, path: path.Join(name, e.Name), entry: e}
+	}
+	return out, nil
+}
+
+var (
+	errNotDir = errors.New("not a directory")
+	errIsDir  = errors.New("is a directory")
+)
+
+// fileInfo implements fs.FileInfo for songs and directories.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fileInfo) Sys() any           { return nil }
+
+// dirEntry implements fs.DirEntry. Songs are only generated if Info is
+// called, so directories can be listed cheaply.
+type dirEntry struct {
+	fs    *FS
+	path  string
+	entry Entry
+}
+
+func (e *dirEntry) Name() string { return e.entry.Name }
+func (e *dirEntry) IsDir() bool  { return e.entry.IsDir() }
+
+func (e *dirEntry) Type() fs.FileMode {
+	if e.IsDir() {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	info, _, err := e.fs.stat("stat", e.path)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// songFile is an open song. It implements io.Seeker and io.ReaderAt, as
+// required by http.FS.
+type songFile struct {
+	info *fileInfo
+	*io.SectionReader
+}
+
+func (f *songFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *songFile) Close() error               { return nil }
+
+// dirFile is an open directory. It implements fs.ReadDirFile.
+type dirFile struct {
+	path    string
+	info    *fileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errIsDir}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
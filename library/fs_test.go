@@ -0,0 +1,108 @@
+package library
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFS(t *testing.T) {
+	lib, err := New(EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 40
+	lib.Timestamper = func(idx int) time.Time { return time.Unix(int64(1_000_000_000+idx), 0) }
+	if err := lib.Remove(3); err != nil {
+		t.Fatalf("lib.Remove(3) = %v; want nil", err)
+	}
+
+	fsys, err := lib.FS()
+	if err != nil {
+		t.Fatalf("lib.FS() = _, %v; want _, nil", err)
+	}
+	paths, err := lib.Paths()
+	if err != nil {
+		t.Fatalf("lib.Paths() = _, %v; want _, nil", err)
+	}
+	var want []string
+	for idx := 0; idx < paths.Len(); idx++ {
+		if p, err := paths.PathAt(idx); err == nil {
+			want = append(want, p)
+		}
+	}
+	if err := fstest.TestFS(fsys, want...); err != nil {
+		t.Errorf("fstest.TestFS() = %v; want nil", err)
+	}
+
+	for idx := 0; idx < paths.Len(); idx++ {
+		p, err := paths.PathAt(idx)
+		if err != nil {
+			continue
+		}
+		song, _ := lib.SongAt(idx)
+		wantContent := make([]byte, song.Size())
+		song.ReadAt(wantContent, 0)
+		got, err := fs.ReadFile(fsys, p)
+		if err != nil || !bytes.Equal(got, wantContent) {
+			t.Errorf("fs.ReadFile(%q) = %d bytes, %v; want song %d (%d bytes), nil", p, len(got), err, idx, len(wantContent))
+		}
+	}
+
+	// Directories have the time of their newest song.
+	info, err := fsys.Stat(".")
+	if err != nil {
+		t.Fatalf("fsys.Stat(\".\") = _, %v; want _, nil", err)
+	}
+	if newest := time.Unix(1_000_000_000+39, 0); !info.ModTime().Equal(newest) {
+		t.Errorf("fsys.Stat(\".\").ModTime() = %v; want %v", info.ModTime(), newest)
+	}
+
+	for _, name := range []string{"missing", "/A", "A/../A"} {
+		if _, err := fsys.Open(name); err == nil {
+			t.Errorf("fsys.Open(%q) = _, nil; want an error", name)
+		}
+	}
+	if _, err := fsys.ReadDir(want[0]); err == nil {
+		t.Errorf("fsys.ReadDir(%q) = _, nil; want an error", want[0])
+	}
+}
+
+func TestFSSeek(t *testing.T) {
+	lib, err := New(EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 1
+	fsys, err := lib.FS()
+	if err != nil {
+		t.Fatalf("lib.FS() = _, %v; want _, nil", err)
+	}
+	p, _ := lib.PathAt(0)
+	f, err := fsys.Open(p)
+	if err != nil {
+		t.Fatalf("fsys.Open(%q) = _, %v; want _, nil", p, err)
+	}
+	defer f.Close()
+	song, _ := lib.SongAt(0)
+	content := make([]byte, song.Size())
+	song.ReadAt(content, 0)
+
+	seeker := f.(io.ReadSeeker)
+	if off, err := seeker.Seek(-10, io.SeekEnd); off != song.Size()-10 || err != nil {
+		t.Fatalf("Seek(-10, io.SeekEnd) = %d, %v; want %d, nil", off, err, song.Size()-10)
+	}
+	buf := make([]byte, 20)
+	if n, err := seeker.Read(buf); n != 10 || (err != nil && err != io.EOF) {
+		t.Errorf("Read() at end = %d, %v; want 10, nil or io.EOF", n, err)
+	}
+	if !bytes.Equal(buf[:10], content[len(content)-10:]) {
+		t.Errorf("Read() at end = %x; want %x", buf[:10], content[len(content)-10:])
+	}
+	if n, err := seeker.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("Read() past end = %d, %v; want 0, io.EOF", n, err)
+	}
+}
@@ -26,10 +26,12 @@ Typical Usage:
 	// Access any songs/paths you want...
 
 	s := lib.SongAt(0)
-	s.Read(...)
+	s.ReadAt(...)
 	s.Size()
 
 A mountable file-system can be found in github.com/joshkunz/fakelib/filesystem.
+For tests that don't need a mount, Library.FS returns an io/fs.FS of the
+library.
 */
 package library
 
@@ -37,12 +39,17 @@ import (
 	"bytes"
 	"compress/bzip2"
 	_ "embed"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bogem/id3v2/v2"
 )
@@ -70,6 +77,18 @@ func EmbeddedGoldMP3() io.ReadSeeker {
 type Song struct {
 	tag  []byte
 	data []byte
+	// patch replaces the bytes of data at patchAt, see Audio.
+	patch   []byte
+	patchAt int64
+	modTime time.Time
+	// audioHash is a hash of data, see Library.audioHash.
+	audioHash uint64
+}
+
+// ModTime is the modification time of this song. It is the zero time if the
+// library has no Timestamper.
+func (s Song) ModTime() time.Time {
+	return s.modTime
 }
 
 // Size is the size in bytes of this song.
@@ -77,17 +96,28 @@ func (s Song) Size() int64 {
 	return int64(len(s.tag) + len(s.data))
 }
 
-// Read reads bytes from this song into the buffer `buf` starting at byte `off`
-// in the song. All data is read from memory, so this operation cannot fail.
-func (s Song) Read(buf []byte, off int64) {
+// TagSize is the size in bytes of this song's id3v2 tag, which comes before
+// the audio data.
+func (s Song) TagSize() int64 {
+	return int64(len(s.tag))
+}
+
+// ReadAt implements io.ReaderAt. It reads len(buf) bytes from this song
+// starting at byte `off`. If fewer bytes are available, it returns the number
+// of bytes read and io.EOF. All data is read from memory, so no other errors
+// are possible for valid offsets.
+func (s Song) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
 	// Nothing to read here.
 	if off >= s.Size() {
-		return
+		return 0, io.EOF
 	}
 
+	var n int
 	if off < int64(len(s.tag)) {
-		read := copy(buf, s.tag[off:])
-		buf = buf[read:]
+		n = copy(buf, s.tag[off:])
 		// If off < len(e.tag), the we've read all we can from
 		// the tag, and we should re-start at the beginning of
 		// the song.
@@ -97,7 +127,59 @@ func (s Song) Read(buf []byte, off int64) {
 		// should exclude the tag part from the offset.
 		off -= int64(len(s.tag))
 	}
-	copy(buf, s.data[off:])
+	m := copy(buf[n:], s.data[off:])
+	if s.patch != nil {
+		s.applyPatch(buf[n:n+m], off)
+	}
+	n += m
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Hash returns a hash of the song's contents, e.g. for an HTTP entity tag.
+// It only reads the tag, and the patch of damaged audio: the hash of the
+// audio data is computed once per Library. Songs with different contents
+// have different hashes, but songs with the same contents may not have
+// the same hash.
+func (s Song) Hash() uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	put := func(v uint64) {
+		binary.BigEndian.PutUint64(buf[:], v)
+		h.Write(buf[:])
+	}
+	put(uint64(len(s.tag)))
+	h.Write(s.tag)
+	put(s.audioHash)
+	put(uint64(s.patchAt))
+	h.Write(s.patch)
+	return h.Sum64()
+}
+
+// applyPatch replaces the bytes of `buf`, which holds the audio data from
+// offset `off`, that are covered by the song's patch.
+func (s Song) applyPatch(buf []byte, off int64) {
+	start := max(s.patchAt, off)
+	end := min(s.patchAt+int64(len(s.patch)), off+int64(len(buf)))
+	if start < end {
+		copy(buf[start-off:end-off], s.patch[start-s.patchAt:])
+	}
+}
+
+// Reader returns a reader of this song's contents. The reader also
+// implements io.Seeker and io.ReaderAt.
+func (s Song) Reader() *io.SectionReader {
+	return io.NewSectionReader(s, 0, s.Size())
+}
+
+// Read reads bytes from this song into the buffer `buf` starting at byte `off`
+// in the song. All data is read from memory, so this operation cannot fail.
+//
+// Deprecated: Use ReadAt, which reports how many bytes were read.
+func (s Song) Read(buf []byte, off int64) {
+	s.ReadAt(buf, off)
 }
 
 // RepeatedLetters implements a tagger to generate track metadata using
@@ -207,7 +289,10 @@ type PathFunc func(index int, tag *id3v2.Tag) string
 // The number of tracks, and the structure of the library can be controlled
 // via member variables.
 type Library struct {
-	// Total number of tracks in the fake library.
+	// Total number of tracks in the fake library. Songs are indexed by int,
+	// so on 64-bit platforms a library is limited only by memory, e.g. for
+	// its PathMap. Note that mounted libraries of more than about 2^31
+	// tracks need filesystem.Options.LargeInodes.
 	Tracks int
 
 	// Tagger is invoked to retrieve the tags for the song at each index
@@ -216,35 +301,213 @@ type Library struct {
 	// Pather is invoked to generate the path for the song at each index. It
 	// is also passed the tag generated by the Tagger.
 	Pather PathFunc
+	// Timestamper is invoked to retrieve the modification time of the song
+	// at each index. If unset, songs have the zero time.
+	Timestamper TimeFunc
+	// Collisions determines how songs that are given the same path by the
+	// Pather are handled. See Paths.
+	Collisions CollisionStrategy
+	// TagCorrupter, if set, is invoked with the encoded tag of the song at
+	// each index, and can return a damaged tag, e.g. to test tag parsers.
+	// See CorruptTags.
+	TagCorrupter CorruptFunc
+	// AudioCorrupter, if set, is invoked with the audio data of the song at
+	// each index, and can return damaged audio, e.g. to test decoders. If it
+	// returns no data, the song is an empty file. See CorruptAudio.
+	AudioCorrupter AudioFunc
+	// TagCache, if set, caches encoded tags, so SongAt doesn't have to run
+	// the Tagger and encode the tag every time. Tags set with SetTag are not
+	// cached. The cache must be replaced if the Tagger changes. See
+	// LRUTagCache and PrecomputeTags.
+	TagCache TagCache
+	// Workers is the number of goroutines used to generate the songs or
+	// paths of many tracks at once, in Paths and SongsAt. If it is more than
+	// 1, the Tagger, Pather and Timestamper must be safe for concurrent use.
+	// Defaults to 1.
+	Workers int
 
 	// golden is the "golden" track data for this
 	// Library. Does not include id3v2 header.
 	golden []byte
+	// goldenHash is the FNV-1a hash of golden.
+	goldenHash uint64
+
+	// mu guards edits, so songs can be edited while other goroutines read
+	// the library, e.g. while it is served by the web package.
+	mu sync.RWMutex
+	// edits are changes made to individual songs with SetTag, SetPath,
+	// SetModTime and Remove, by index.
+	edits map[int]*edit
 }
 
-// PathAt returns the path to the idx-th song in the library.
+// PathAt returns the path to the idx-th song in the library, as generated by
+// the library's Pather, or set with SetPath. The returned path is not
+// guaranteed to be unique, use Paths to generate collision-free paths for the
+// whole library.
 func (l *Library) PathAt(idx int) (string, error) {
-	if idx < 0 || idx > (l.Tracks-1) {
-		return "", fmt.Errorf("index %d out of range [0, %d)", idx, l.Tracks)
+	tag, err := l.TagAt(idx)
+	if err != nil {
+		return "", err
+	}
+	return l.pathOf(idx, tag), nil
+}
+
+// pathOf returns the path of the idx-th song, whose tag is `tag`.
+func (l *Library) pathOf(idx int, tag *id3v2.Tag) string {
+	if e := l.editOf(idx); e.path != "" {
+		return e.path
+	}
+	return l.Pather(idx, tag)
+}
+
+// encodeTag encodes `tag` like tag.WriteTo, but with its frames in a stable
+// order, so the same tag is always encoded to the same bytes. tag.WriteTo
+// writes frames in map order, which changes every time.
+func encodeTag(tag *id3v2.Tag) ([]byte, error) {
+	all := tag.AllFrames()
+	ids := make([]string, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	synchsafe := tag.Version() == 4
+	putSize := func(n int, synchsafe bool) {
+		var size [4]byte
+		if synchsafe {
+			putSynchsafe(size[:], uint32(n))
+		} else {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+		}
+		buf.Write(size[:])
 	}
 
-	return l.Pather(idx, l.Tagger(idx)), nil
+	// Tags without frames are not written at all, like tag.WriteTo.
+	if tag.Size() == 0 {
+		return nil, nil
+	}
+	buf.WriteString("ID3")
+	buf.Write([]byte{tag.Version(), 0, 0})
+	putSize(tag.Size()-tagHeaderSize, true)
+	for _, id := range ids {
+		// Copy the frames before sorting, since AllFrames returns the tag's
+		// own slices, which may be shared between songs and goroutines.
+		frames := append([]id3v2.Framer(nil), all[id]...)
+		sort.SliceStable(frames, func(i, j int) bool {
+			return frames[i].UniqueIdentifier() < frames[j].UniqueIdentifier()
+		})
+		for _, f := range frames {
+			buf.WriteString(id)
+			putSize(f.Size(), synchsafe)
+			buf.Write([]byte{0, 0})
+			if _, err := f.WriteTo(&buf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// encodedTagAt returns the encoded tag of the idx-th song, from the TagCache
+// if possible. Tags set with SetTag are never cached. `tag` is the song's
+// tag if it was already generated, or nil.
+func (l *Library) encodedTagAt(idx int, tag *id3v2.Tag) ([]byte, error) {
+	if err := l.checkIndex(idx); err != nil {
+		return nil, err
+	}
+	cache := l.TagCache
+	if e := l.editOf(idx); e.tag != nil {
+		cache = nil
+	}
+	if cache != nil {
+		if encoded, ok := cache.Get(idx); ok {
+			return encoded, nil
+		}
+	}
+
+	if tag == nil {
+		var err error
+		if tag, err = l.TagAt(idx); err != nil {
+			return nil, err
+		}
+	}
+	encoded, err := encodeTag(tag)
+	if err != nil {
+		log.Fatalf("error writing id3v2 header to buffer: %v", err)
+	}
+	if cache != nil {
+		cache.Add(idx, encoded)
+	}
+	return encoded, nil
 }
 
 // SongAt returns the song at the idx-th spot in the library.
 func (l *Library) SongAt(idx int) (Song, error) {
-	if idx < 0 || idx > (l.Tracks-1) {
-		return Song{}, fmt.Errorf("index %d out of range [0, %d)", idx, l.Tracks)
+	return l.songAt(idx, nil)
+}
+
+// songAt returns the song at the idx-th spot in the library. `tag` is the
+// song's tag if it was already generated, or nil.
+func (l *Library) songAt(idx int, tag *id3v2.Tag) (Song, error) {
+	encoded, err := l.encodedTagAt(idx, tag)
+	if err != nil {
+		return Song{}, err
+	}
+	if l.TagCorrupter != nil {
+		encoded = l.TagCorrupter(idx, encoded)
 	}
 
-	tag := l.Tagger(idx)
+	song := Song{tag: encoded, data: l.golden, modTime: l.modTimeAt(idx), audioHash: l.goldenHash}
+	if l.AudioCorrupter != nil {
+		audio := l.AudioCorrupter(idx, l.golden)
+		song.data, song.patch, song.patchAt = audio.Data, audio.Patch, int64(audio.PatchAt)
+		song.audioHash = l.audioHash(audio)
+		if len(song.data) == 0 {
+			song.tag = nil
+		}
+	}
+	return song, nil
+}
 
-	var buf bytes.Buffer
-	if _, err := tag.WriteTo(&buf); err != nil {
-		log.Fatalf("error writing id3v2 header to buffer: %v", err)
+// audioHash returns a hash of the data of `audio`. The golden data, and
+// prefixes of it, are never read. Other data is only read if audio.Hash is
+// not set.
+func (l *Library) audioHash(audio Audio) uint64 {
+	data := audio.Data
+	switch {
+	case audio.Hash != 0:
+		return audio.Hash
+	case len(data) == 0:
+		return 0
+	case len(l.golden) > 0 && &data[0] == &l.golden[0]:
+		if len(data) == len(l.golden) {
+			return l.goldenHash
+		}
+		return splitmix64(l.goldenHash ^ splitmix64(uint64(len(data))))
 	}
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// ModTimeAt returns the modification time of the idx-th song, like
+// SongAt(idx).ModTime(), but without generating the song. It is the zero
+// time if the song has none.
+func (l *Library) ModTimeAt(idx int) time.Time {
+	return l.modTimeAt(idx)
+}
 
-	return Song{tag: buf.Bytes(), data: l.golden}, nil
+// modTimeAt returns the modification time of the idx-th song, without
+// generating the rest of the song.
+func (l *Library) modTimeAt(idx int) time.Time {
+	if e := l.editOf(idx); !e.modTime.IsZero() {
+		return e.modTime
+	}
+	if l.Timestamper != nil {
+		return l.Timestamper(idx)
+	}
+	return time.Time{}
 }
 
 // New returns a new Library that uses Golden data read from the given golden
@@ -265,13 +528,17 @@ func New(golden io.ReadSeeker) (*Library, error) {
 		return nil, err
 	}
 
+	h := fnv.New64a()
+	h.Write(data)
+
 	return &Library{
 		Tracks: 1000,
 		Tagger: RepeatedLetters{
 			TracksPerAlbum:  10,
 			AlbumsPerArtist: 3,
 		}.Tag,
-		Pather: ArtistAlbumTitle,
-		golden: data,
+		Pather:     ArtistAlbumTitle,
+		golden:     data,
+		goldenHash: h.Sum64(),
 	}, nil
 }
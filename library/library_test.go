@@ -2,6 +2,8 @@ package library
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"log"
 	"testing"
 
@@ -290,3 +292,118 @@ func TestEmbeddedGoldMP3(t *testing.T) {
 		}
 	}
 }
+
+func TestSongAtStable(t *testing.T) {
+	first, err := testLibrary.SongAt(0)
+	if err != nil {
+		t.Fatalf("testLibrary.SongAt(0) = _, %v; want _, nil", err)
+	}
+	// Tags are encoded from maps, so repeat a few times to catch any
+	// dependence on map order.
+	for i := 0; i < 20; i++ {
+		again, err := testLibrary.SongAt(0)
+		if err != nil {
+			t.Fatalf("testLibrary.SongAt(0) = _, %v; want _, nil", err)
+		}
+		if !bytes.Equal(again.tag, first.tag) {
+			t.Fatalf("testLibrary.SongAt(0) tag changed between calls:\n%q\n%q", first.tag, again.tag)
+		}
+	}
+}
+
+func TestSongHash(t *testing.T) {
+	lib, err := New(EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("failed to load library: %v", err)
+	}
+	lib.Tracks = 10
+	hashes := make(map[uint64]string)
+	add := func(name string, song Song) {
+		t.Helper()
+		if other, ok := hashes[song.Hash()]; ok {
+			t.Errorf("%s has the same hash as %s", name, other)
+		}
+		hashes[song.Hash()] = name
+	}
+	for idx := 0; idx < 3; idx++ {
+		song, err := lib.SongAt(idx)
+		if err != nil {
+			t.Fatalf("lib.SongAt(%d) = _, %v; want _, nil", idx, err)
+		}
+		if again, _ := lib.SongAt(idx); again.Hash() != song.Hash() {
+			t.Errorf("Song %d has hash %x, then %x", idx, song.Hash(), again.Hash())
+		}
+		add(fmt.Sprintf("song %d", idx), song)
+	}
+	for _, kind := range AllAudioCorruptions {
+		lib.AudioCorrupter = (&CorruptAudio{Rate: 1, Kinds: []AudioCorruption{kind}}).Corrupt
+		song, err := lib.SongAt(0)
+		if err != nil {
+			t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+		}
+		add(fmt.Sprintf("song 0 with %v", kind), song)
+	}
+}
+
+func TestSongReadAt(t *testing.T) {
+	song := Song{tag: []byte("tag"), data: []byte("audio")}
+	for _, test := range []struct {
+		off     int64
+		size    int
+		want    string
+		wantErr error
+	}{
+		{off: 0, size: 8, want: "tagaudio"},
+		{off: 0, size: 2, want: "ta"},
+		{off: 1, size: 4, want: "agau"},
+		{off: 3, size: 5, want: "audio"},
+		{off: 5, size: 10, want: "dio", wantErr: io.EOF},
+		{off: 8, size: 1, want: "", wantErr: io.EOF},
+		{off: 100, size: 1, want: "", wantErr: io.EOF},
+	} {
+		buf := make([]byte, test.size)
+		n, err := song.ReadAt(buf, test.off)
+		if got := string(buf[:n]); got != test.want || err != test.wantErr {
+			t.Errorf("song.ReadAt(<%d bytes>, %d) = %q, %v; want %q, %v", test.size, test.off, got, err, test.want, test.wantErr)
+		}
+	}
+	if _, err := song.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Errorf("song.ReadAt(_, -1) = _, nil; want an error")
+	}
+
+	r := song.Reader()
+	if _, err := r.Seek(2, io.SeekStart); err != nil {
+		t.Fatalf("r.Seek(2, io.SeekStart) = _, %v; want _, nil", err)
+	}
+	if got, err := io.ReadAll(r); string(got) != "gaudio" || err != nil {
+		t.Errorf("io.ReadAll(r) after seek = %q, %v; want \"gaudio\", nil", got, err)
+	}
+}
+
+func TestSongHashReusedAudio(t *testing.T) {
+	lib, err := New(EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("failed to load library: %v", err)
+	}
+	// A custom AudioFunc may reuse a buffer with new contents, which must
+	// change the hash.
+	buf := make([]byte, 16)
+	lib.AudioCorrupter = func(idx int, _ []byte) Audio {
+		buf[0] = byte(idx)
+		return Audio{Data: buf}
+	}
+	first, err := lib.SongAt(0)
+	if err != nil {
+		t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+	}
+	firstHash := first.Hash()
+	second, err := lib.SongAt(1)
+	if err != nil {
+		t.Fatalf("lib.SongAt(1) = _, %v; want _, nil", err)
+	}
+	// Give both songs the same tag, so only the audio differs.
+	second.tag = first.tag
+	if second.Hash() == firstHash {
+		t.Errorf("Songs with different audio in the same buffer have the same hash %x", firstHash)
+	}
+}
@@ -0,0 +1,64 @@
+package library
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// chunkSize is the number of consecutive indices handed to a worker at once,
+// so workers don't contend on every index.
+const chunkSize = 256
+
+// forEach calls `fn` for every index in [lo, hi), on up to `workers`
+// goroutines. The first error returned by `fn` stops the remaining calls,
+// and is returned.
+func forEach(lo, hi, workers int, fn func(idx int) error) error {
+	if workers <= 1 || hi-lo <= chunkSize {
+		for idx := lo; idx < hi; idx++ {
+			if err := fn(idx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		next   = int64(lo)
+		failed atomic.Bool
+		once   sync.Once
+		first  error
+		wg     sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !failed.Load() {
+				start := int(atomic.AddInt64(&next, chunkSize)) - chunkSize
+				if start >= hi {
+					return
+				}
+				end := min(start+chunkSize, hi)
+				for idx := start; idx < end; idx++ {
+					if err := fn(idx); err != nil {
+						once.Do(func() { first = err })
+						failed.Store(true)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return first
+}
+
+// SongsAt fills `songs` with the songs at indices lo, lo+1, and so on, like
+// SongAt. The songs are generated on up to Workers goroutines.
+func (l *Library) SongsAt(lo int, songs []Song) error {
+	return forEach(lo, lo+len(songs), l.Workers, func(idx int) error {
+		song, err := l.SongAt(idx)
+		songs[idx-lo] = song
+		return err
+	})
+}
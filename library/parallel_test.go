@@ -0,0 +1,102 @@
+package library
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bogem/id3v2/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestForEach(t *testing.T) {
+	for _, workers := range []int{0, 1, 8} {
+		var calls [5000]int32
+		err := forEach(10, len(calls), workers, func(idx int) error {
+			atomic.AddInt32(&calls[idx], 1)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("forEach(workers=%d) = %v; want nil", workers, err)
+		}
+		for idx, n := range calls {
+			want := int32(1)
+			if idx < 10 {
+				want = 0
+			}
+			if n != want {
+				t.Errorf("forEach(workers=%d) called fn(%d) %d times; want %d", workers, idx, n, want)
+			}
+		}
+
+		wantErr := errors.New("failed")
+		err = forEach(0, len(calls), workers, func(idx int) error {
+			if idx == 1234 {
+				return wantErr
+			}
+			return nil
+		})
+		if err != wantErr {
+			t.Errorf("forEach(workers=%d) with a failing fn = %v; want %v", workers, err, wantErr)
+		}
+	}
+}
+
+// pathsOf returns every path in `m`, by index.
+func pathsOf(m *PathMap) []string {
+	out := make([]string, m.Len())
+	for idx := range out {
+		out[idx], _ = m.PathAt(idx)
+	}
+	return out
+}
+
+func TestParallelPaths(t *testing.T) {
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 20000
+	lib.Collisions = CollisionSuffixCount
+	// Every tenth song collides with the one before it, so collisions must
+	// be resolved in index order.
+	lib.Pather = func(idx int, _ *id3v2.Tag) string {
+		if idx%10 == 9 {
+			idx--
+		}
+		return fmt.Sprintf("%d/%d.mp3", idx/100, idx)
+	}
+	lib.Remove(42)
+
+	want, err := lib.Paths()
+	if err != nil {
+		t.Fatalf("lib.Paths() = _, %v; want _, nil", err)
+	}
+	lib.Workers = 8
+	got, err := lib.Paths()
+	if err != nil {
+		t.Fatalf("lib.Paths() with 8 workers = _, %v; want _, nil", err)
+	}
+	if diff := cmp.Diff(pathsOf(want), pathsOf(got)); diff != "" {
+		t.Errorf("lib.Paths() with 8 workers differs from 1 worker (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want.Collisions(), got.Collisions()); diff != "" {
+		t.Errorf("lib.Paths().Collisions() with 8 workers differs from 1 worker (-want +got):\n%s", diff)
+	}
+
+	songs := make([]Song, 1000)
+	if err := lib.SongsAt(5000, songs); err != nil {
+		t.Fatalf("lib.SongsAt(5000) = %v; want nil", err)
+	}
+	for i, got := range songs {
+		want, _ := lib.SongAt(5000 + i)
+		if !bytes.Equal(got.tag, want.tag) {
+			t.Errorf("lib.SongsAt(5000)[%d] has tag %q; want %q", i, got.tag, want.tag)
+		}
+	}
+	if err := lib.SongsAt(lib.Tracks-1, songs); err == nil {
+		t.Errorf("lib.SongsAt() past the end = nil; want an error")
+	}
+}
@@ -0,0 +1,419 @@
+package library
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CollisionStrategy determines how a Library handles two songs that are
+// assigned the same path by its Pather.
+type CollisionStrategy int
+
+const (
+	// CollisionError causes Library.Paths to fail if any two songs share a
+	// path, or if a song's path is also used as a directory.
+	CollisionError CollisionStrategy = iota
+	// CollisionSuffixCount renames colliding songs by adding a counter to
+	// the colliding path component, like a file manager would. E.g., the
+	// second song at "A/B.mp3" becomes "A/B (2).mp3".
+	CollisionSuffixCount
+	// CollisionSuffixIndex renames colliding songs by adding the song's
+	// index to the colliding path component. E.g., if song 42 collides
+	// at "A/B.mp3" it becomes "A/B [42].mp3".
+	CollisionSuffixIndex
+)
+
+func (c CollisionStrategy) String() string {
+	switch c {
+	case CollisionError:
+		return "error"
+	case CollisionSuffixCount:
+		return "count"
+	case CollisionSuffixIndex:
+		return "index"
+	}
+	return fmt.Sprintf("CollisionStrategy(%d)", int(c))
+}
+
+// ParseCollisionStrategy returns the strategy with the given name, as
+// returned by CollisionStrategy.String.
+func ParseCollisionStrategy(name string) (CollisionStrategy, error) {
+	for _, c := range []CollisionStrategy{CollisionError, CollisionSuffixCount, CollisionSuffixIndex} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown collision strategy %q, want one of error, count, index", name)
+}
+
+// Collision records a song whose generated path was already taken, and the
+// path it was moved to.
+type Collision struct {
+	// Index is the index of the song that was moved.
+	Index int
+	// Path is the path originally generated for the song.
+	Path string
+	// Resolved is the path the song was actually given.
+	Resolved string
+}
+
+// PathMap is the collision-free mapping between song indices and paths in a
+// library. Unlike Library.PathAt, every path in a PathMap is unique, and no
+// song path is also used as a directory. It is created with Library.Paths, or
+// Library.SongPaths.
+type PathMap struct {
+	strategy CollisionStrategy
+
+	paths []string
+	// children are the names of the entries in each directory, mapped to
+	// the index of the song, or -1 for directories. The root is ".". Only
+	// directories with entries are in the map.
+	children map[string]map[string]int
+	// songs is the number of songs in the map.
+	songs      int
+	collisions []Collision
+}
+
+// Paths generates the path of every song in the library, and resolves any
+// collisions according to the library's Collisions strategy. Songs with a
+// lower index keep their generated path when a collision occurs. Songs that
+// have been removed from the library are skipped.
+func (l *Library) Paths() (*PathMap, error) {
+	return l.paths(nil)
+}
+
+// SongPaths is like Paths, but also generates every song from the same tag
+// as its path, and calls `fn` with each song and its collision-free path, in
+// index order. Use it instead of Paths followed by SongAt to generate each
+// tag once.
+func (l *Library) SongPaths(fn func(idx int, p string, song Song) error) (*PathMap, error) {
+	return l.paths(fn)
+}
+
+// paths implements Paths and SongPaths. Songs are only generated if `fn` is
+// set.
+func (l *Library) paths(fn func(idx int, p string, song Song) error) (*PathMap, error) {
+	m := &PathMap{
+		strategy: l.Collisions,
+		paths:    make([]string, l.Tracks),
+		children: make(map[string]map[string]int),
+	}
+	// Paths are generated in parallel, a batch at a time, but collisions
+	// must be resolved in index order.
+	n := min(l.Tracks, max(l.Workers, 1)*chunkSize*16)
+	batch := make([]string, n)
+	var songs []Song
+	if fn != nil {
+		songs = make([]Song, n)
+	}
+	for lo := 0; lo < l.Tracks; lo += len(batch) {
+		paths := batch[:min(len(batch), l.Tracks-lo)]
+		err := forEach(lo, lo+len(paths), l.Workers, func(idx int) error {
+			if l.Removed(idx) {
+				paths[idx-lo] = ""
+				return nil
+			}
+			tag, err := l.TagAt(idx)
+			if err != nil {
+				return err
+			}
+			paths[idx-lo] = l.pathOf(idx, tag)
+			if fn != nil {
+				songs[idx-lo], err = l.songAt(idx, tag)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i, p := range paths {
+			if l.Removed(lo + i) {
+				continue
+			}
+			if err := m.add(lo+i, p); err != nil {
+				return nil, err
+			}
+			if fn == nil {
+				continue
+			}
+			if err := fn(lo+i, m.paths[lo+i], songs[i]); err != nil {
+				return nil, err
+			}
+			// Don't keep the song alive until the batch is reused.
+			songs[i] = Song{}
+		}
+	}
+	return m, nil
+}
+
+// entry returns the index of the song at `p`, or -1 if `p` is a directory,
+// and whether `p` exists.
+func (m *PathMap) entry(p string) (int, bool) {
+	idx, ok := m.children[path.Dir(p)][path.Base(p)]
+	return idx, ok
+}
+
+// conflict returns the number of leading path components that conflict
+// with an existing song or directory, or 0 if `p` can be used as-is.
+// Conflicting parent directories are reported before the song itself.
+func (m *PathMap) conflict(components []string) int {
+	p := components[0]
+	for i := 1; i < len(components); i++ {
+		if idx, ok := m.entry(p); !ok {
+			// Nothing exists beneath a missing directory.
+			return 0
+		} else if idx >= 0 {
+			return i
+		}
+		p += "/" + components[i]
+	}
+	if _, ok := m.entry(p); ok {
+		return len(components)
+	}
+	return 0
+}
+
+func (m *PathMap) conflictError(idx int, p string, depth int) error {
+	at := strings.Join(strings.Split(p, "/")[:depth], "/")
+	if other, ok := m.entry(at); ok && other >= 0 {
+		return fmt.Errorf("path %q of song %d collides with song %d at %q", p, idx, other, at)
+	}
+	return fmt.Errorf("path %q of song %d collides with a directory", p, idx)
+}
+
+// suffixed inserts `suffix` into the path component `name`. For songs
+// (`isFile`) the suffix is placed before the extension.
+func suffixed(name, suffix string, isFile bool) string {
+	ext := path.Ext(name)
+	if !isFile || ext == name {
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + suffix + ext
+}
+
+func (m *PathMap) add(idx int, p string) error {
+	original := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if original == "" {
+		return fmt.Errorf("song %d has an empty path", idx)
+	}
+	originalComponents := strings.Split(original, "/")
+	components := append([]string(nil), originalComponents...)
+
+	var lastDepth, n int
+	for {
+		depth := m.conflict(components)
+		if depth == 0 {
+			break
+		}
+		if depth == lastDepth {
+			n++
+		} else {
+			lastDepth, n = depth, 2
+		}
+
+		var suffix string
+		switch m.strategy {
+		case CollisionSuffixCount:
+			suffix = " (" + strconv.Itoa(n) + ")"
+		case CollisionSuffixIndex:
+			suffix = " [" + strconv.Itoa(idx) + "]"
+			if n > 2 {
+				// The index suffix was taken too, so fall back to
+				// counting.
+				suffix += " (" + strconv.Itoa(n-1) + ")"
+			}
+		default:
+			return m.conflictError(idx, original, depth)
+		}
+		components[depth-1] = suffixed(originalComponents[depth-1], suffix, depth == len(components))
+	}
+
+	resolved := strings.Join(components, "/")
+	if resolved != original {
+		m.collisions = append(m.collisions, Collision{Index: idx, Path: original, Resolved: resolved})
+	}
+	m.paths[idx] = resolved
+	m.songs++
+	m.addChild(resolved, idx)
+	for dir := path.Dir(resolved); dir != "."; dir = path.Dir(dir) {
+		if _, ok := m.entry(dir); ok {
+			// The rest of the parents exist already.
+			break
+		}
+		m.addChild(dir, -1)
+	}
+	return nil
+}
+
+// addChild adds `p` to the entries of its parent directory.
+func (m *PathMap) addChild(p string, idx int) {
+	parent := path.Dir(p)
+	c := m.children[parent]
+	if c == nil {
+		c = make(map[string]int)
+		m.children[parent] = c
+	}
+	c[path.Base(p)] = idx
+}
+
+// removeChild removes `p` from the entries of its parent directory.
+func (m *PathMap) removeChild(p string) {
+	parent := path.Dir(p)
+	delete(m.children[parent], path.Base(p))
+	if len(m.children[parent]) == 0 {
+		delete(m.children, parent)
+	}
+}
+
+// Len returns the number of song indices in the map, including removed
+// songs.
+func (m *PathMap) Len() int {
+	return len(m.paths)
+}
+
+// Songs returns the number of songs in the map, excluding removed songs.
+func (m *PathMap) Songs() int {
+	return m.songs
+}
+
+// Dirs returns the number of directories in the map, excluding the root.
+func (m *PathMap) Dirs() int {
+	if _, ok := m.children["."]; ok {
+		return len(m.children) - 1
+	}
+	return len(m.children)
+}
+
+// PathAt returns the collision-free path of the idx-th song. If the song was
+// removed from the library, the returned error wraps ErrRemoved.
+func (m *PathMap) PathAt(idx int) (string, error) {
+	if idx < 0 || idx >= len(m.paths) {
+		return "", fmt.Errorf("index %d out of range [0, %d)", idx, len(m.paths))
+	}
+	if m.paths[idx] == "" {
+		return "", fmt.Errorf("song %d: %w", idx, ErrRemoved)
+	}
+	return m.paths[idx], nil
+}
+
+// Set updates the path of the idx-th song to `p`, growing the map if
+// needed. Collisions with other songs are resolved like in Library.Paths,
+// and the resolved path is returned.
+func (m *PathMap) Set(idx int, p string) (string, error) {
+	if idx < 0 {
+		return "", fmt.Errorf("invalid index %d", idx)
+	}
+	for idx >= len(m.paths) {
+		m.paths = append(m.paths, "")
+	}
+	old := m.paths[idx]
+	m.Delete(idx)
+	if err := m.add(idx, p); err != nil {
+		if old != "" {
+			// Restore the old path, which was collision-free before.
+			m.add(idx, old)
+		}
+		return "", err
+	}
+	return m.paths[idx], nil
+}
+
+// Delete removes the idx-th song from the map. Its index is kept, but
+// PathAt will report it as removed.
+func (m *PathMap) Delete(idx int) {
+	if idx < 0 || idx >= len(m.paths) || m.paths[idx] == "" {
+		return
+	}
+	p := m.paths[idx]
+	m.songs--
+	m.removeChild(p)
+	// Remove the directories left empty.
+	for dir := path.Dir(p); dir != "." && m.children[dir] == nil; dir = path.Dir(dir) {
+		m.removeChild(dir)
+	}
+	m.paths[idx] = ""
+
+	collisions := m.collisions[:0]
+	for _, c := range m.collisions {
+		if c.Index != idx {
+			collisions = append(collisions, c)
+		}
+	}
+	m.collisions = collisions
+}
+
+// Truncate removes all songs with an index >= n from the map, and shrinks
+// it to Len() == n.
+func (m *PathMap) Truncate(n int) {
+	for idx := n; idx < len(m.paths); idx++ {
+		m.Delete(idx)
+	}
+	if n < len(m.paths) {
+		m.paths = m.paths[:n]
+	}
+}
+
+// Index returns the index of the song at path `p`, and whether a song exists
+// at that path.
+func (m *PathMap) Index(p string) (int, bool) {
+	idx, ok := m.entry(path.Clean(p))
+	return idx, ok && idx >= 0
+}
+
+// Collisions returns every song that was moved away from its generated path,
+// in index order.
+func (m *PathMap) Collisions() []Collision {
+	return append([]Collision(nil), m.collisions...)
+}
+
+// cleanPath cleans a path relative to the library root. The root is ".".
+func cleanPath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// Entry is an entry in a directory of a PathMap.
+type Entry struct {
+	// Name is the name of the entry in its directory.
+	Name string
+	// Index is the index of the song, or -1 if the entry is a directory.
+	Index int
+}
+
+// IsDir returns true if the entry is a directory.
+func (e Entry) IsDir() bool {
+	return e.Index < 0
+}
+
+// IsDir returns true if `p` is a directory containing songs. The root ("" or
+// ".") is always a directory, even if the library is empty.
+func (m *PathMap) IsDir(p string) bool {
+	p = cleanPath(p)
+	if p == "." {
+		return true
+	}
+	_, ok := m.children[p]
+	return ok
+}
+
+// ReadDir returns the entries of the directory `dir`, sorted by name. An
+// error is returned if `dir` is not a directory.
+func (m *PathMap) ReadDir(dir string) ([]Entry, error) {
+	dir = cleanPath(dir)
+	if !m.IsDir(dir) {
+		return nil, fmt.Errorf("%q is not a directory", dir)
+	}
+	c := m.children[dir]
+	entries := make([]Entry, 0, len(c))
+	for name, idx := range c {
+		entries = append(entries, Entry{Name: name, Index: idx})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
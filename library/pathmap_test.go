@@ -0,0 +1,229 @@
+package library
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bogem/id3v2/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+func collidingLibrary(t *testing.T, strategy CollisionStrategy, paths ...string) *Library {
+	t.Helper()
+
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = len(paths)
+	lib.Tagger = func(int) *id3v2.Tag { return id3v2.NewEmptyTag() }
+	lib.Pather = func(idx int, _ *id3v2.Tag) string { return paths[idx] }
+	lib.Collisions = strategy
+	return lib
+}
+
+func TestPathsNoCollisions(t *testing.T) {
+	m, err := testLibrary.Paths()
+	if err != nil {
+		t.Fatalf("testLibrary.Paths() = _, %v; want _, nil", err)
+	}
+	if m.Len() != testLibrary.Tracks {
+		t.Errorf("testLibrary.Paths().Len() = %d, want %d", m.Len(), testLibrary.Tracks)
+	}
+	for _, test := range libraryTests {
+		got, err := m.PathAt(test.idx)
+		if err != nil {
+			t.Errorf("m.PathAt(%d) = _, %v; want _, nil", test.idx, err)
+			continue
+		}
+		if got != test.wantLocation {
+			t.Errorf("m.PathAt(%d) = %q, want %q", test.idx, got, test.wantLocation)
+		}
+		if idx, ok := m.Index(test.wantLocation); !ok || idx != test.idx {
+			t.Errorf("m.Index(%q) = %d, %v; want %d, true", test.wantLocation, idx, ok, test.idx)
+		}
+	}
+	if c := m.Collisions(); len(c) != 0 {
+		t.Errorf("m.Collisions() = %v, want none", c)
+	}
+}
+
+func TestPathsCollisionError(t *testing.T) {
+	for _, paths := range [][]string{
+		{"A/B.mp3", "A/B.mp3"},
+		{"A/B.mp3", "A/B.mp3/C.mp3"},
+		{"A/B.mp3/C.mp3", "A/B.mp3"},
+		{"A.mp3", ""},
+	} {
+		lib := collidingLibrary(t, CollisionError, paths...)
+		if _, err := lib.Paths(); err == nil {
+			t.Errorf("Paths() with paths %q = _, nil; want _, <error>", paths)
+		}
+	}
+}
+
+func TestPathsCollisionSuffix(t *testing.T) {
+	tests := []struct {
+		strategy CollisionStrategy
+		paths    []string
+		want     []string
+	}{
+		{
+			strategy: CollisionSuffixCount,
+			paths:    []string{"A/B.mp3", "A/B.mp3", "A/B.mp3", "A/C.mp3"},
+			want:     []string{"A/B.mp3", "A/B (2).mp3", "A/B (3).mp3", "A/C.mp3"},
+		},
+		{
+			strategy: CollisionSuffixIndex,
+			paths:    []string{"A/B.mp3", "A/B.mp3", "A/B.mp3"},
+			want:     []string{"A/B.mp3", "A/B [1].mp3", "A/B [2].mp3"},
+		},
+		{
+			strategy: CollisionSuffixCount,
+			// A song in place of a directory, and a directory in place of
+			// a song.
+			paths: []string{"A/B.mp3", "A", "A/B.mp3/C.mp3"},
+			want:  []string{"A/B.mp3", "A (2)", "A/B.mp3 (2)/C.mp3"},
+		},
+		{
+			strategy: CollisionSuffixCount,
+			// The suffixed path is also taken.
+			paths: []string{"B (2).mp3", "B.mp3", "B.mp3"},
+			want:  []string{"B (2).mp3", "B.mp3", "B (3).mp3"},
+		},
+	}
+
+	for _, test := range tests {
+		m, err := collidingLibrary(t, test.strategy, test.paths...).Paths()
+		if err != nil {
+			t.Errorf("Paths() with strategy %v, paths %q = _, %v; want _, nil", test.strategy, test.paths, err)
+			continue
+		}
+		var got []string
+		for i := 0; i < m.Len(); i++ {
+			p, _ := m.PathAt(i)
+			got = append(got, p)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("Paths() with strategy %v, paths %q had unexpected diff (want -> got):\n%s", test.strategy, test.paths, diff)
+		}
+	}
+}
+
+func TestPathsCollisions(t *testing.T) {
+	m, err := collidingLibrary(t, CollisionSuffixCount, "A.mp3", "B.mp3", "A.mp3").Paths()
+	if err != nil {
+		t.Fatalf("Paths() = _, %v; want _, nil", err)
+	}
+	want := []Collision{{Index: 2, Path: "A.mp3", Resolved: "A (2).mp3"}}
+	if diff := cmp.Diff(want, m.Collisions()); diff != "" {
+		t.Errorf("m.Collisions() had unexpected diff (want -> got):\n%s", diff)
+	}
+	if idx, ok := m.Index("A (2).mp3"); !ok || idx != 2 {
+		t.Errorf(`m.Index("A (2).mp3") = %d, %v; want 2, true`, idx, ok)
+	}
+}
+
+func TestPathMapReadDir(t *testing.T) {
+	lib := collidingLibrary(t, CollisionError, "A/B/1.mp3", "A/B/2.mp3", "A/C.mp3", "D.mp3")
+	m, err := lib.Paths()
+	if err != nil {
+		t.Fatalf("lib.Paths() = _, %v; want _, nil", err)
+	}
+
+	for _, test := range []struct {
+		dir  string
+		want []Entry
+	}{
+		{"", []Entry{{"A", -1}, {"D.mp3", 3}}},
+		{"/", []Entry{{"A", -1}, {"D.mp3", 3}}},
+		{"A", []Entry{{"B", -1}, {"C.mp3", 2}}},
+		{"A/B/", []Entry{{"1.mp3", 0}, {"2.mp3", 1}}},
+	} {
+		got, err := m.ReadDir(test.dir)
+		if err != nil {
+			t.Errorf("m.ReadDir(%q) = _, %v; want _, nil", test.dir, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("m.ReadDir(%q) diff (want -> got):\n%s", test.dir, diff)
+		}
+	}
+	if m.Songs() != 4 || m.Dirs() != 2 {
+		t.Errorf("m.Songs(), m.Dirs() = %d, %d; want 4, 2", m.Songs(), m.Dirs())
+	}
+	for _, p := range []string{"D.mp3", "A/B/1.mp3", "X"} {
+		if m.IsDir(p) {
+			t.Errorf("m.IsDir(%q) = true, want false", p)
+		}
+		if _, err := m.ReadDir(p); err == nil {
+			t.Errorf("m.ReadDir(%q) = _, nil; want error", p)
+		}
+	}
+
+	// Removing the last song in a directory removes the directory too.
+	m.Delete(0)
+	m.Delete(1)
+	if m.IsDir("A/B") {
+		t.Errorf("m.IsDir(\"A/B\") = true after removing all of its songs, want false")
+	}
+	if got, _ := m.ReadDir("A"); len(got) != 1 || got[0].Name != "C.mp3" {
+		t.Errorf("m.ReadDir(\"A\") = %v after removing A/B, want only C.mp3", got)
+	}
+	if m.Songs() != 2 || m.Dirs() != 1 || m.Len() != 4 {
+		t.Errorf("m.Songs(), m.Dirs(), m.Len() = %d, %d, %d after removing A/B; want 2, 1, 4", m.Songs(), m.Dirs(), m.Len())
+	}
+}
+
+func TestSongPaths(t *testing.T) {
+	lib, err := New(EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 2000
+	lib.Workers = 4
+	lib.Remove(3)
+	var tagged [2000]atomic.Int32
+	tagger := lib.Tagger
+	lib.Tagger = func(idx int) *id3v2.Tag {
+		tagged[idx].Add(1)
+		return tagger(idx)
+	}
+
+	got := make(map[int]Song)
+	gotPaths := make(map[int]string)
+	last := -1
+	m, err := lib.SongPaths(func(idx int, p string, song Song) error {
+		if idx <= last {
+			t.Errorf("SongPaths called fn with song %d after song %d", idx, last)
+		}
+		last = idx
+		got[idx], gotPaths[idx] = song, p
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("lib.SongPaths(...) = _, %v; want _, nil", err)
+	}
+	if m.Songs() != lib.Tracks-1 || len(got) != lib.Tracks-1 {
+		t.Errorf("lib.SongPaths(...) had %d songs, and called fn %d times; want %d", m.Songs(), len(got), lib.Tracks-1)
+	}
+	for idx := range tagged {
+		want := int32(1)
+		if idx == 3 {
+			want = 0
+		}
+		if n := tagged[idx].Load(); n != want {
+			t.Errorf("Tagger was called %d times for song %d, want %d", n, idx, want)
+		}
+	}
+
+	for idx, song := range got {
+		if want, _ := m.PathAt(idx); gotPaths[idx] != want {
+			t.Errorf("SongPaths called fn with song %d at %q, want %q", idx, gotPaths[idx], want)
+		}
+		if want, _ := lib.SongAt(idx); song.Hash() != want.Hash() {
+			t.Errorf("SongPaths called fn with song %d, which differs from lib.SongAt(%d)", idx, idx)
+		}
+	}
+}
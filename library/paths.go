@@ -0,0 +1,107 @@
+package library
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+// The path functions in this file generate layouts that only depend on the
+// song's index, not its tag. They are useful for stressing how consumers
+// handle directory structure (readdir size, path length, recursion depth)
+// independently of the metadata in the library.
+
+// Flat implements PathFunc. Every song is placed in the root of the library,
+// named after its index, e.g. "00000042.mp3".
+func Flat(index int, _ *id3v2.Tag) string {
+	return fmt.Sprintf("%08d.mp3", index)
+}
+
+// Nested implements a PathFunc that places songs in a deeply nested tree.
+// Every song is placed Depth directories deep, and each directory below the
+// top level holds at most Fanout entries. Directory names are the digits of
+// the song's index in base Fanout, so with Depth = 3 and Fanout = 10, song
+// 1234 is located at:
+//
+//	1/2/3/1234.mp3
+//
+// With a small Fanout and a large Depth (e.g. 20+) this produces very long
+// paths, and long chains of single-entry directories for small libraries.
+type Nested struct {
+	// Number of directories above each song. Zero (or less) yields a flat
+	// library.
+	Depth int
+	// Maximum number of entries in each directory. Defaults to 10 if unset.
+	Fanout int
+}
+
+// Path implements PathFunc.
+func (n Nested) Path(index int, _ *id3v2.Tag) string {
+	fanout := n.Fanout
+	if fanout < 2 {
+		fanout = 10
+	}
+
+	depth := n.Depth
+	if depth < 0 {
+		depth = 0
+	}
+
+	components := make([]string, depth+1)
+	components[depth] = strconv.Itoa(index) + ".mp3"
+	rest := index / fanout
+	for i := depth - 1; i >= 0; i-- {
+		if i == 0 {
+			// The top level absorbs any overflow, so large libraries still
+			// have unique paths.
+			components[i] = strconv.Itoa(rest)
+			break
+		}
+		components[i] = strconv.Itoa(rest % fanout)
+		rest /= fanout
+	}
+	return path.Join(components...)
+}
+
+// HashSharded implements a PathFunc that places songs in a content-addressed
+// style layout, like the ones used by git or many object stores. Each song is
+// named after the hex SHA-1 hash of its index, and sharded into Levels
+// directories using consecutive Width character prefixes of that hash. E.g.
+// with Levels = 2 and Width = 2:
+//
+//	b6/58/b6589fc6ab0dc82cf12099d1c2d40ab994e8410c.mp3
+type HashSharded struct {
+	// Number of shard directories above each song. Zero yields a flat
+	// library.
+	Levels int
+	// Number of hash characters used for each shard directory. Defaults to
+	// 2 if unset.
+	Width int
+}
+
+// Path implements PathFunc.
+func (h HashSharded) Path(index int, _ *id3v2.Tag) string {
+	width := h.Width
+	if width < 1 {
+		width = 2
+	}
+
+	sum := sha1.Sum([]byte(strconv.Itoa(index)))
+	name := hex.EncodeToString(sum[:])
+
+	components := make([]string, 0, h.Levels+1)
+	for i := 0; i < h.Levels; i++ {
+		start := (i * width) % len(name)
+		end := start + width
+		if end > len(name) {
+			end = len(name)
+		}
+		components = append(components, name[start:end])
+	}
+	components = append(components, name+".mp3")
+	return path.Join(components...)
+}
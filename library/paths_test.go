@@ -0,0 +1,59 @@
+package library
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIndexLayouts(t *testing.T) {
+	tests := []struct {
+		name   string
+		pather PathFunc
+		idx    int
+		want   string
+	}{
+		{name: "Flat", pather: Flat, idx: 42, want: "00000042.mp3"},
+		{name: "Nested{}", pather: Nested{}.Path, idx: 42, want: "42.mp3"},
+		{name: "Nested{3, 10}", pather: Nested{Depth: 3, Fanout: 10}.Path, idx: 1234, want: "1/2/3/1234.mp3"},
+		{name: "Nested{2, 2}", pather: Nested{Depth: 2, Fanout: 2}.Path, idx: 5, want: "1/0/5.mp3"},
+		{name: "Nested{1, 10}", pather: Nested{Depth: 1, Fanout: 10}.Path, idx: 1234, want: "123/1234.mp3"},
+		{name: "Nested{-1, 10}", pather: Nested{Depth: -1, Fanout: 10}.Path, idx: 42, want: "42.mp3"},
+		{name: "HashSharded{}", pather: HashSharded{}.Path, idx: 0, want: "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c.mp3"},
+		{name: "HashSharded{2, 2}", pather: HashSharded{Levels: 2, Width: 2}.Path, idx: 0, want: "b6/58/b6589fc6ab0dc82cf12099d1c2d40ab994e8410c.mp3"},
+		{name: "HashSharded{1, 3}", pather: HashSharded{Levels: 1, Width: 3}.Path, idx: 0, want: "b65/b6589fc6ab0dc82cf12099d1c2d40ab994e8410c.mp3"},
+	}
+
+	for _, test := range tests {
+		if got := test.pather(test.idx, nil); got != test.want {
+			t.Errorf("%s(%d) = %q, want %q", test.name, test.idx, got, test.want)
+		}
+	}
+}
+
+func TestIndexLayoutsUnique(t *testing.T) {
+	pathers := map[string]PathFunc{
+		"Flat":              Flat,
+		"Nested{20, 2}":     Nested{Depth: 20, Fanout: 2}.Path,
+		"Nested{2, 3}":      Nested{Depth: 2, Fanout: 3}.Path,
+		"HashSharded{2, 2}": HashSharded{Levels: 2, Width: 2}.Path,
+	}
+
+	for name, pather := range pathers {
+		seen := make(map[string]int)
+		for i := 0; i < 10_000; i++ {
+			p := pather(i, nil)
+			if prev, ok := seen[p]; ok {
+				t.Errorf("%s: index %d and %d both map to %q", name, prev, i, p)
+				break
+			}
+			seen[p] = i
+		}
+	}
+}
+
+func TestNestedDepth(t *testing.T) {
+	got := Nested{Depth: 25, Fanout: 2}.Path(7, nil)
+	if n := strings.Count(got, "/"); n != 25 {
+		t.Errorf("Nested{Depth: 25}.Path(7) = %q, has %d separators, want 25", got, n)
+	}
+}
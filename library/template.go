@@ -0,0 +1,271 @@
+package library
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+// Template implements a PathFunc driven by a textual path template. Templates
+// are plain paths with fields in braces that are substituted with values from
+// the song's tag, for example:
+//
+//	{albumartist}/{year} - {album}/{track:02} {title}.{ext}
+//
+// The depth of the generated library is determined by the number of `/`
+// separators in the template. Supported fields are:
+//
+//	artist       Lead artist (TPE1)
+//	albumartist  Album artist (TPE2), falls back to artist when unset
+//	album        Album title (TALB)
+//	title        Track title (TIT2)
+//	genre        Genre (TCON)
+//	year         Year, numeric
+//	track        Track number (TRCK, without the "/total" part), numeric
+//	disc         Disc number (TPOS, without the "/total" part), numeric
+//	index        The song's index in the library, numeric
+//	ext          The file extension, always "mp3"
+//
+// Numeric fields accept a width after a colon. A leading zero in the width
+// pads the value with zeros, so `{track:02}` renders track 3 as "03". Literal
+// braces can be written as `{{` and `}}`. A Template is created with
+// ParseTemplate.
+type Template struct {
+	// Sanitize is applied to every substituted field value before it is
+	// inserted into the path, and then to every element of the rendered
+	// path, so literal text and fields can't combine into names like "..".
+	// Defaults to SanitizePOSIX if unset.
+	Sanitize func(string) string
+
+	// Missing is substituted for string fields that are not set in the tag.
+	// Defaults to "Unknown" if unset.
+	Missing string
+
+	segments []segment
+}
+
+type segment struct {
+	// literal is set for literal text, otherwise the segment is a field.
+	literal string
+	field   string
+	width   int
+	zeroPad bool
+}
+
+type fieldKind int
+
+const (
+	stringField fieldKind = iota
+	numericField
+)
+
+var templateFields = map[string]fieldKind{
+	"artist":      stringField,
+	"albumartist": stringField,
+	"album":       stringField,
+	"title":       stringField,
+	"genre":       stringField,
+	"ext":         stringField,
+	"year":        numericField,
+	"track":       numericField,
+	"disc":        numericField,
+	"index":       numericField,
+}
+
+// ParseTemplate parses the given path template. See Template for the
+// supported syntax.
+func ParseTemplate(tmpl string) (*Template, error) {
+	if tmpl == "" {
+		return nil, fmt.Errorf("empty path template")
+	}
+	if strings.HasPrefix(tmpl, "/") || strings.HasSuffix(tmpl, "/") {
+		return nil, fmt.Errorf("path template %q must not start or end with /", tmpl)
+	}
+	if strings.Contains(tmpl, "//") {
+		return nil, fmt.Errorf("path template %q contains an empty path component", tmpl)
+	}
+
+	var segments []segment
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			segments = append(segments, segment{literal: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(tmpl); i++ {
+		c := tmpl[i]
+		switch {
+		case c == '{' && i+1 < len(tmpl) && tmpl[i+1] == '{':
+			literal.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(tmpl) && tmpl[i+1] == '}':
+			literal.WriteByte('}')
+			i++
+		case c == '}':
+			return nil, fmt.Errorf("path template %q has unmatched } at offset %d", tmpl, i)
+		case c == '{':
+			end := strings.IndexByte(tmpl[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("path template %q has unterminated { at offset %d", tmpl, i)
+			}
+			seg, err := parseField(tmpl[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("path template %q: %w", tmpl, err)
+			}
+			flush()
+			segments = append(segments, seg)
+			i += end
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	flush()
+
+	return &Template{segments: segments}, nil
+}
+
+func parseField(spec string) (segment, error) {
+	name, format, hasFormat := strings.Cut(spec, ":")
+	kind, ok := templateFields[name]
+	if !ok {
+		return segment{}, fmt.Errorf("unknown field %q", name)
+	}
+	seg := segment{field: name}
+	if !hasFormat {
+		return seg, nil
+	}
+	if kind != numericField {
+		return segment{}, fmt.Errorf("field %q does not accept a width", name)
+	}
+	width, err := strconv.Atoi(format)
+	if err != nil || width < 0 {
+		return segment{}, fmt.Errorf("invalid width %q for field %q", format, name)
+	}
+	seg.width = width
+	seg.zeroPad = strings.HasPrefix(format, "0")
+	return seg, nil
+}
+
+// leadingNumber parses the leading integer in frames like TRCK "3/12".
+func leadingNumber(s string) int {
+	s = strings.TrimSpace(s)
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
+
+func (t *Template) value(seg segment, index int, tag *id3v2.Tag) string {
+	var s string
+	switch seg.field {
+	case "artist":
+		s = tag.Artist()
+	case "albumartist":
+		s = tag.GetTextFrame(tag.CommonID("Band/Orchestra/Accompaniment")).Text
+		if s == "" {
+			s = tag.Artist()
+		}
+	case "album":
+		s = tag.Album()
+	case "title":
+		s = tag.Title()
+	case "genre":
+		s = tag.Genre()
+	case "ext":
+		return "mp3"
+	}
+
+	if templateFields[seg.field] == stringField {
+		if s == "" {
+			s = t.Missing
+			if s == "" {
+				s = "Unknown"
+			}
+		}
+		return s
+	}
+
+	var n int
+	switch seg.field {
+	case "year":
+		n = leadingNumber(tag.Year())
+	case "track":
+		n = leadingNumber(tag.GetTextFrame(tag.CommonID("Track number/Position in set")).Text)
+	case "disc":
+		n = leadingNumber(tag.GetTextFrame(tag.CommonID("Part of a set")).Text)
+	case "index":
+		n = index
+	}
+	pad := " "
+	if seg.zeroPad {
+		pad = "0"
+	}
+	s = strconv.Itoa(n)
+	if len(s) < seg.width {
+		s = strings.Repeat(pad, seg.width-len(s)) + s
+	}
+	return s
+}
+
+// Path implements PathFunc by rendering the template for the given song.
+func (t *Template) Path(index int, tag *id3v2.Tag) string {
+	sanitize := t.Sanitize
+	if sanitize == nil {
+		sanitize = SanitizePOSIX
+	}
+
+	var b strings.Builder
+	for _, seg := range t.segments {
+		if seg.field == "" {
+			b.WriteString(seg.literal)
+			continue
+		}
+		b.WriteString(sanitize(t.value(seg, index, tag)))
+	}
+	elems := strings.Split(b.String(), "/")
+	for i, e := range elems {
+		elems[i] = sanitize(e)
+	}
+	return strings.Join(elems, "/")
+}
+
+// SanitizePOSIX makes s safe to use as a single path component on POSIX
+// filesystems. Path separators and NUL bytes are replaced with `_`, and the
+// special names "." and ".." are escaped.
+func SanitizePOSIX(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == 0 {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "." || s == ".." {
+		s = strings.Repeat("_", len(s))
+	}
+	return s
+}
+
+// SanitizeWindows makes s safe to use as a single path component on Windows
+// (and SMB shares). In addition to the SanitizePOSIX replacements, the
+// reserved characters <>:"\|?* and control characters are replaced with `_`,
+// and trailing dots and spaces are removed.
+func SanitizeWindows(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"/\|?*`, r) || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.TrimRight(s, ". ")
+	if s == "" {
+		s = "_"
+	}
+	return s
+}
@@ -0,0 +1,128 @@
+package library
+
+import (
+	"testing"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+func templateTag() *id3v2.Tag {
+	t := id3v2.NewEmptyTag()
+	t.SetArtist("Artist")
+	t.SetAlbum("Album")
+	t.SetTitle("Title")
+	t.SetYear("1999")
+	t.SetGenre("Rock")
+	t.AddTextFrame(t.CommonID("Track number/Position in set"), id3v2.EncodingUTF8, "3/12")
+	return t
+}
+
+func TestTemplatePath(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		idx  int
+		tag  func() *id3v2.Tag
+		want string
+	}{
+		{
+			tmpl: "{artist}/{album}/{title}.{ext}",
+			tag:  templateTag,
+			want: "Artist/Album/Title.mp3",
+		},
+		{
+			tmpl: "{albumartist}/{year} - {album}/{track:02} {title}.{ext}",
+			tag:  templateTag,
+			want: "Artist/1999 - Album/03 Title.mp3",
+		},
+		{
+			tmpl: "{genre}/{index:06}.{ext}",
+			idx:  42,
+			tag:  templateTag,
+			want: "Rock/000042.mp3",
+		},
+		{
+			tmpl: "{track:3}-{disc}.{ext}",
+			tag:  templateTag,
+			want: "  3-0.mp3",
+		},
+		{
+			tmpl: "{{{title}}}.{ext}",
+			tag:  templateTag,
+			want: "{Title}.mp3",
+		},
+		{
+			tmpl: "{artist}/{title}.{ext}",
+			tag: func() *id3v2.Tag {
+				t := id3v2.NewEmptyTag()
+				t.SetArtist("AC/DC")
+				return t
+			},
+			want: "AC_DC/Unknown.mp3",
+		},
+		{
+			tmpl: "{albumartist}/{title}.{ext}",
+			tag: func() *id3v2.Tag {
+				t := templateTag()
+				t.AddTextFrame(t.CommonID("Band/Orchestra/Accompaniment"), id3v2.EncodingUTF8, "Various")
+				return t
+			},
+			want: "Various/Title.mp3",
+		},
+		{
+			// Literal text can't form special names either.
+			tmpl: "./{artist}/../{title}.{ext}",
+			tag:  templateTag,
+			want: "_/Artist/__/Title.mp3",
+		},
+	}
+
+	for _, test := range tests {
+		tmpl, err := ParseTemplate(test.tmpl)
+		if err != nil {
+			t.Errorf("ParseTemplate(%q) = _, %v; want _, nil", test.tmpl, err)
+			continue
+		}
+		if got := tmpl.Path(test.idx, test.tag()); got != test.want {
+			t.Errorf("ParseTemplate(%q).Path(%d, ...) = %q, want %q", test.tmpl, test.idx, got, test.want)
+		}
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	for _, tmpl := range []string{
+		"",
+		"/{title}",
+		"{title}/",
+		"{artist}//{title}",
+		"{title",
+		"title}",
+		"{bogus}",
+		"{title:02}",
+		"{track:x}",
+	} {
+		if _, err := ParseTemplate(tmpl); err == nil {
+			t.Errorf("ParseTemplate(%q) = _, nil; want _, <error>", tmpl)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		in, posix, windows string
+	}{
+		{in: "plain", posix: "plain", windows: "plain"},
+		{in: "a/b", posix: "a_b", windows: "a_b"},
+		{in: "..", posix: "__", windows: "_"},
+		{in: `what? "no"`, posix: `what? "no"`, windows: "what_ _no_"},
+		{in: "trailing. ", posix: "trailing. ", windows: "trailing"},
+	}
+
+	for _, test := range tests {
+		if got := SanitizePOSIX(test.in); got != test.posix {
+			t.Errorf("SanitizePOSIX(%q) = %q, want %q", test.in, got, test.posix)
+		}
+		if got := SanitizeWindows(test.in); got != test.windows {
+			t.Errorf("SanitizeWindows(%q) = %q, want %q", test.in, got, test.windows)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package library
+
+import (
+	"time"
+)
+
+// TimeFunc is a function that generates the modification time of the song at
+// the given index in the library.
+type TimeFunc func(index int) time.Time
+
+// splitmix64 is a fast, well-distributed integer hash. It is used to derive
+// deterministic "random" values from song indices.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// unitFloat maps a hash to a float in [0, 1).
+func unitFloat(h uint64) float64 {
+	return float64(h>>11) / (1 << 53)
+}
+
+// Timestamps implements a TimeFunc that spreads song modification times over
+// the Span before End. Songs are timestamped in groups of Group consecutive
+// indices, to simulate whole albums being imported at once. A fraction of
+// groups (Recent) can be clustered in the RecentWindow just before End, to
+// simulate recent imports.
+//
+// Timestamps are a deterministic function of the song's index, so the same
+// library always has the same timestamps.
+type Timestamps struct {
+	// End is the latest timestamp that can be generated.
+	End time.Time
+	// Span is the length of the period before End over which timestamps are
+	// spread.
+	Span time.Duration
+
+	// Group is the number of consecutive songs that share a timestamp.
+	// Defaults to 1 if unset.
+	Group int
+
+	// Recent is the fraction (0 to 1) of groups that are timestamped within
+	// RecentWindow of End.
+	Recent float64
+	// RecentWindow is the length of the "recently added" period before End.
+	RecentWindow time.Duration
+}
+
+// Time implements TimeFunc.
+func (t Timestamps) Time(index int) time.Time {
+	group := t.Group
+	if group < 1 {
+		group = 1
+	}
+	g := uint64(index / group)
+
+	// Use independent hashes for the "is recent" decision, and the offset so
+	// that recent groups are spread uniformly over the window.
+	isRecent := unitFloat(splitmix64(g<<1)) < t.Recent
+	offset := unitFloat(splitmix64(g<<1 | 1))
+
+	window := t.Span
+	if isRecent {
+		window = t.RecentWindow
+	}
+	// Truncate to whole seconds, like most filesystems would report.
+	return t.End.Add(-time.Duration(offset * float64(window))).Truncate(time.Second)
+}
@@ -0,0 +1,73 @@
+package library
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTimestamps(t *testing.T) {
+	end := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	ts := Timestamps{
+		End:          end,
+		Span:         5 * 365 * 24 * time.Hour,
+		Group:        10,
+		Recent:       0.2,
+		RecentWindow: 24 * time.Hour,
+	}
+
+	var recent, groups int
+	for i := 0; i < 10_000; i++ {
+		got := ts.Time(i)
+		if got.After(end) || got.Before(end.Add(-ts.Span)) {
+			t.Fatalf("ts.Time(%d) = %v, want within %v before %v", i, got, ts.Span, end)
+		}
+		if again := ts.Time(i); !again.Equal(got) {
+			t.Fatalf("ts.Time(%d) is not deterministic: %v != %v", i, got, again)
+		}
+		if i%ts.Group != 0 {
+			if first := ts.Time(i - i%ts.Group); !first.Equal(got) {
+				t.Errorf("ts.Time(%d) = %v, want same time as rest of group %v", i, got, first)
+			}
+			continue
+		}
+		groups++
+		if end.Sub(got) <= ts.RecentWindow {
+			recent++
+		}
+	}
+
+	// Roughly 20% should be recent. Non-recent groups can also land in the
+	// recent window, but rarely.
+	if frac := float64(recent) / float64(groups); frac < 0.15 || frac > 0.25 {
+		t.Errorf("%.2f of groups were recent, want ~%.2f", frac, ts.Recent)
+	}
+}
+
+func TestSongModTime(t *testing.T) {
+	lib, err := New(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+
+	song, err := lib.SongAt(0)
+	if err != nil {
+		t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+	}
+	if !song.ModTime().IsZero() {
+		t.Errorf("lib.SongAt(0).ModTime() = %v, want zero time without Timestamper", song.ModTime())
+	}
+
+	want := time.Unix(1234567890, 0)
+	lib.Timestamper = func(int) time.Time { return want }
+	song, err = lib.SongAt(0)
+	if err != nil {
+		t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+	}
+	if !song.ModTime().Equal(want) {
+		t.Errorf("lib.SongAt(0).ModTime() = %v, want %v", song.ModTime(), want)
+	}
+	if got := lib.ModTimeAt(0); !got.Equal(want) {
+		t.Errorf("lib.ModTimeAt(0) = %v, want %v", got, want)
+	}
+}
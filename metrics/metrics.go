@@ -0,0 +1,367 @@
+/*
+Package metrics collects counters, gauges and histograms about fakelib
+servers, and serves them in the Prometheus text exposition format, so
+benchmarks can scrape them like any other Prometheus target.
+
+Typical Usage:
+
+	reg := metrics.NewRegistry()
+	server, err := filesystem.MountWithOptions(lib, dir, &filesystem.Options{Metrics: reg})
+	if err != nil {
+	    ...
+	}
+	metrics.RegisterTagCache(reg, lib.TagCache)
+
+	http.Handle("/metrics", reg)
+
+Only the small subset of the Prometheus client that fakelib needs is
+implemented, so fakelib does not depend on it.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joshkunz/fakelib/library"
+)
+
+// Registry is a set of metrics. It implements http.Handler, and serves its
+// metrics in the text exposition format. Metrics are added with Counter,
+// Histogram, GaugeFunc and CounterFunc. Names must be unique, and the
+// methods panic otherwise. A Registry is safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// metric is a family of time series with the same name.
+type metric interface {
+	// write writes the HELP and TYPE lines, and every series.
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) add(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %q registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric to `w` in the text exposition format, in the
+// order they were added.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func header(w *bufio.Writer, name, help, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelString formats label names and values as {a="1",b="2"}, with
+// `extra` (e.g. `le="0.1"`) at the end. It returns "" if there are no
+// labels.
+func labelString(names, values []string, extra string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i]))
+		b.WriteByte('"')
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// atomicFloat is a float64 that can be added to atomically.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+// family holds the series of a metric with labels, keyed by their label
+// values.
+type family[T any] struct {
+	name, help string
+	labels     []string
+	newSeries  func() *T
+
+	mu     sync.RWMutex
+	series map[string]*T
+	values map[string][]string
+}
+
+// with returns the series with the given label values, creating it if
+// needed.
+func (f *family[T]) with(values []string) *T {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %q has labels %v, got values %v", f.name, f.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.RLock()
+	s, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return s
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.series[key]; ok {
+		return s
+	}
+	s = f.newSeries()
+	f.series[key] = s
+	f.values[key] = append([]string(nil), values...)
+	return s
+}
+
+// each calls `fn` with the label values of every series, sorted by label
+// values.
+func (f *family[T]) each(fn func(values []string, s *T)) {
+	f.mu.RLock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	series, values := make([]*T, len(keys)), make([][]string, len(keys))
+	sort.Strings(keys)
+	for i, k := range keys {
+		series[i], values[i] = f.series[k], f.values[k]
+	}
+	f.mu.RUnlock()
+	for i := range keys {
+		fn(values[i], series[i])
+	}
+}
+
+func newFamily[T any](name, help string, labels []string, newSeries func() *T) *family[T] {
+	return &family[T]{
+		name:      name,
+		help:      help,
+		labels:    labels,
+		newSeries: newSeries,
+		series:    make(map[string]*T),
+		values:    make(map[string][]string),
+	}
+}
+
+// Counter is a counter with labels. Each combination of label values is a
+// separate series, which starts at zero.
+type Counter struct {
+	f *family[atomicFloat]
+}
+
+// Counter adds a counter named `name`, with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{f: newFamily(name, help, labels, func() *atomicFloat { return new(atomicFloat) })}
+	r.add(name, c)
+	return c
+}
+
+// Add adds `v`, which must not be negative, to the series with the given
+// label values. There must be a value for each label.
+func (c *Counter) Add(v float64, values ...string) {
+	c.f.with(values).add(v)
+}
+
+// Inc adds 1 to the series with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value returns the value of the series with the given label values.
+func (c *Counter) Value(values ...string) float64 {
+	return c.f.with(values).load()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	header(w, c.f.name, c.f.help, "counter")
+	c.f.each(func(values []string, s *atomicFloat) {
+		fmt.Fprintf(w, "%s%s %s\n", c.f.name, labelString(c.f.labels, values, ""), formatFloat(s.load()))
+	})
+}
+
+// DurationBuckets are histogram buckets for latencies in seconds, from 10µs
+// (e.g. a cached lookup) to 10s (e.g. a read with injected latency).
+var DurationBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// Histogram is a histogram with labels. Each combination of label values
+// is a separate series.
+type Histogram struct {
+	f       *family[histogramSeries]
+	buckets []float64
+}
+
+type histogramSeries struct {
+	// counts[i] is the number of observations in (buckets[i-1], buckets[i]].
+	// The last count is for observations over every bucket.
+	counts []atomic.Uint64
+	sum    atomicFloat
+}
+
+// Histogram adds a histogram named `name`, with the given upper bounds of
+// its buckets (in increasing order) and label names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets}
+	h.f = newFamily(name, help, labels, func() *histogramSeries {
+		return &histogramSeries{counts: make([]atomic.Uint64, len(buckets)+1)}
+	})
+	r.add(name, h)
+	return h
+}
+
+// Observe adds an observation of `v` to the series with the given label
+// values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	s := h.f.with(values)
+	s.counts[sort.SearchFloat64s(h.buckets, v)].Add(1)
+	s.sum.add(v)
+}
+
+// ObserveDuration adds an observation of `d`, in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration, values ...string) {
+	h.Observe(d.Seconds(), values...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	header(w, h.f.name, h.f.help, "histogram")
+	h.f.each(func(values []string, s *histogramSeries) {
+		var total uint64
+		for i := range s.counts {
+			total += s.counts[i].Load()
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.f.name, labelString(h.f.labels, values, `le="`+le+`"`), total)
+		}
+		labels := labelString(h.f.labels, values, "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.f.name, labels, formatFloat(s.sum.load()))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.f.name, labels, total)
+	})
+}
+
+// funcMetric is a metric without labels whose value is computed when it is
+// written.
+type funcMetric struct {
+	name, help, typ string
+	f               func() float64
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	header(w, m.name, m.help, m.typ)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.f()))
+}
+
+// GaugeFunc adds a gauge named `name`, whose value is returned by `f`.
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.add(name, &funcMetric{name: name, help: help, typ: "gauge", f: f})
+}
+
+// CounterFunc adds a counter named `name`, whose value is returned by `f`.
+// The value must never decrease.
+func (r *Registry) CounterFunc(name, help string, f func() float64) {
+	r.add(name, &funcMetric{name: name, help: help, typ: "counter", f: f})
+}
+
+// RegisterTagCache adds metrics about a library's TagCache to `r`. It does
+// nothing if `cache` is nil.
+func RegisterTagCache(r *Registry, cache library.TagCache) {
+	if cache == nil {
+		return
+	}
+	stat := func(f func(library.CacheStats) float64) func() float64 {
+		return func() float64 { return f(cache.Stats()) }
+	}
+	r.CounterFunc("fakelib_tag_cache_hits_total", "Lookups of encoded tags found in the tag cache.",
+		stat(func(s library.CacheStats) float64 { return float64(s.Hits) }))
+	r.CounterFunc("fakelib_tag_cache_misses_total", "Lookups of encoded tags not found in the tag cache.",
+		stat(func(s library.CacheStats) float64 { return float64(s.Misses) }))
+	r.CounterFunc("fakelib_tag_cache_evictions_total", "Tags evicted from the tag cache to stay within its memory budget.",
+		stat(func(s library.CacheStats) float64 { return float64(s.Evictions) }))
+	r.GaugeFunc("fakelib_tag_cache_entries", "Tags in the tag cache.",
+		stat(func(s library.CacheStats) float64 { return float64(s.Entries) }))
+	r.GaugeFunc("fakelib_tag_cache_bytes", "Approximate memory used by the tag cache.",
+		stat(func(s library.CacheStats) float64 { return float64(s.Bytes) }))
+}
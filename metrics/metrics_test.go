@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/joshkunz/fakelib/library"
+)
+
+func TestWriteTo(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("ops_total", "Operations.", "op")
+	c.Inc("read")
+	c.Add(2, "read")
+	c.Inc("lookup")
+	h := reg.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.ObserveDuration(500 * time.Millisecond)
+	h.Observe(3)
+	reg.GaugeFunc("songs", "Songs,\nwith a \\ newline.", func() float64 { return 7 })
+	reg.Counter("escaped_total", "Escaped.", "path").Inc("a\"b\\c")
+
+	var b strings.Builder
+	if _, err := reg.WriteTo(&b); err != nil {
+		t.Fatalf("reg.WriteTo(...) = _, %v; want _, nil", err)
+	}
+	want := `# HELP ops_total Operations.
+# TYPE ops_total counter
+ops_total{op="lookup"} 1
+ops_total{op="read"} 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.55
+latency_seconds_count 3
+# HELP songs Songs,\nwith a \\ newline.
+# TYPE songs gauge
+songs 7
+# HELP escaped_total Escaped.
+# TYPE escaped_total counter
+escaped_total{path="a\"b\\c"} 1
+`
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("reg.WriteTo(...) diff (want -> got):\n%s", diff)
+	}
+	if got := c.Value("read"); got != 3 {
+		t.Errorf("c.Value(\"read\") = %v, want 3", got)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("ops_total", "Operations.").Inc()
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want text/plain; version=0.0.4", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "\nops_total 1\n") {
+		t.Errorf("Body = %q, want it to contain \"ops_total 1\"", body)
+	}
+}
+
+func TestDuplicateName(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("ops_total", "Operations.")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering ops_total twice did not panic")
+		}
+	}()
+	reg.GaugeFunc("ops_total", "Operations.", func() float64 { return 0 })
+}
+
+func TestRegisterTagCache(t *testing.T) {
+	lib, err := library.New(library.EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 3
+	lib.TagCache = library.NewLRUTagCache(1 << 20)
+	for i := 0; i < 2; i++ {
+		if _, err := lib.SongAt(0); err != nil {
+			t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+		}
+	}
+
+	reg := NewRegistry()
+	RegisterTagCache(reg, lib.TagCache)
+	var b strings.Builder
+	reg.WriteTo(&b)
+	for _, want := range []string{
+		"\nfakelib_tag_cache_hits_total 1\n",
+		"\nfakelib_tag_cache_misses_total 1\n",
+		"\nfakelib_tag_cache_entries 1\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Metrics = %q, want them to contain %q", b.String(), want)
+		}
+	}
+
+	// A library without a cache has no cache metrics.
+	reg = NewRegistry()
+	RegisterTagCache(reg, nil)
+	b.Reset()
+	reg.WriteTo(&b)
+	if b.String() != "" {
+		t.Errorf("Metrics without a tag cache = %q, want none", b.String())
+	}
+}
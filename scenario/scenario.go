@@ -0,0 +1,406 @@
+/*
+Package scenario simulates a library that evolves over time. A scenario is a
+script of changes, like adding, removing and retagging tracks, that are
+applied to a mounted library on a schedule. Scenarios are driven by a seed,
+so the same scenario always makes the same changes in the same order.
+
+Scenarios are written one rule per line. Each rule is either periodic
+("every") or happens once ("at"), and is timed relative to the start of the
+scenario:
+
+	# Grow the library steadily.
+	every 5s add 100
+	# Delete a whole album (10 consecutive tracks) every 30s.
+	every 30s remove-album 10
+	# Retag 1% of tracks every hour.
+	every 1h retag 1% genre
+	# Shrink the library back to 1000 tracks after a day.
+	at 24h resize 1000
+
+Supported actions are:
+
+	add <n>                  Add <n> tracks to the end of the library.
+	resize <n>               Grow or shrink the library to <n> tracks.
+	remove <count>           Remove <count> random tracks.
+	remove-album <n>         Remove a random run of <n> consecutive tracks,
+	                         aligned to a multiple of <n>.
+	retag <count> [field]    Change <field> (title, artist, album, genre or
+	                         year, default genre) of <count> random tracks.
+	move <count>             Move <count> random tracks to a new directory.
+
+A <count> is either a number of tracks, or a percentage of the current
+library size, like "1%".
+
+Typical Usage:
+
+	s, err := scenario.Parse(f)
+	if err != nil {
+	    ...
+	}
+	s.Seed = 42
+
+	server, err := filesystem.MountWithOptions(lib, dir, nil)
+	if err != nil {
+	    ...
+	}
+	go s.Run(ctx, server)
+*/
+package scenario
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+// Library is a library that can be changed by a scenario.
+// *filesystem.Server implements Library.
+type Library interface {
+	Tracks() int
+	Resize(tracks int) error
+	Remove(lo, hi int) error
+	Retag(lo, hi int, f func(idx int, tag *id3v2.Tag)) error
+	Move(idx int, p string) error
+}
+
+// Count is a number of tracks, either absolute, or relative to the size of
+// the library.
+type Count struct {
+	// N is the absolute number of tracks, used if Percent is zero.
+	N int
+	// Percent is the percentage (0 to 100) of the library's tracks.
+	Percent float64
+}
+
+func (c Count) of(tracks int) int {
+	if c.Percent == 0 {
+		return c.N
+	}
+	return int(math.Ceil(c.Percent / 100 * float64(tracks)))
+}
+
+func (c Count) String() string {
+	if c.Percent == 0 {
+		return strconv.Itoa(c.N)
+	}
+	return strconv.FormatFloat(c.Percent, 'g', -1, 64) + "%"
+}
+
+// Action is a single change to a library.
+type Action struct {
+	// Kind is one of "add", "resize", "remove", "remove-album", "retag" or
+	// "move".
+	Kind  string
+	Count Count
+	// Field is the tag field changed by "retag" actions.
+	Field string
+}
+
+func (a Action) String() string {
+	if a.Kind == "retag" {
+		return fmt.Sprintf("%s %v %s", a.Kind, a.Count, a.Field)
+	}
+	return fmt.Sprintf("%s %v", a.Kind, a.Count)
+}
+
+// Rule schedules an action. The action is first applied At after the start
+// of the scenario, and then repeated Every period, if Every is non-zero.
+type Rule struct {
+	At     time.Duration
+	Every  time.Duration
+	Action Action
+}
+
+// Scenario is a set of rules applied to a library over time.
+type Scenario struct {
+	Rules []Rule
+	// Seed determines which tracks are picked by each action.
+	Seed int64
+	// Logger, if set, is used to log every action applied, and any errors.
+	Logger *log.Logger
+}
+
+var countPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)(%?)$`)
+
+func parseCount(s string) (Count, error) {
+	m := countPattern.FindStringSubmatch(s)
+	if m == nil {
+		return Count{}, fmt.Errorf("invalid count %q", s)
+	}
+	if m[2] == "%" {
+		p, err := strconv.ParseFloat(m[1], 64)
+		if err != nil || p > 100 {
+			return Count{}, fmt.Errorf("invalid percentage %q", s)
+		}
+		return Count{Percent: p}, nil
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return Count{}, fmt.Errorf("invalid count %q", s)
+	}
+	return Count{N: n}, nil
+}
+
+var retagFields = map[string]bool{"title": true, "artist": true, "album": true, "genre": true, "year": true}
+
+func parseAction(fields []string) (Action, error) {
+	if len(fields) == 0 {
+		return Action{}, fmt.Errorf("missing action")
+	}
+	a := Action{Kind: fields[0]}
+	args := fields[1:]
+
+	maxArgs := 1
+	switch a.Kind {
+	case "add", "resize", "remove", "remove-album", "move":
+	case "retag":
+		maxArgs = 2
+		a.Field = "genre"
+	default:
+		return Action{}, fmt.Errorf("unknown action %q", a.Kind)
+	}
+	if len(args) < 1 || len(args) > maxArgs {
+		return Action{}, fmt.Errorf("wrong number of arguments for %q", a.Kind)
+	}
+
+	var err error
+	if a.Count, err = parseCount(args[0]); err != nil {
+		return Action{}, err
+	}
+	switch a.Kind {
+	case "add", "resize", "remove-album":
+		if a.Count.Percent != 0 {
+			return Action{}, fmt.Errorf("%q does not accept a percentage", a.Kind)
+		}
+	}
+	if a.Kind == "remove-album" && a.Count.N < 1 {
+		return Action{}, fmt.Errorf("album size must be at least 1")
+	}
+	if len(args) > 1 {
+		if !retagFields[args[1]] {
+			return Action{}, fmt.Errorf("unknown tag field %q", args[1])
+		}
+		a.Field = args[1]
+	}
+	return a, nil
+}
+
+// Parse parses a scenario script. See the package documentation for the
+// format.
+func Parse(r io.Reader) (*Scenario, error) {
+	var s Scenario
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: missing duration", line)
+		}
+
+		d, err := time.ParseDuration(fields[1])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("line %d: invalid duration %q", line, fields[1])
+		}
+		var rule Rule
+		switch fields[0] {
+		case "every":
+			if d == 0 {
+				return nil, fmt.Errorf("line %d: period must be positive", line)
+			}
+			rule.At, rule.Every = d, d
+		case "at":
+			rule.At = d
+		default:
+			return nil, fmt.Errorf("line %d: rules must start with \"every\" or \"at\", got %q", line, fields[0])
+		}
+
+		if rule.Action, err = parseAction(fields[2:]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		s.Rules = append(s.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Run applies the scenario to `lib` in real time, until all rules are
+// exhausted or `ctx` is cancelled. Errors applying individual actions are
+// logged, and do not stop the scenario. Run returns ctx.Err() if the
+// context was cancelled.
+func (s *Scenario) Run(ctx context.Context, lib Library) error {
+	start := time.Now()
+	return s.run(lib, -1, func(at time.Duration) error {
+		timer := time.NewTimer(time.Until(start.Add(at)))
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	})
+}
+
+// Simulate applies every action the scenario would apply in the first `d`
+// of running, without waiting. The changes (and their order) are identical
+// to those made by Run.
+func (s *Scenario) Simulate(lib Library, d time.Duration) error {
+	return s.run(lib, d, func(time.Duration) error { return nil })
+}
+
+// run applies actions in schedule order until `until` (or forever if
+// negative), calling `wait` before each action.
+func (s *Scenario) run(lib Library, until time.Duration, wait func(at time.Duration) error) error {
+	rng := rand.New(rand.NewSource(s.Seed))
+	next := make([]time.Duration, len(s.Rules))
+	done := make([]bool, len(s.Rules))
+	runs := make([]int, len(s.Rules))
+	for i, r := range s.Rules {
+		next[i] = r.At
+	}
+
+	for {
+		// Find the next rule to apply, ties are broken by rule order.
+		cur := -1
+		for i := range s.Rules {
+			if !done[i] && (cur < 0 || next[i] < next[cur]) {
+				cur = i
+			}
+		}
+		if cur < 0 || (until >= 0 && next[cur] > until) {
+			return nil
+		}
+
+		if err := wait(next[cur]); err != nil {
+			return err
+		}
+		rule := s.Rules[cur]
+		runs[cur]++
+		err := apply(lib, rng, rule.Action, runs[cur])
+		if s.Logger != nil {
+			if err != nil {
+				s.Logger.Printf("scenario: %v @ %v failed: %v", rule.Action, next[cur], err)
+			} else {
+				s.Logger.Printf("scenario: %v @ %v", rule.Action, next[cur])
+			}
+		}
+
+		if rule.Every == 0 {
+			done[cur] = true
+		} else {
+			next[cur] += rule.Every
+		}
+	}
+}
+
+// revision matches the suffix added to tag fields by previous retags.
+var revision = regexp.MustCompile(` \(rev [0-9]+\)$`)
+
+func retag(field string, run int) func(int, *id3v2.Tag) {
+	return func(_ int, tag *id3v2.Tag) {
+		if field == "year" {
+			tag.SetYear(strconv.Itoa(1950 + run%75))
+			return
+		}
+		var get func() string
+		var set func(string)
+		switch field {
+		case "title":
+			get, set = tag.Title, tag.SetTitle
+		case "artist":
+			get, set = tag.Artist, tag.SetArtist
+		case "album":
+			get, set = tag.Album, tag.SetAlbum
+		default:
+			get, set = tag.Genre, tag.SetGenre
+		}
+		base := revision.ReplaceAllString(get(), "")
+		if base == "" {
+			base = "Retagged"
+		}
+		set(fmt.Sprintf("%s (rev %d)", base, run))
+	}
+}
+
+// sample returns `n` distinct random integers in [0, max).
+func sample(rng *rand.Rand, max, n int) []int {
+	if n >= max/2 {
+		perm := rng.Perm(max)
+		if n < max {
+			perm = perm[:n]
+		}
+		return perm
+	}
+	picked := make(map[int]bool, n)
+	out := make([]int, 0, n)
+	for len(out) < n {
+		idx := rng.Intn(max)
+		if !picked[idx] {
+			picked[idx] = true
+			out = append(out, idx)
+		}
+	}
+	return out
+}
+
+// apply applies a single action. `run` is the number of times the action's
+// rule has been applied, including this time.
+func apply(lib Library, rng *rand.Rand, a Action, run int) error {
+	tracks := lib.Tracks()
+	n := a.Count.of(tracks)
+
+	switch a.Kind {
+	case "add":
+		return lib.Resize(tracks + n)
+	case "resize":
+		return lib.Resize(n)
+	case "remove-album":
+		albums := (tracks + n - 1) / n
+		if albums == 0 {
+			return nil
+		}
+		lo := rng.Intn(albums) * n
+		hi := lo + n
+		if hi > tracks {
+			hi = tracks
+		}
+		return lib.Remove(lo, hi)
+	}
+
+	// The remaining actions apply to `n` distinct random tracks.
+	for _, idx := range sample(rng, tracks, n) {
+		var err error
+		switch a.Kind {
+		case "remove":
+			err = lib.Remove(idx, idx+1)
+		case "retag":
+			err = lib.Retag(idx, idx+1, retag(a.Field, run))
+		case "move":
+			err = lib.Move(idx, fmt.Sprintf("Moved/%d/%d.mp3", run, idx))
+		default:
+			return fmt.Errorf("unknown action %q", a.Kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bogem/id3v2/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeLibrary records every change made to it.
+type fakeLibrary struct {
+	tracks int
+	tags   map[int]*id3v2.Tag
+	log    []string
+}
+
+func newFakeLibrary(tracks int) *fakeLibrary {
+	return &fakeLibrary{tracks: tracks, tags: make(map[int]*id3v2.Tag)}
+}
+
+func (f *fakeLibrary) Tracks() int { return f.tracks }
+
+func (f *fakeLibrary) Resize(tracks int) error {
+	f.log = append(f.log, fmt.Sprintf("resize %d", tracks))
+	f.tracks = tracks
+	return nil
+}
+
+func (f *fakeLibrary) Remove(lo, hi int) error {
+	f.log = append(f.log, fmt.Sprintf("remove %d %d", lo, hi))
+	return nil
+}
+
+func (f *fakeLibrary) Retag(lo, hi int, fn func(int, *id3v2.Tag)) error {
+	for idx := lo; idx < hi; idx++ {
+		tag, ok := f.tags[idx]
+		if !ok {
+			tag = id3v2.NewEmptyTag()
+			f.tags[idx] = tag
+		}
+		fn(idx, tag)
+		f.log = append(f.log, fmt.Sprintf("retag %d %s", idx, tag.Genre()))
+	}
+	return nil
+}
+
+func (f *fakeLibrary) Move(idx int, p string) error {
+	f.log = append(f.log, fmt.Sprintf("move %d %s", idx, p))
+	return nil
+}
+
+func TestParse(t *testing.T) {
+	const script = `
+# comment
+every 5s add 100
+every 30s remove-album 10 # trailing comment
+every 1h retag 1% title
+at 24h resize 1000
+every 1m move 2
+every 1m remove 0.5%
+`
+	got, err := Parse(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Parse(...) = _, %v; want _, nil", err)
+	}
+	want := []Rule{
+		{At: 5 * time.Second, Every: 5 * time.Second, Action: Action{Kind: "add", Count: Count{N: 100}}},
+		{At: 30 * time.Second, Every: 30 * time.Second, Action: Action{Kind: "remove-album", Count: Count{N: 10}}},
+		{At: time.Hour, Every: time.Hour, Action: Action{Kind: "retag", Count: Count{Percent: 1}, Field: "title"}},
+		{At: 24 * time.Hour, Action: Action{Kind: "resize", Count: Count{N: 1000}}},
+		{At: time.Minute, Every: time.Minute, Action: Action{Kind: "move", Count: Count{N: 2}}},
+		{At: time.Minute, Every: time.Minute, Action: Action{Kind: "remove", Count: Count{Percent: 0.5}}},
+	}
+	if diff := cmp.Diff(want, got.Rules); diff != "" {
+		t.Errorf("Parse(...) had unexpected diff (want -> got):\n%s", diff)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, script := range []string{
+		"every",
+		"every 5s",
+		"every 0s add 1",
+		"sometimes 5s add 1",
+		"every 5x add 1",
+		"every 5s explode 1",
+		"every 5s add 1%",
+		"every 5s add",
+		"every 5s add 1 2",
+		"every 5s remove-album 0",
+		"every 5s retag 1 color",
+		"every 5s retag 200%",
+	} {
+		if _, err := Parse(strings.NewReader(script)); err == nil {
+			t.Errorf("Parse(%q) = _, nil; want _, <error>", script)
+		}
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	s := &Scenario{
+		Seed: 1,
+		Rules: []Rule{
+			{At: 10 * time.Second, Every: 10 * time.Second, Action: Action{Kind: "add", Count: Count{N: 10}}},
+			{At: 15 * time.Second, Action: Action{Kind: "remove-album", Count: Count{N: 10}}},
+			{At: 20 * time.Second, Every: 20 * time.Second, Action: Action{Kind: "retag", Count: Count{Percent: 10}, Field: "genre"}},
+		},
+	}
+
+	lib := newFakeLibrary(20)
+	if err := s.Simulate(lib, 40*time.Second); err != nil {
+		t.Fatalf("s.Simulate(...) = %v, want nil", err)
+	}
+	if lib.tracks != 60 {
+		t.Errorf("library has %d tracks after simulation, want 60", lib.tracks)
+	}
+
+	// Check the schedule order, ignoring which tracks were picked.
+	var kinds []string
+	for _, l := range lib.log {
+		kinds = append(kinds, strings.Fields(l)[0])
+	}
+	want := []string{
+		"resize",                           // 10s
+		"remove",                           // 15s
+		"resize",                           // 20s, rule order breaks ties.
+		"retag", "retag", "retag", "retag", // 20s, 10% of 40 tracks.
+		"resize",                                             // 30s
+		"resize",                                             // 40s
+		"retag", "retag", "retag", "retag", "retag", "retag", // 40s, 10% of 60 tracks.
+	}
+	if diff := cmp.Diff(want, kinds); diff != "" {
+		t.Errorf("simulation applied unexpected actions (want -> got):\n%s\nfull log:\n%s", diff, strings.Join(lib.log, "\n"))
+	}
+
+	// The same seed must make the same changes.
+	again := newFakeLibrary(20)
+	if err := s.Simulate(again, 40*time.Second); err != nil {
+		t.Fatalf("s.Simulate(...) = %v, want nil", err)
+	}
+	if diff := cmp.Diff(lib.log, again.log); diff != "" {
+		t.Errorf("simulation with the same seed was not reproducible (first -> second):\n%s", diff)
+	}
+}
+
+func TestSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, test := range []struct{ max, n, want int }{
+		{max: 100, n: 10, want: 10},
+		{max: 100, n: 90, want: 90},
+		{max: 10, n: 20, want: 10},
+		{max: 0, n: 5, want: 0},
+	} {
+		got := sample(rng, test.max, test.n)
+		seen := make(map[int]bool)
+		for _, idx := range got {
+			if idx < 0 || idx >= test.max || seen[idx] {
+				t.Errorf("sample(_, %d, %d) = %v, want distinct values in range", test.max, test.n, got)
+				break
+			}
+			seen[idx] = true
+		}
+		if len(got) != test.want {
+			t.Errorf("sample(_, %d, %d) returned %d values, want %d", test.max, test.n, len(got), test.want)
+		}
+	}
+}
+
+func TestRetagRevisions(t *testing.T) {
+	tag := id3v2.NewEmptyTag()
+	tag.SetTitle("Song")
+	retag("title", 1)(0, tag)
+	retag("title", 2)(0, tag)
+	if got, want := tag.Title(), "Song (rev 2)"; got != want {
+		t.Errorf("title after two retags = %q, want %q", got, want)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	s := &Scenario{Rules: []Rule{
+		{At: 0, Action: Action{Kind: "add", Count: Count{N: 1}}},
+		{At: time.Hour, Action: Action{Kind: "add", Count: Count{N: 1}}},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	lib := newFakeLibrary(0)
+	if err := s.Run(ctx, lib); err != context.DeadlineExceeded {
+		t.Errorf("s.Run(...) = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if lib.tracks != 1 {
+		t.Errorf("library has %d tracks, want 1", lib.tracks)
+	}
+}
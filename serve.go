@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/joshkunz/fakelib/metrics"
+	"github.com/joshkunz/fakelib/web"
+)
+
+var (
+	listen = flag.String("listen", "localhost:8080", "Address to listen on for \"fakelib serve\"")
+	webdav = flag.Bool("webdav", false, "Serve the library over WebDAV with \"fakelib serve\", so it can be mounted by WebDAV clients")
+)
+
+// runServe serves the library over HTTP until the process is killed.
+func runServe() {
+	lib := newLibrary(flag.Arg(0))
+	var h interface {
+		http.Handler
+		SetMetrics(reg *metrics.Registry)
+	}
+	var err error
+	if *webdav {
+		h, err = web.NewDAVHandler(lib)
+	} else {
+		h, err = web.NewHandler(lib)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *metricsAddr != "" {
+		reg := metrics.NewRegistry()
+		metrics.RegisterTagCache(reg, lib.TagCache)
+		h.SetMetrics(reg)
+		if _, err := listenMetrics(reg); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving metrics at http://%s/metrics", *metricsAddr)
+	}
+	log.Printf("serving library at http://%s/", *listen)
+	log.Fatal(http.ListenAndServe(*listen, h))
+}
@@ -0,0 +1,278 @@
+package web
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/joshkunz/fakelib/library"
+	"github.com/joshkunz/fakelib/metrics"
+)
+
+// DAVHandler is an http.Handler that serves a library over WebDAV, so it can
+// be mounted by WebDAV clients, or tools like rclone. The library is
+// read-only: PROPFIND, GET, HEAD and OPTIONS are supported, other methods
+// fail. The handler must be served at the root of the server, since hrefs
+// in PROPFIND responses are absolute paths. The library must not be
+// modified while it is served.
+type DAVHandler struct {
+	h *Handler
+}
+
+// NewDAVHandler returns a DAVHandler that serves `lib`. An error is returned
+// if the library's paths collide, and the library's Collisions strategy does
+// not resolve them.
+func NewDAVHandler(lib *library.Library) (*DAVHandler, error) {
+	h, err := NewHandler(lib)
+	if err != nil {
+		return nil, err
+	}
+	return &DAVHandler{h: h}, nil
+}
+
+const davMethods = "OPTIONS, GET, HEAD, PROPFIND"
+
+// SetMetrics adds metrics about the requests served by the handler to `reg`.
+// It must be called before the handler serves any requests.
+func (d *DAVHandler) SetMetrics(reg *metrics.Registry) {
+	d.h.SetMetrics(reg)
+}
+
+func (d *DAVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.h.metrics.instrument(w, r, d.serve)
+}
+
+func (d *DAVHandler) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		d.h.serve(w, r)
+	case http.MethodOptions:
+		w.Header().Set("Allow", davMethods)
+		w.Header().Set("DAV", "1")
+		w.Header().Set("MS-Author-Via", "DAV")
+	case "PROPFIND":
+		d.propfind(w, r)
+	default:
+		w.Header().Set("Allow", davMethods)
+		http.Error(w, "the library is read-only", http.StatusMethodNotAllowed)
+	}
+}
+
+// propfindRequest is the body of a PROPFIND request. An empty body is
+// treated like allprop.
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Props []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// property is a single WebDAV property in a PROPFIND response.
+type property struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+	// Collection is set for the resourcetype of directories.
+	Collection *struct{} `xml:"D:collection"`
+}
+
+type propstat struct {
+	Props  []property `xml:"D:prop>any"`
+	Status string     `xml:"D:status"`
+}
+
+type davResponse struct {
+	XMLName   xml.Name   `xml:"D:response"`
+	Href      string     `xml:"D:href"`
+	Propstats []propstat `xml:"D:propstat"`
+}
+
+// davName returns the name of a property in the DAV: namespace. The "D"
+// prefix is declared on the multistatus element.
+func davName(local string) xml.Name {
+	return xml.Name{Local: "D:" + local}
+}
+
+// davProps are the names of the supported properties, for propname
+// requests.
+var davProps = []string{"displayname", "resourcetype", "getcontentlength", "getcontenttype", "getlastmodified", "getetag"}
+
+// props returns the properties of the file or directory `p`. Directories
+// only have a displayname and resourcetype.
+func (d *DAVHandler) props(p string, idx int, isDir bool) (map[string]property, error) {
+	name := path.Base(p)
+	if p == "" {
+		name = "/"
+	}
+	props := map[string]property{
+		"displayname":  {Value: name},
+		"resourcetype": {},
+	}
+	if isDir {
+		props["resourcetype"] = property{Collection: &struct{}{}}
+		return props, nil
+	}
+
+	song, err := d.h.lib.SongAt(idx)
+	if err != nil {
+		return nil, err
+	}
+	props["getcontentlength"] = property{Value: strconv.FormatInt(song.Size(), 10)}
+	ctype := mime.TypeByExtension(path.Ext(p))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	props["getcontenttype"] = property{Value: ctype}
+	if t := song.ModTime(); !t.IsZero() {
+		props["getlastmodified"] = property{Value: t.UTC().Format(http.TimeFormat)}
+	}
+	props["getetag"] = property{Value: ETag(song)}
+	return props, nil
+}
+
+// href returns the escaped href of `p`. Directories have a trailing slash.
+func href(p string, isDir bool) string {
+	h := (&url.URL{Path: "/" + p}).EscapedPath()
+	if isDir && !strings.HasSuffix(h, "/") {
+		h += "/"
+	}
+	return h
+}
+
+// response builds the PROPFIND response for a single file or directory.
+func (d *DAVHandler) response(req *propfindRequest, p string, idx int, isDir bool) (davResponse, error) {
+	resp := davResponse{Href: href(p, isDir)}
+	props, err := d.props(p, idx, isDir)
+	if err != nil {
+		return resp, err
+	}
+
+	found := propstat{Status: "HTTP/1.1 200 OK"}
+	switch {
+	case req.PropName != nil:
+		for _, name := range davProps {
+			if _, ok := props[name]; ok {
+				found.Props = append(found.Props, property{XMLName: davName(name)})
+			}
+		}
+	case req.Prop != nil:
+		missing := propstat{Status: "HTTP/1.1 404 Not Found"}
+		for _, want := range req.Prop.Props {
+			prop, ok := props[want.XMLName.Local]
+			if !ok || want.XMLName.Space != "DAV:" {
+				missing.Props = append(missing.Props, property{XMLName: want.XMLName})
+				continue
+			}
+			prop.XMLName = davName(want.XMLName.Local)
+			found.Props = append(found.Props, prop)
+		}
+		if len(missing.Props) > 0 {
+			resp.Propstats = append(resp.Propstats, missing)
+		}
+	default:
+		for _, name := range davProps {
+			if prop, ok := props[name]; ok {
+				prop.XMLName = davName(name)
+				found.Props = append(found.Props, prop)
+			}
+		}
+	}
+	if len(found.Props) > 0 {
+		resp.Propstats = append([]propstat{found}, resp.Propstats...)
+	}
+	return resp, nil
+}
+
+// errInfiniteDepth is returned by depth for "Depth: infinity".
+var errInfiniteDepth = errors.New("Depth: infinity is not supported")
+
+// depth parses the Depth header of a PROPFIND request, which defaults to 1.
+// Infinite depth is not supported, since a single request could list every
+// song in a huge library.
+func depth(r *http.Request) (int, error) {
+	switch r.Header.Get("Depth") {
+	case "0":
+		return 0, nil
+	case "", "1":
+		return 1, nil
+	case "infinity":
+		return 0, errInfiniteDepth
+	}
+	return 0, fmt.Errorf("invalid Depth %q", r.Header.Get("Depth"))
+}
+
+func (d *DAVHandler) propfind(w http.ResponseWriter, r *http.Request) {
+	depth, err := depth(r)
+	if err == errInfiniteDepth {
+		// The precondition code of RFC 4918, section 9.1.
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, xml.Header+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`+"\n")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req propfindRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("invalid PROPFIND body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	p, _ := name(r)
+	idx, isFile := d.h.paths.Index(p)
+	if !isFile && !d.h.paths.IsDir(p) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header+`<D:multistatus xmlns:D="DAV:">`)
+	enc := xml.NewEncoder(w)
+	// Responses are streamed, since a directory can have many entries.
+	// Errors can't be reported after the header is written, so the response
+	// is just cut short.
+	var walk func(p string, idx int, isDir bool, depth int) error
+	walk = func(p string, idx int, isDir bool, depth int) error {
+		resp, err := d.response(&req, p, idx, isDir)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+		if !isDir || depth == 0 {
+			return nil
+		}
+		entries, err := d.h.paths.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := walk(path.Join(p, e.Name), e.Index, e.IsDir(), depth-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !isFile {
+		idx = -1
+	}
+	if err := walk(p, idx, !isFile, depth); err != nil {
+		return
+	}
+	enc.Flush()
+	io.WriteString(w, "</D:multistatus>\n")
+}
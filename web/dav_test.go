@@ -0,0 +1,164 @@
+package web
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/joshkunz/fakelib/library"
+)
+
+// multistatus is the parsed body of a PROPFIND response.
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"href"`
+		Propstats []struct {
+			Prop struct {
+				DisplayName   string    `xml:"displayname"`
+				Collection    *struct{} `xml:"resourcetype>collection"`
+				ContentLength string    `xml:"getcontentlength"`
+				ContentType   string    `xml:"getcontenttype"`
+				ETag          string    `xml:"getetag"`
+				Any           []struct {
+					XMLName xml.Name
+				} `xml:",any"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func propfind(t *testing.T, h http.Handler, p, depth, body string) (int, multistatus) {
+	t.Helper()
+	r := httptest.NewRequest("PROPFIND", p, strings.NewReader(body))
+	if depth != "" {
+		r.Header.Set("Depth", depth)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var ms multistatus
+	if w.Code == http.StatusMultiStatus {
+		if err := xml.Unmarshal(w.Body.Bytes(), &ms); err != nil {
+			t.Fatalf("Failed to parse PROPFIND %s response: %v\n%s", p, err, w.Body)
+		}
+	}
+	return w.Code, ms
+}
+
+func newDAVHandler(t *testing.T, tracks int) *DAVHandler {
+	t.Helper()
+	lib, err := library.New(library.EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = tracks
+	d, err := NewDAVHandler(lib)
+	if err != nil {
+		t.Fatalf("NewDAVHandler(...) = _, %v; want _, nil", err)
+	}
+	return d
+}
+
+func TestPropfindDepth(t *testing.T) {
+	d := newDAVHandler(t, 12)
+
+	for _, test := range []struct {
+		path, depth string
+		want        []string
+	}{
+		{"/A/A/A.mp3", "0", []string{"/A/A/A.mp3"}},
+		{"/A", "0", []string{"/A/"}},
+		{"/A/", "1", []string{"/A/", "/A/A/", "/A/B/"}},
+		{"/A/B/", "1", []string{"/A/B/", "/A/B/A.mp3", "/A/B/B.mp3"}},
+		{"/", "", []string{"/", "/A/"}},
+	} {
+		code, ms := propfind(t, d, test.path, test.depth, "")
+		if code != http.StatusMultiStatus {
+			t.Errorf("PROPFIND %s (Depth: %q) status = %d, want %d", test.path, test.depth, code, http.StatusMultiStatus)
+			continue
+		}
+		var got []string
+		for _, r := range ms.Responses {
+			got = append(got, r.Href)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("PROPFIND %s (Depth: %q) hrefs diff (want -> got):\n%s", test.path, test.depth, diff)
+		}
+	}
+
+	if code, _ := propfind(t, d, "/A/Z", "0", ""); code != http.StatusNotFound {
+		t.Errorf("PROPFIND /A/Z status = %d, want %d", code, http.StatusNotFound)
+	}
+	if code, _ := propfind(t, d, "/", "infinity", ""); code != http.StatusForbidden {
+		t.Errorf("PROPFIND / with Depth: infinity status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code, _ := propfind(t, d, "/A", "2", ""); code != http.StatusBadRequest {
+		t.Errorf("PROPFIND /A with Depth: 2 status = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestPropfindProps(t *testing.T) {
+	d := newDAVHandler(t, 10)
+
+	_, ms := propfind(t, d, "/A/A/B.mp3", "0", "")
+	if len(ms.Responses) != 1 || len(ms.Responses[0].Propstats) != 1 {
+		t.Fatalf("PROPFIND A/A/B.mp3 = %+v, want one response with one propstat", ms)
+	}
+	prop := ms.Responses[0].Propstats[0].Prop
+	song, err := d.h.lib.SongAt(1)
+	if err != nil {
+		t.Fatalf("lib.SongAt(1) = _, %v; want _, nil", err)
+	}
+	if prop.DisplayName != "B.mp3" || prop.Collection != nil || prop.ContentType != "audio/mpeg" ||
+		prop.ContentLength != "20316" || prop.ETag != ETag(song) {
+		t.Errorf("PROPFIND A/A/B.mp3 props = %+v, want a 20316 byte audio/mpeg file named B.mp3 with ETag %s", prop, ETag(song))
+	}
+
+	_, ms = propfind(t, d, "/A", "0", `<?xml version="1.0"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><x:rating xmlns:x="urn:example"/></prop></propfind>`)
+	if len(ms.Responses) != 1 || len(ms.Responses[0].Propstats) != 2 {
+		t.Fatalf("PROPFIND A = %+v, want one response with two propstats", ms)
+	}
+	found, missing := ms.Responses[0].Propstats[0], ms.Responses[0].Propstats[1]
+	if found.Prop.Collection == nil || !strings.Contains(found.Status, "200") {
+		t.Errorf("PROPFIND A found props = %+v, want a collection with status 200", found)
+	}
+	// getcontentlength is parsed into ContentLength, so only the rating
+	// is left in Any.
+	if len(missing.Prop.Any) != 1 || missing.Prop.Any[0].XMLName.Local != "rating" || !strings.Contains(missing.Status, "404") {
+		t.Errorf("PROPFIND A missing props = %+v, want getcontentlength and rating with status 404", missing)
+	}
+
+	_, ms = propfind(t, d, "/A/A/A.mp3", "0", `<propfind xmlns="DAV:"><propname/></propfind>`)
+	if len(ms.Responses) != 1 || len(ms.Responses[0].Propstats) != 1 || ms.Responses[0].Propstats[0].Prop.DisplayName != "" {
+		t.Errorf("PROPFIND A/A/A.mp3 with propname = %+v, want property names without values", ms)
+	}
+}
+
+func TestDAVMethods(t *testing.T) {
+	d := newDAVHandler(t, 10)
+
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/", nil))
+	if w.Header().Get("DAV") == "" || !strings.Contains(w.Header().Get("Allow"), "PROPFIND") {
+		t.Errorf("OPTIONS / headers = %v, want DAV and Allow with PROPFIND", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/A/A/A.mp3", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 20316 {
+		t.Errorf("GET A/A/A.mp3 = %d with %d bytes, want %d with 20316 bytes", w.Code, w.Body.Len(), http.StatusOK)
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete, "MKCOL", "PROPPATCH", "LOCK"} {
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, httptest.NewRequest(method, "/A/A/A.mp3", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s A/A/A.mp3 status = %d, want %d", method, w.Code, http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/joshkunz/fakelib/library"
+	"github.com/joshkunz/fakelib/metrics"
+)
+
+// httpMetrics are the metrics of a Handler or DAVHandler. All of its methods
+// can be called on nil, and do nothing.
+type httpMetrics struct {
+	requests  *metrics.Counter
+	latency   *metrics.Histogram
+	songBytes *metrics.Counter
+}
+
+func newMetrics(reg *metrics.Registry) *httpMetrics {
+	m := &httpMetrics{
+		requests:  reg.Counter("fakelib_http_requests_total", "HTTP requests, by method and status code.", "method", "code"),
+		latency:   reg.Histogram("fakelib_http_request_duration_seconds", "Latency of HTTP requests, by method.", metrics.DurationBuckets, "method"),
+		songBytes: reg.Counter("fakelib_http_song_bytes_total", "Bytes of songs read for responses, by source: the generated id3v2 tags (tag), or the golden MP3's audio data (audio).", "source"),
+	}
+	// Report every source, even before anything is read.
+	m.songBytes.Add(0, "tag")
+	m.songBytes.Add(0, "audio")
+	return m
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrument serves a request with `serve`, and records it.
+func (m *httpMetrics) instrument(w http.ResponseWriter, r *http.Request, serve func(http.ResponseWriter, *http.Request)) {
+	if m == nil {
+		serve(w, r)
+		return
+	}
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	serve(sw, r)
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	m.requests.Inc(r.Method, strconv.Itoa(sw.code))
+	m.latency.ObserveDuration(time.Since(start), r.Method)
+}
+
+// countingSong is a song that records the bytes read from it.
+type countingSong struct {
+	library.Song
+	m *httpMetrics
+}
+
+func (s countingSong) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := s.Song.ReadAt(buf, off)
+	fromTag := int(min(max(s.TagSize()-off, 0), int64(n)))
+	if fromTag > 0 {
+		s.m.songBytes.Add(float64(fromTag), "tag")
+	}
+	if n > fromTag {
+		s.m.songBytes.Add(float64(n-fromTag), "audio")
+	}
+	return n, err
+}
+
+// reader returns a reader of `song`, which records the bytes read.
+func (m *httpMetrics) reader(song library.Song) *io.SectionReader {
+	if m == nil {
+		return song.Reader()
+	}
+	return io.NewSectionReader(countingSong{song, m}, 0, song.Size())
+}
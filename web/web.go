@@ -0,0 +1,230 @@
+/*
+Package web serves a fake library over HTTP, for testing streaming clients
+and web players without FUSE.
+
+Typical Usage:
+
+	lib, err := library.New(...)
+	if err != nil {
+	    ...
+	}
+
+	h, err := web.NewHandler(lib)
+	if err != nil {
+	    ...
+	}
+	log.Fatal(http.ListenAndServe(":8080", h))
+
+Songs are served at their library path, with support for Range requests,
+conditional requests and ETags. Directories are served as an HTML listing, or
+as JSON if requested with "?format=json" or an "Accept: application/json"
+header.
+*/
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/joshkunz/fakelib/library"
+	"github.com/joshkunz/fakelib/metrics"
+)
+
+// Handler is an http.Handler that serves a library. The library must not be
+// modified while it is served.
+type Handler struct {
+	lib     *library.Library
+	paths   *library.PathMap
+	metrics *httpMetrics
+}
+
+// NewHandler returns a Handler that serves `lib`. An error is returned if
+// the library's paths collide, and the library's Collisions strategy does
+// not resolve them.
+func NewHandler(lib *library.Library) (*Handler, error) {
+	paths, err := lib.Paths()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate library paths: %w", err)
+	}
+	return &Handler{lib: lib, paths: paths}, nil
+}
+
+// SetMetrics adds metrics about the requests served by the handler to `reg`.
+// It must be called before the handler serves any requests.
+func (h *Handler) SetMetrics(reg *metrics.Registry) {
+	h.metrics = newMetrics(reg)
+}
+
+// ETag returns a strong entity tag for the contents of `song`. It doesn't
+// read the song's audio data, see library.Song.Hash.
+func ETag(song library.Song) string {
+	return fmt.Sprintf(`"%016x"`, song.Hash())
+}
+
+// name returns the library path of a request, and whether the request was
+// for a directory (had a trailing slash).
+func name(r *http.Request) (string, bool) {
+	p := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	return p, p == "" || strings.HasSuffix(r.URL.Path, "/")
+}
+
+// redirect redirects to the unescaped path `target`, relative to the
+// request's directory, and keeps the query string.
+func redirect(w http.ResponseWriter, r *http.Request, target string) {
+	// URL.String escapes the path, and adds "./" if its first segment could
+	// be mistaken for a scheme.
+	target = (&url.URL{Path: target}).String()
+	if q := r.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.metrics.instrument(w, r, h.serve)
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, wantDir := name(r)
+	if h.paths.IsDir(p) {
+		if !wantDir {
+			redirect(w, r, path.Base(p)+"/")
+			return
+		}
+		h.serveDir(w, r, p)
+		return
+	}
+	idx, ok := h.paths.Index(p)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if wantDir {
+		redirect(w, r, "../"+path.Base(p))
+		return
+	}
+	h.serveSong(w, r, idx, p)
+}
+
+func (h *Handler) serveSong(w http.ResponseWriter, r *http.Request, idx int, p string) {
+	song, err := h.lib.SongAt(idx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", ETag(song))
+	// ServeContent handles Range, If-Range and the other conditional
+	// headers, and sets the Content-Type from the file extension.
+	http.ServeContent(w, r, p, song.ModTime(), h.metrics.reader(song))
+}
+
+// Entry is an entry in a JSON directory listing.
+type Entry struct {
+	Name string `json:"name"`
+	// Dir is true for directories.
+	Dir bool `json:"dir,omitempty"`
+	// Index, Size and ModTime are only set for songs.
+	Index   *int       `json:"index,omitempty"`
+	Size    int64      `json:"size,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+}
+
+// Listing is a JSON directory listing.
+type Listing struct {
+	// Path is the path of the directory, relative to the library root. It
+	// is empty for the root.
+	Path    string  `json:"path"`
+	Entries []Entry `json:"entries"`
+}
+
+// wantsJSON returns true if the request asked for a JSON listing.
+func wantsJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func (h *Handler) listing(dir string) (Listing, error) {
+	entries, err := h.paths.ReadDir(dir)
+	if err != nil {
+		return Listing{}, err
+	}
+	l := Listing{Path: dir, Entries: make([]Entry, 0, len(entries))}
+	for _, e := range entries {
+		if e.IsDir() {
+			l.Entries = append(l.Entries, Entry{Name: e.Name, Dir: true})
+			continue
+		}
+		song, err := h.lib.SongAt(e.Index)
+		if err != nil {
+			return Listing{}, err
+		}
+		idx := e.Index
+		entry := Entry{Name: e.Name, Index: &idx, Size: song.Size()}
+		if t := song.ModTime(); !t.IsZero() {
+			entry.ModTime = &t
+		}
+		l.Entries = append(l.Entries, entry)
+	}
+	return l, nil
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"href": func(e Entry) string {
+		u := (&url.URL{Path: e.Name}).String()
+		if e.Dir {
+			u += "/"
+		}
+		return u
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>/{{.Path}}</title></head>
+<body>
+<h1>/{{.Path}}</h1>
+<ul>
+{{- if .Path}}
+<li><a href="../">../</a></li>
+{{- end}}
+{{- range .Entries}}
+<li><a href="{{href .}}">{{.Name}}{{if .Dir}}/{{end}}</a>{{if not .Dir}} ({{.Size}} bytes){{end}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+func (h *Handler) serveDir(w http.ResponseWriter, r *http.Request, dir string) {
+	l, err := h.listing(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Add("Vary", "Accept")
+		if r.Method != http.MethodHead {
+			json.NewEncoder(w).Encode(l)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Add("Vary", "Accept")
+	if r.Method != http.MethodHead {
+		listingTemplate.Execute(w, l)
+	}
+}
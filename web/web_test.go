@@ -0,0 +1,248 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bogem/id3v2/v2"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/joshkunz/fakelib/library"
+	"github.com/joshkunz/fakelib/metrics"
+)
+
+func newServer(t *testing.T, tracks int) (*httptest.Server, *library.Library) {
+	t.Helper()
+	lib, err := library.New(library.EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = tracks
+	h, err := NewHandler(lib)
+	if err != nil {
+		t.Fatalf("NewHandler(...) = _, %v; want _, nil", err)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv, lib
+}
+
+func get(t *testing.T, url string, header map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body of %s: %v", url, err)
+	}
+	return resp, body
+}
+
+func songBytes(t *testing.T, lib *library.Library, idx int) []byte {
+	t.Helper()
+	song, err := lib.SongAt(idx)
+	if err != nil {
+		t.Fatalf("lib.SongAt(%d) = _, %v; want _, nil", idx, err)
+	}
+	buf := make([]byte, song.Size())
+	song.ReadAt(buf, 0)
+	return buf
+}
+
+func TestServeSong(t *testing.T) {
+	srv, lib := newServer(t, 10)
+	want := songBytes(t, lib, 1)
+
+	resp, body := get(t, srv.URL+"/A/A/B.mp3", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET A/A/B.mp3 status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if string(body) != string(want) {
+		t.Errorf("GET A/A/B.mp3 returned %d bytes, not the song's %d bytes", len(body), len(want))
+	}
+	if got := resp.Header.Get("Content-Type"); got != "audio/mpeg" {
+		t.Errorf("GET A/A/B.mp3 Content-Type = %q, want %q", got, "audio/mpeg")
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("GET A/A/B.mp3 has no ETag")
+	}
+
+	resp, body = get(t, srv.URL+"/A/A/B.mp3", map[string]string{"Range": "bytes=10-19"})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != string(want[10:20]) {
+		t.Errorf("GET A/A/B.mp3 with Range = %d, %q; want %d, %q", resp.StatusCode, body, http.StatusPartialContent, want[10:20])
+	}
+
+	resp, _ = get(t, srv.URL+"/A/A/B.mp3", map[string]string{"Range": "bytes=10-19", "If-Range": etag})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("GET A/A/B.mp3 with matching If-Range status = %d, want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	resp, _ = get(t, srv.URL+"/A/A/B.mp3", map[string]string{"Range": "bytes=10-19", "If-Range": `"stale"`})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET A/A/B.mp3 with stale If-Range status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	resp, _ = get(t, srv.URL+"/A/A/B.mp3", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET A/A/B.mp3 with If-None-Match status = %d, want %d", resp.StatusCode, http.StatusNotModified)
+	}
+
+	if other, _ := get(t, srv.URL+"/A/A/C.mp3", nil); other.Header.Get("ETag") == etag {
+		t.Errorf("A/A/B.mp3 and A/A/C.mp3 have the same ETag %s", etag)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	srv, _ := newServer(t, 10)
+
+	if resp, _ := get(t, srv.URL+"/A/A/Z.mp3", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET A/A/Z.mp3 status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	resp, err := http.Post(srv.URL+"/A/A/B.mp3", "text/plain", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST A/A/B.mp3 status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	for _, test := range []struct{ path, location string }{
+		{"/A/A", "A/"},
+		{"/A/A/B.mp3/", "../B.mp3"},
+	} {
+		resp, _ := get(t, srv.URL+test.path, nil)
+		if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != test.location {
+			t.Errorf("GET %s = %d, Location %q; want %d, %q", test.path, resp.StatusCode, resp.Header.Get("Location"), http.StatusMovedPermanently, test.location)
+		}
+	}
+}
+
+func TestRedirectEscaping(t *testing.T) {
+	lib, err := library.New(library.EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 1
+	lib.Pather = func(int, *id3v2.Tag) string { return "50% #1?/a:b #2.mp3" }
+	h, err := NewHandler(lib)
+	if err != nil {
+		t.Fatalf("NewHandler(...) = _, %v; want _, nil", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, test := range []struct{ path, location string }{
+		{"/50%25%20%231%3F", "50%25%20%231%3F/"},
+		{"/50%25%20%231%3F/a:b%20%232.mp3/", "../a:b%20%232.mp3"},
+	} {
+		resp, _ := get(t, srv.URL+test.path, nil)
+		if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != test.location {
+			t.Errorf("GET %s = %d, Location %q; want %d, %q", test.path, resp.StatusCode, resp.Header.Get("Location"), http.StatusMovedPermanently, test.location)
+		}
+	}
+	// A name with a colon isn't mistaken for a URL scheme.
+	lib.Pather = func(int, *id3v2.Tag) string { return "a:b/c.mp3" }
+	if h, err = NewHandler(lib); err != nil {
+		t.Fatalf("NewHandler(...) = _, %v; want _, nil", err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a:b", nil))
+	if got, want := rec.Header().Get("Location"), "./a:b/"; got != want {
+		t.Errorf("GET /a:b Location = %q, want %q", got, want)
+	}
+}
+
+func TestServeListing(t *testing.T) {
+	srv, lib := newServer(t, 12)
+
+	resp, body := get(t, srv.URL+"/A/B/?format=json", nil)
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Fatalf("GET A/B/?format=json Content-Type = %q, want application/json", got)
+	}
+	var l Listing
+	if err := json.Unmarshal(body, &l); err != nil {
+		t.Fatalf("Failed to parse listing %s: %v", body, err)
+	}
+	var names []string
+	for _, e := range l.Entries {
+		names = append(names, e.Name)
+		if e.Dir || e.Index == nil || e.Size != int64(len(songBytes(t, lib, *e.Index))) {
+			t.Errorf("Listing entry %+v is not a song with the right size", e)
+		}
+	}
+	if diff := cmp.Diff([]string{"A.mp3", "B.mp3"}, names); diff != "" {
+		t.Errorf("GET A/B/ listing diff (want -> got):\n%s", diff)
+	}
+
+	_, body = get(t, srv.URL+"/", map[string]string{"Accept": "application/json"})
+	if err := json.Unmarshal(body, &l); err != nil {
+		t.Fatalf("Failed to parse listing %s: %v", body, err)
+	}
+	if len(l.Entries) != 1 || !l.Entries[0].Dir || l.Entries[0].Name != "A" {
+		t.Errorf("GET / listing = %+v, want only directory A", l)
+	}
+
+	resp, body = get(t, srv.URL+"/A/", nil)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("GET A/ Content-Type = %q, want HTML", resp.Header.Get("Content-Type"))
+	}
+	for _, link := range []string{`href="../"`, `href="A/"`, `href="B/"`} {
+		if !strings.Contains(string(body), link) {
+			t.Errorf("GET A/ HTML listing does not contain %s:\n%s", link, body)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	lib, err := library.New(library.EmbeddedGoldMP3())
+	if err != nil {
+		t.Fatalf("Failed to create new library: %v", err)
+	}
+	lib.Tracks = 12
+	h, err := NewHandler(lib)
+	if err != nil {
+		t.Fatalf("NewHandler(...) = _, %v; want _, nil", err)
+	}
+	reg := metrics.NewRegistry()
+	h.SetMetrics(reg)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	song, err := lib.SongAt(0)
+	if err != nil {
+		t.Fatalf("lib.SongAt(0) = _, %v; want _, nil", err)
+	}
+	get(t, srv.URL+"/A/A/A.mp3", nil)
+	get(t, srv.URL+"/A/A/A.mp3", map[string]string{"Range": "bytes=0-9"})
+	get(t, srv.URL+"/nothing", nil)
+
+	var b strings.Builder
+	reg.WriteTo(&b)
+	for _, want := range []string{
+		`fakelib_http_requests_total{method="GET",code="200"} 1`,
+		`fakelib_http_requests_total{method="GET",code="206"} 1`,
+		`fakelib_http_requests_total{method="GET",code="404"} 1`,
+		`fakelib_http_request_duration_seconds_count{method="GET"} 3`,
+		fmt.Sprintf(`fakelib_http_song_bytes_total{source="tag"} %d`, song.TagSize()+10),
+		fmt.Sprintf(`fakelib_http_song_bytes_total{source="audio"} %d`, song.Size()-song.TagSize()),
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("Metrics do not contain %s:\n%s", want, b.String())
+		}
+	}
+}